@@ -1,26 +1,234 @@
 package errors
 
 import (
+	"encoding/json"
+	goerrors "errors"
 	"html"
+	"log/slog"
+	"mime"
 	"net/http"
+	"strings"
 )
 
+/*
+ * stable codes identifying errors to clients; an error without a code is
+ * reported with the code for its status
+ */
+const (
+	CODE_BAD_REQUEST = "bad_request"
+	CODE_UNAUTHORIZED = "unauthorized"
+	CODE_FORBIDDEN = "forbidden"
+	CODE_NOT_FOUND = "not_found"
+	CODE_CONFLICT = "conflict"
+	CODE_TOO_LARGE = "request_too_large"
+	CODE_UNPROCESSABLE = "unprocessable"
+	CODE_TOO_MANY_REQUESTS = "too_many_requests"
+	CODE_DEPENDENCY_FAILED = "dependency_failed"
+	CODE_INTERNAL = "internal_error"
+	CODE_UNAVAILABLE = "unavailable"
+
+	CODE_INVALID_BODY = "invalid_body"
+	CODE_INVALID_PARAMETER = "invalid_parameter"
+	CODE_CREDENTIALS_REQUIRED = "credentials_required"
+	CODE_PASSWORD_INVALID = "password_invalid"
+	CODE_ACCOUNT_LOCKED = "account_locked"
+	CODE_RESET_TOKEN_INVALID = "reset_token_invalid"
+	CODE_RESET_TOKEN_EXPIRED = "reset_token_expired"
+	CODE_TOKEN_INVALID = "token_invalid"
+	CODE_TOKEN_EXPIRED = "token_expired"
+	CODE_TOKEN_NOT_FOUND = "token_not_found"
+	CODE_TOKEN_SCOPE = "token_scope"
+	CODE_INSUFFICIENT_PERMISSIONS = "insufficient_permissions"
+	CODE_NODE_SECRET_INVALID = "node_secret_invalid"
+	CODE_USER_REQUIRED = "user_required"
+	CODE_USER_NOT_FOUND = "user_not_found"
+	CODE_USER_CONFLICT = "user_conflict"
+	CODE_EMAIL_TAKEN = "email_taken"
+	CODE_CHECKLIST_NOT_FOUND = "checklist_not_found"
+	CODE_CHECKLIST_EXISTS = "checklist_exists"
+	CODE_CHECKLIST_INVALID = "checklist_invalid"
+	CODE_SETTING_NOT_FOUND = "setting_not_found"
+
+	// OAuth2 error codes, as in RFC 6749
+	CODE_INVALID_REQUEST = "invalid_request"
+	CODE_INVALID_CLIENT = "invalid_client"
+	CODE_INVALID_GRANT = "invalid_grant"
+	CODE_INVALID_SCOPE = "invalid_scope"
+	CODE_UNSUPPORTED_GRANT_TYPE = "unsupported_grant_type"
+	CODE_UNSUPPORTED_RESPONSE_TYPE = "unsupported_response_type"
+	CODE_ACCESS_DENIED = "access_denied"
+)
+
+/*
+ * sentinels matched by errors.Is; an error matches the sentinel given as its
+ * Kind, or if it has none, the sentinel for its status
+ */
+var (
+	ErrNotFound = goerrors.New("not found")
+	ErrConflict = goerrors.New("conflict")
+	ErrUnauthorized = goerrors.New("unauthorized")
+	ErrUpstream = goerrors.New("upstream failure")
+	ErrRateLimited = goerrors.New("rate limited")
+)
+
+var statusKinds = map[int]error{
+	401: ErrUnauthorized,
+	403: ErrUnauthorized,
+	404: ErrNotFound,
+	409: ErrConflict,
+	424: ErrUpstream,
+	429: ErrRateLimited,
+	502: ErrUpstream,
+	503: ErrUpstream,
+	504: ErrUpstream,
+}
+
+var statusCodes = map[int]string{
+	400: CODE_BAD_REQUEST,
+	401: CODE_UNAUTHORIZED,
+	403: CODE_FORBIDDEN,
+	404: CODE_NOT_FOUND,
+	409: CODE_CONFLICT,
+	413: CODE_TOO_LARGE,
+	422: CODE_UNPROCESSABLE,
+	429: CODE_TOO_MANY_REQUESTS,
+	424: CODE_DEPENDENCY_FAILED,
+	500: CODE_INTERNAL,
+	503: CODE_UNAVAILABLE,
+}
+
+/*
+ * Cause is the underlying error, if any, and Context holds the lines added by
+ * Prepend, outermost first
+ */
 type PreflightError struct {
 	Status int
+	Code string
+	Kind error
+	Cause error
+	Context []string
 	InternalMessage string
 	ExternalMessage string
 }
 
+type errorResponse struct {
+	Code string    `json:"code"`
+	Message string `json:"message"`
+	Status int     `json:"status"`
+}
+
 func (e PreflightError) Error() string {
-	return e.InternalMessage
+	if len(e.Context) == 0 {
+		return e.InternalMessage
+	}
+	return strings.Join(e.Context, "\n\t") + "\n\t" + e.InternalMessage
 }
 
 func (e *PreflightError) Prepend(line string) *PreflightError {
-	e.InternalMessage = line + "\n\t" + e.InternalMessage
+	e.Context = append([]string{line}, e.Context...)
 	return e
 }
 
-func (e *PreflightError) WriteResponse(w http.ResponseWriter) {
+func (e *PreflightError) Unwrap() error {
+	if e == nil {
+		return nil
+	}
+	return e.Cause
+}
+
+func (e *PreflightError) Is(target error) bool {
+	if e == nil {
+		return false
+	}
+	if e.Kind != nil {
+		return e.Kind == target
+	}
+	kind, found := statusKinds[e.Status]
+	return found && kind == target
+}
+
+/*
+ * logs the error as a group of its fields, so that log lines stay on one line
+ */
+func (e *PreflightError) LogValue() slog.Value {
+	attrs := []slog.Attr{
+		slog.Int("status", e.Status),
+		slog.String("code", e.GetCode()),
+		slog.String("message", e.InternalMessage),
+	}
+	if len(e.Context) > 0 {
+		context := make([]string, len(e.Context))
+		for i, line := range e.Context {
+			context[i] = strings.TrimSuffix(strings.TrimSpace(line), ":")
+		}
+		attrs = append(attrs, slog.Any("context", context))
+	}
+	return slog.GroupValue(attrs...)
+}
+
+/*
+ * Is and As are those of the standard errors package, which this package
+ * shadows
+ */
+func Is(err, target error) bool {
+	return goerrors.Is(err, target)
+}
+
+func As(err error, target interface{}) bool {
+	return goerrors.As(err, target)
+}
+
+/*
+ * returns the error's code, or the code for its status if it has none
+ */
+func (e *PreflightError) GetCode() string {
+	if e.Code != "" {
+		return e.Code
+	}
+	code, found := statusCodes[e.Status]
+	if ! found {
+		return CODE_INTERNAL
+	}
+	return code
+}
+
+/*
+ * writes the error as json if the request accepts application/json, and as
+ * plain text otherwise, for older clients
+ */
+func (e *PreflightError) WriteResponse(w http.ResponseWriter, r *http.Request) {
+	if ! acceptsJson(r) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(e.Status)
+		w.Write([]byte(html.EscapeString(e.ExternalMessage)))
+		return
+	}
+
+	body, err := json.Marshal(errorResponse{
+		Code: e.GetCode(),
+		Message: e.ExternalMessage,
+		Status: e.Status,
+	})
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(e.Status)
-	w.Write([]byte(html.EscapeString(e.ExternalMessage)))
+	w.Write(body)
+}
+
+func acceptsJson(r *http.Request) bool {
+	if r == nil {
+		return false
+	}
+	for _, accept := range r.Header.Values("Accept") {
+		for _, mediaRange := range strings.Split(accept, ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+			if err == nil && mediaType == "application/json" {
+				return true
+			}
+		}
+	}
+	return false
 }
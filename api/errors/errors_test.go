@@ -0,0 +1,122 @@
+package errors
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGetCode(t *testing.T) {
+	cases := []struct{
+		err PreflightError
+		code string
+	}{
+		{PreflightError{Status: 404, Code: CODE_CHECKLIST_NOT_FOUND}, CODE_CHECKLIST_NOT_FOUND},
+		{PreflightError{Status: 404}, CODE_NOT_FOUND},
+		{PreflightError{Status: 409}, CODE_CONFLICT},
+		{PreflightError{Status: 429}, CODE_TOO_MANY_REQUESTS},
+		{PreflightError{Status: 503}, CODE_UNAVAILABLE},
+		{PreflightError{Status: 418}, CODE_INTERNAL},
+	}
+	for _, c := range cases {
+		if code := c.err.GetCode(); code != c.code {
+			t.Logf("code wrong for %+v: expected %s, got %s", c.err, c.code, code)
+			t.Fail()
+		}
+	}
+}
+
+func TestWriteResponse(t *testing.T) {
+	err := &PreflightError{
+		Status: 404,
+		Code: CODE_CHECKLIST_NOT_FOUND,
+		InternalMessage: "commands.GetChecklist: checklist \"foo\" not found",
+		ExternalMessage: "Checklist <foo> not found.",
+	}
+	cases := []struct{
+		name string
+		accept []string
+		json bool
+	}{
+		{"json", []string{"application/json"}, true},
+		{"json with parameters", []string{"text/html;q=0.9, application/json;q=0.8"}, true},
+		{"json in second header", []string{"text/html", "application/json"}, true},
+		{"any", []string{"*/*"}, false},
+		{"absent", nil, false},
+		{"plain text", []string{"text/plain"}, false},
+		{"malformed", []string{";;;"}, false},
+	}
+	for _, c := range cases {
+		r := httptest.NewRequest("GET", "/checklists/foo", nil)
+		for _, accept := range c.accept {
+			r.Header.Add("Accept", accept)
+		}
+		w := httptest.NewRecorder()
+		err.WriteResponse(w, r)
+
+		if w.Code != 404 {
+			t.Logf("%s: status wrong: expected 404, got %d", c.name, w.Code)
+			t.Fail()
+		}
+		contentType := w.Header().Get("Content-Type")
+		if ! c.json {
+			if contentType != "text/plain; charset=utf-8" {
+				t.Logf("%s: content type wrong: expected text/plain, got %s", c.name, contentType)
+				t.Fail()
+			}
+			if body := w.Body.String(); body != "Checklist &lt;foo&gt; not found." {
+				t.Logf("%s: body wrong: got %s", c.name, body)
+				t.Fail()
+			}
+			continue
+		}
+
+		if contentType != "application/json" {
+			t.Logf("%s: content type wrong: expected application/json, got %s", c.name, contentType)
+			t.Fail()
+		}
+		body := make(map[string]interface{})
+		jsonErr := json.Unmarshal(w.Body.Bytes(), &body)
+		if jsonErr != nil {
+			t.Logf("%s: error parsing body %s: %s", c.name, w.Body.String(), jsonErr.Error())
+			t.Fail()
+			continue
+		}
+		expected := map[string]interface{}{
+			"code": CODE_CHECKLIST_NOT_FOUND,
+			"message": "Checklist <foo> not found.",
+			"status": float64(404),
+		}
+		if len(body) != len(expected) {
+			t.Logf("%s: body wrong: expected %v, got %v", c.name, expected, body)
+			t.Fail()
+		}
+		for key, value := range expected {
+			if body[key] != value {
+				t.Logf("%s: %s wrong: expected %v, got %v", c.name, key, value, body[key])
+				t.Fail()
+			}
+		}
+	}
+
+	// an error without a code is reported with the code for its status
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Accept", "application/json")
+	(&PreflightError{Status: 503, ExternalMessage: "down"}).WriteResponse(w, r)
+	body := errorResponse{}
+	jsonErr := json.Unmarshal(w.Body.Bytes(), &body)
+	if jsonErr != nil || body.Code != CODE_UNAVAILABLE || body.Status != 503 {
+		t.Logf("fallback code wrong: got %s", w.Body.String())
+		t.Fail()
+	}
+
+	// with no request, as when writing outside a handler, plain text is used
+	w = httptest.NewRecorder()
+	err.WriteResponse(w, nil)
+	if w.Header().Get("Content-Type") != "text/plain; charset=utf-8" || w.Code != http.StatusNotFound {
+		t.Logf("response wrong without request: %d %s", w.Code, w.Header().Get("Content-Type"))
+		t.Fail()
+	}
+}
@@ -1,18 +1,40 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"github.com/jsutton9/preflight/api/errors"
 	"github.com/jsutton9/preflight/commands"
+	"github.com/jsutton9/preflight/metrics"
 	"github.com/jsutton9/preflight/persistence"
+	"github.com/jsutton9/preflight/ratelimit"
+	"github.com/jsutton9/preflight/scheduler"
 	"github.com/jsutton9/preflight/security"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
+/*
+ * records the uses of tokens accepted by validate
+ */
+var usage *commands.UsageTracker
+
+/*
+ * the limits on password attempts, which handlePassword also applies to
+ * password changes made with a token
+ */
+var logins *loginLimits
+
 func main() {
 	if len(os.Args) != 2 {
 		fmt.Println("Usage: preflight-api CONFIG_FILE")
@@ -32,6 +54,22 @@ func main() {
 		return
 	}
 	defer logger.Close()
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			err := logger.Reopen()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err.Prepend("api.main: error reopening log: ").Error())
+			}
+		}
+	}()
+	err = settings.LoadTokenKey()
+	if err != nil {
+		err.Prepend("api.main: error loading token key: ")
+		fmt.Println(err.Error())
+		return
+	}
 	persister, err := settings.GetPersister()
 	if err != nil {
 		err.Prepend("api.main: error getting persister: ")
@@ -39,11 +77,27 @@ func main() {
 		return
 	}
 	defer persister.Close()
+	usage = commands.NewUsageTracker(time.Duration(settings.TokenUsageInterval) * time.Second)
+	go usage.Run(persister, logger.With("component", "usage"))
+
+	// a bolt file can be open in only one process, so the scheduler runs here
+	var s *scheduler.Scheduler
+	if settings.DatabaseType == "bolt" {
+		s = scheduler.New(settings, persister, logger.With("component", "scheduler"))
+		go s.Run()
+	}
 
-	e_handleUsers := encloseHandler(handleUsers, settings, logger, persister)
-	e_handleChecklists := encloseHandler(handleChecklists, settings, logger, persister)
-	e_handleTokens := encloseHandler(handleTokens, settings, logger, persister)
-	e_handleSettings := encloseHandler(handleSettings, settings, logger, persister)
+	e_handleUsers := encloseHandler("users", handleUsers, settings, logger, persister)
+	e_handleChecklists := encloseHandler("checklists", handleChecklists, settings, logger, persister)
+	logins = newLoginLimits(settings)
+	e_handleTokens := encloseHandler("tokens", limitLogins(handleTokens, logins), settings, logger, persister)
+	e_handlePassword := encloseHandler("password", limitLogins(handlePassword, logins), settings, logger, persister)
+	e_handleAuthorize := encloseHandler("oauthAuthorize", limitLogins(handleAuthorize, logins), settings, logger, persister)
+	e_handleOAuthToken := encloseHandler("oauthToken", handleOAuthToken, settings, logger, persister)
+	e_handleSettings := encloseHandler("settings", handleSettings, settings, logger, persister)
+	e_handleAudit := encloseHandler("audit", handleAudit, settings, logger, persister)
+	e_handleReady := encloseHandler("readyz", handleReady, settings, logger, persister)
+	e_handleHealth := encloseHandler("healthz", handleHealth, settings, logger, persister)
 
 	http.HandleFunc("/users", e_handleUsers)
 	http.HandleFunc("/users/", e_handleUsers)
@@ -51,21 +105,66 @@ func main() {
 	http.HandleFunc("/checklists/", e_handleChecklists)
 	http.HandleFunc("/tokens", e_handleTokens)
 	http.HandleFunc("/tokens/", e_handleTokens)
+	http.HandleFunc("/password", e_handlePassword)
+	http.HandleFunc("/password/", e_handlePassword)
+	http.HandleFunc("/oauth/authorize", e_handleAuthorize)
+	http.HandleFunc("/oauth/token", e_handleOAuthToken)
 	http.HandleFunc("/settings", e_handleSettings)
 	http.HandleFunc("/settings/", e_handleSettings)
+	http.HandleFunc("/audit", e_handleAudit)
+	http.HandleFunc("/readyz", e_handleReady)
+	http.HandleFunc("/healthz", e_handleHealth)
+	http.Handle("/metrics", metrics.Handler())
 
-	portString := ":" + strconv.Itoa(settings.Port)
-	log.Fatal(http.ListenAndServeTLS(portString, settings.CertFile, settings.KeyFile, nil))
+	server := &http.Server{
+		Addr: ":" + strconv.Itoa(settings.Port),
+		ReadHeaderTimeout: time.Duration(settings.ServerReadTimeout) * time.Second,
+		ReadTimeout: time.Duration(settings.ServerReadTimeout) * time.Second,
+		WriteTimeout: time.Duration(settings.ServerWriteTimeout) * time.Second,
+		IdleTimeout: time.Duration(settings.ServerIdleTimeout) * time.Second,
+		ErrorLog: slog.NewLogLogger(logger.Handler(), slog.LevelWarn),
+	}
+
+	// on SIGTERM, stop accepting requests and wait for those in progress,
+	// so that the deferred closes of the persister and logger come after them
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-signals
+		logger.Info("shutting down", "signal", sig.String())
+		ctx, cancel := context.WithTimeout(context.Background(),
+			time.Duration(settings.ServerShutdownTimeout) * time.Second)
+		defer cancel()
+		shutdownErr := server.Shutdown(ctx)
+		if shutdownErr != nil {
+			logger.Error("requests still in progress at shutdown timeout", "error", shutdownErr)
+		}
+		if s != nil {
+			s.Stop()
+		}
+		close(stopped)
+	}()
+
+	logger.Info("listening", "port", settings.Port)
+	serveErr := server.ListenAndServeTLS(settings.CertFile, settings.KeyFile)
+	if serveErr != http.ErrServerClosed {
+		logger.Error("server stopped", "error", serveErr)
+		return
+	}
+	<-stopped
+	usage.Stop()
+	logger.Info("shut down")
 }
 
-func handleUsers(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *persistence.LoggerCloser, persister *persistence.Persister) {
+func handleUsers(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
 	pathWords := getPathWords(r)
 
-	_, err := validate(r, security.PermissionFlags{}, true, persister)
+	_, actor, err := validate(r, settings, security.PermissionFlags{}, "", true, logger, persister)
 	if err != nil {
 		err.Prepend("api.handleUsers: error validating request: ")
-		logger.Println(err.Error())
-		err.WriteResponse(w)
+		logger.logError(err)
+		err.WriteResponse(w, r)
 		return
 	}
 
@@ -73,15 +172,15 @@ func handleUsers(w http.ResponseWriter, r *http.Request, settings *persistence.S
 		body, err := readBody(r, 1000)
 		if err != nil {
 			err.Prepend("api.handleUsers: error reading body: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		id, err := commands.AddUser(body, persister)
 		if err != nil {
 			err.Prepend("api.handleUsers: error adding user: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		w.WriteHeader(201)
@@ -91,80 +190,159 @@ func handleUsers(w http.ResponseWriter, r *http.Request, settings *persistence.S
 		err = commands.DeleteUser(id, persister)
 		if err != nil {
 			err.Prepend("api.handleUsers: error deleting user: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		w.WriteHeader(204)
+	} else if strings.EqualFold(r.Method, "POST") && len(pathWords) == 3 && pathWords[2] == "passwordReset" {
+		id := pathWords[1]
+		validFor := time.Duration(settings.PasswordResetMinutes) * time.Minute
+		resetString, err := commands.IssuePasswordReset(id, validFor, actor, persister)
+		if err != nil {
+			err.Prepend("api.handleUsers: error issuing password reset: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+		w.WriteHeader(201)
+		w.Write([]byte(resetString))
 	} else {
 		w.WriteHeader(404)
 	}
 }
 
-func handleChecklists(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *persistence.LoggerCloser, persister *persistence.Persister) {
+func handlePassword(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
 	pathWords := getPathWords(r)
 
+	if strings.EqualFold(r.Method, "POST") && len(pathWords) == 1 {
+		permissions := security.PermissionFlags{GeneralWrite: true}
+		id, actor, err := validate(r, settings, permissions, "", false, logger, persister)
+		if err != nil {
+			err.Prepend("api.handlePassword: error validating token: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+
+		// the current password is checked, so the request is throttled like
+		// any other password attempt on the account
+		email, err := commands.GetEmail(id, persister)
+		if err != nil {
+			err.Prepend("api.handlePassword: error getting user: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+		if ! logins.allowAddress(w, r, logger) || ! logins.allowAccount(w, r, logger, email) {
+			return
+		}
+
+		body, err := readBody(r, 1000)
+		if err != nil {
+			err.Prepend("api.handlePassword: error reading body: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+		err = commands.UpdatePassword(id, body, actor, persister)
+		if err != nil {
+			err.Prepend("api.handlePassword: error changing password: ")
+			logger.logError(err)
+			logins.record(r, err.Status, email, logger, persister)
+			err.WriteResponse(w, r)
+			return
+		}
+		logins.record(r, 204, email, logger, persister)
+		w.WriteHeader(204)
+	} else if strings.EqualFold(r.Method, "POST") && len(pathWords) == 2 && pathWords[1] == "reset" {
+		body, err := readBody(r, 1000)
+		if err != nil {
+			err.Prepend("api.handlePassword: error reading body: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+		err = commands.ResetPassword(body, persister)
+		if err != nil {
+			err.Prepend("api.handlePassword: error resetting password: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+		w.WriteHeader(204)
+	} else {
+		w.WriteHeader(404)
+	}
+}
+
+func handleChecklists(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
+	pathWords := getPathWords(r)
+	checklistName := ""
+	if len(pathWords) > 1 {
+		checklistName = pathWords[1]
+	}
+
 	if strings.EqualFold(r.Method, "GET") && len(pathWords) == 1 {
 		permissions := security.PermissionFlags{ChecklistRead: true}
-		id, err := validate(r, permissions, false, persister)
+		id, _, err := validate(r, settings, permissions, checklistName, false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleChecklists: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		checklistsString, err := commands.GetChecklistsString(id, persister)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error getting checklists: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		w.WriteHeader(200)
 		w.Write([]byte(checklistsString))
 	} else if strings.EqualFold(r.Method, "GET") && len(pathWords) == 2 {
 		permissions := security.PermissionFlags{ChecklistRead: true}
-		id, err := validate(r, permissions, false, persister)
+		id, _, err := validate(r, settings, permissions, checklistName, false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleChecklists: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
-		checklistName := pathWords[1]
 		checklistString, err := commands.GetChecklistString(id, checklistName, persister)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error getting checklist: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		w.WriteHeader(200)
 		w.Write([]byte(checklistString))
 	} else if strings.EqualFold(r.Method, "POST") && len(pathWords) == 1 {
 		permissions := security.PermissionFlags{ChecklistWrite: true}
-		id, err := validate(r, permissions, false, persister)
+		id, actor, err := validate(r, settings, permissions, checklistName, false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleChecklists: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		body, err := readBody(r, 10000)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error reading body: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
-		checklistName, err := commands.AddChecklist(id, body, persister)
+		checklistName, err = commands.AddChecklist(id, body, actor, persister)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error adding checklist: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		newUrl := "https://" + r.Host + "/checklists/" + checklistName
@@ -174,66 +352,63 @@ func handleChecklists(w http.ResponseWriter, r *http.Request, settings *persiste
 	} else if strings.EqualFold(r.Method, "POST") && len(pathWords) == 3 &&
 			strings.EqualFold(pathWords[2], "invoke") {
 		permissions := security.PermissionFlags{ChecklistInvoke: true}
-		id, err := validate(r, permissions, false, persister)
+		id, actor, err := validate(r, settings, permissions, checklistName, false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleChecklists: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
-		checklistName := pathWords[1]
-		err = commands.Invoke(id, checklistName, settings.TrelloAppKey, persister)
+		err = commands.Invoke(id, checklistName, settings.TrelloAppKey, actor, logger.Logger, persister)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error invoking checklist: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		w.WriteHeader(204)
 	} else if strings.EqualFold(r.Method, "PUT") && len(pathWords) == 2 {
 		permissions := security.PermissionFlags{ChecklistWrite: true}
-		id, err := validate(r, permissions, false, persister)
+		id, actor, err := validate(r, settings, permissions, checklistName, false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleChecklists: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
-		checklistName := pathWords[1]
 		body, err := readBody(r, 10000)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error reading body: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
-		err = commands.UpdateChecklist(id, checklistName, body, persister)
+		err = commands.UpdateChecklist(id, checklistName, body, actor, persister)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error updating checklist: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		w.WriteHeader(204)
 	} else if strings.EqualFold(r.Method, "DELETE") && len(pathWords) == 2 {
 		permissions := security.PermissionFlags{ChecklistWrite: true}
-		id, err := validate(r, permissions, false, persister)
+		id, actor, err := validate(r, settings, permissions, checklistName, false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleChecklists: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
-		checklistName := pathWords[1]
-		err = commands.DeleteChecklist(id, checklistName, persister)
+		err = commands.DeleteChecklist(id, checklistName, actor, persister)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error deleting checklist: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		w.WriteHeader(204)
@@ -242,24 +417,24 @@ func handleChecklists(w http.ResponseWriter, r *http.Request, settings *persiste
 	}
 }
 
-func handleTokens(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *persistence.LoggerCloser, persister *persistence.Persister) {
+func handleTokens(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
 	pathWords := getPathWords(r)
 
 	if strings.EqualFold(r.Method, "GET") && len(pathWords) == 1 {
 		permissions := security.PermissionFlags{GeneralRead: true}
-		id, err := validate(r, permissions, false, persister)
+		id, _, err := validate(r, settings, permissions, "", false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleTokens: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		tokensString, err := commands.GetTokens(id, persister)
 		if err != nil {
 			err.Prepend("api.handleTokens: error getting tokens: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
@@ -270,40 +445,43 @@ func handleTokens(w http.ResponseWriter, r *http.Request, settings *persistence.
 		if ! ok {
 			err := &errors.PreflightError{
 				Status: 401,
+				Code: errors.CODE_CREDENTIALS_REQUIRED,
 				InternalMessage: "api.handleTokens: no basic auth header",
 				ExternalMessage: "Basic authentication is required to add a token.",
 			}
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		id, err := commands.GetUserIdFromEmail(username, persister)
 		if err != nil {
 			err = err.Prepend("api.handleTokens: error getting user: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		err = commands.ValidatePassword(id, password, persister)
 		if err != nil {
 			err = err.Prepend("api.handleTokens: error validating password: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
+		actor := persistence.Actor{Type: persistence.ACTOR_PASSWORD}
+
 		body, err := readBody(r, 10000)
 		if err != nil {
 			err = err.Prepend("api.handleTokens: error reading body: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
-		tokenString, err := commands.AddToken(id, body, persister)
+		tokenString, err := commands.AddToken(id, body, actor, persister)
 		if err != nil {
 			err = err.Prepend("api.handleTokens: error adding token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
@@ -311,58 +489,115 @@ func handleTokens(w http.ResponseWriter, r *http.Request, settings *persistence.
 		w.Write([]byte(tokenString))
 	} else if strings.EqualFold(r.Method, "DELETE") && len(pathWords) == 2 {
 		permissions := security.PermissionFlags{GeneralWrite: true}
-		id, err := validate(r, permissions, false, persister)
+		id, actor, err := validate(r, settings, permissions, "", false, logger, persister)
 		if err != nil {
 			err = err.Prepend("api.handleTokens: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		tokenId := pathWords[1]
-		err = commands.DeleteToken(id, tokenId, persister)
+		err = commands.DeleteToken(id, tokenId, actor, persister)
 		if err != nil {
 			err = err.Prepend("api.handleTokens: error deleting token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		w.WriteHeader(204)
+	} else if strings.EqualFold(r.Method, "GET") && len(pathWords) == 2 && pathWords[1] == "self" {
+		id, actor, err := validate(r, settings, security.PermissionFlags{}, "", false, logger, persister)
+		if err != nil {
+			err = err.Prepend("api.handleTokens: error validating token: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+		if actor.Type != persistence.ACTOR_TOKEN {
+			err = &errors.PreflightError{
+				Status: 400,
+				InternalMessage: "api.handleTokens: token introspection without token",
+				ExternalMessage: "Only a token can be introspected.",
+			}
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+
+		tokenString, err := commands.GetToken(id, actor.Id, persister)
+		if err != nil {
+			err = err.Prepend("api.handleTokens: error getting token: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write([]byte(tokenString))
+	} else if strings.EqualFold(r.Method, "POST") && len(pathWords) == 3 && pathWords[2] == "rotate" {
+		permissions := security.PermissionFlags{GeneralWrite: true}
+		id, actor, err := validate(r, settings, permissions, "", false, logger, persister)
+		if err != nil {
+			err = err.Prepend("api.handleTokens: error validating token: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+
+		body, err := readBody(r, 1000)
+		if err != nil {
+			err = err.Prepend("api.handleTokens: error reading body: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+		grace := time.Duration(settings.TokenGraceMinutes) * time.Minute
+		tokenString, err := commands.RotateToken(id, pathWords[1], body, grace, actor, persister)
+		if err != nil {
+			err = err.Prepend("api.handleTokens: error rotating token: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write([]byte(tokenString))
 	} else {
 		w.WriteHeader(404)
 	}
 }
 
-func handleSettings(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *persistence.LoggerCloser, persister *persistence.Persister) {
+func handleSettings(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
 	pathWords := getPathWords(r)
 
 	if strings.EqualFold(r.Method, "GET") && len(pathWords) == 1 {
 		permissions := security.PermissionFlags{GeneralRead: true}
-		id, err := validate(r, permissions, false, persister)
+		id, _, err := validate(r, settings, permissions, "", false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleSettings: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		settingsString, err := commands.GetGeneralSettings(id, persister)
 		if err != nil {
 			err = err.Prepend("api.handleSettings: error getting settings: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 		w.WriteHeader(200)
 		w.Write([]byte(settingsString))
 	} else if strings.EqualFold(r.Method, "PUT") && len(pathWords) == 2 {
 		permissions := security.PermissionFlags{GeneralWrite: true}
-		id, err := validate(r, permissions, false, persister)
+		id, _, err := validate(r, settings, permissions, "", false, logger, persister)
 		if err != nil {
 			err.Prepend("api.handleSettings: error validating token: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
@@ -370,16 +605,16 @@ func handleSettings(w http.ResponseWriter, r *http.Request, settings *persistenc
 		settingValue, err := readBody(r, 10000)
 		if err != nil {
 			err = err.Prepend("api.handleSettings: error reading body: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
 		err = commands.SetGeneralSetting(id, settingName, settingValue, persister)
 		if err != nil {
 			err = err.Prepend("api.handleChecklists: error setting setting: ")
-			logger.Println(err.Error())
-			err.WriteResponse(w)
+			logger.logError(err)
+			err.WriteResponse(w, r)
 			return
 		}
 
@@ -389,6 +624,87 @@ func handleSettings(w http.ResponseWriter, r *http.Request, settings *persistenc
 	}
 }
 
+func handleAudit(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
+	pathWords := getPathWords(r)
+
+	if strings.EqualFold(r.Method, "GET") && len(pathWords) == 1 {
+		permissions := security.PermissionFlags{GeneralRead: true}
+		id, _, err := validate(r, settings, permissions, "", false, logger, persister)
+		if err != nil {
+			err.Prepend("api.handleAudit: error validating token: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+
+		limit := 50
+		limitString := r.URL.Query().Get("limit")
+		if limitString != "" {
+			var convErr error
+			limit, convErr = strconv.Atoi(limitString)
+			if convErr != nil || limit <= 0 {
+				err = &errors.PreflightError{
+					Status: 400,
+					Code: errors.CODE_INVALID_PARAMETER,
+					InternalMessage: "api.handleAudit: invalid limit \"" + limitString + "\"",
+					ExternalMessage: "\"limit\" must be a positive integer.",
+				}
+				logger.logError(err)
+				err.WriteResponse(w, r)
+				return
+			}
+		}
+
+		auditString, err := commands.GetAuditLog(id, r.URL.Query().Get("before"), limit, persister)
+		if err != nil {
+			err.Prepend("api.handleAudit: error getting audit log: ")
+			logger.logError(err)
+			err.WriteResponse(w, r)
+			return
+		}
+
+		w.WriteHeader(200)
+		w.Write([]byte(auditString))
+	} else {
+		w.WriteHeader(404)
+	}
+}
+
+/*
+ * reports that the server is running, without checking the database
+ */
+func handleHealth(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
+	if ! strings.EqualFold(r.Method, "GET") {
+		w.WriteHeader(404)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write([]byte("ok"))
+}
+
+/*
+ * reports whether the server can reach the database, without authentication,
+ * for load balancers and orchestrators
+ */
+func handleReady(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
+	if ! strings.EqualFold(r.Method, "GET") {
+		w.WriteHeader(404)
+		return
+	}
+
+	err := persister.Ping()
+	if err != nil {
+		err.Prepend("api.handleReady: error pinging database: ")
+		logger.logError(err)
+		err.WriteResponse(w, r)
+		return
+	}
+
+	w.WriteHeader(200)
+	w.Write([]byte("ready"))
+}
+
 func readBody(r *http.Request, limit int) (string, *errors.PreflightError) {
 	bodyBytes := make([]byte, limit)
 	n, err := r.Body.Read(bodyBytes)
@@ -404,6 +720,7 @@ func readBody(r *http.Request, limit int) (string, *errors.PreflightError) {
 	} else if err.Error() != "EOF" {
 		pErr := &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "api.readBody: error reading request body: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error reading the request body.",
@@ -423,55 +740,300 @@ func getPathWords(r *http.Request) []string {
 	return pathWords
 }
 
-func getToken(r *http.Request) (string, *errors.PreflightError) {
-	query := r.URL.Query()
-	secret := query.Get("token")
-	if secret == "" {
-		err := &errors.PreflightError{
-			Status: 401,
-			InternalMessage: "api.getUser: no token",
-			ExternalMessage: "A security token is required.",
+/*
+ * reads the client token from an "Authorization: Bearer" header, and the node
+ * secret and user id from X-Preflight-Node-Secret and X-Preflight-User headers,
+ * falling back to query parameters if the settings allow them
+ */
+func getCredentials(r *http.Request, settings *persistence.ServerSettings) (string, string, string) {
+	clientToken := ""
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) > 7 && strings.EqualFold(authorization[:7], "Bearer ") {
+		clientToken = strings.TrimSpace(authorization[7:])
+	}
+	nodeSecret := r.Header.Get("X-Preflight-Node-Secret")
+	userId := r.Header.Get("X-Preflight-User")
+
+	if settings.AllowQueryCredentials {
+		query := r.URL.Query()
+		if clientToken == "" {
+			clientToken = query.Get("token")
+		}
+		if nodeSecret == "" {
+			nodeSecret = query.Get("nodeSecret")
+		}
+		if userId == "" {
+			userId = query.Get("user")
 		}
-		return "", err
 	}
 
-	return secret, nil
+	return clientToken, nodeSecret, userId
 }
 
-func validate(r *http.Request, permissions security.PermissionFlags, nodeOnly bool, persister *persistence.Persister) (string, *errors.PreflightError) {
-	query := r.URL.Query()
-	clientToken := query.Get("token")
-	nodeSecret := query.Get("nodeSecret")
-	userId := query.Get("user")
+/*
+ * checklist is the name of the checklist the request acts on, or empty if it
+ * acts on none or all of them; the returned actor identifies the credential
+ * for the audit log
+ */
+func validate(r *http.Request, settings *persistence.ServerSettings, permissions security.PermissionFlags, checklist string, nodeOnly bool, logger *requestLogger, persister persistence.Store) (string, persistence.Actor, *errors.PreflightError) {
+	clientToken, nodeSecret, userId := getCredentials(r, settings)
 	if nodeSecret != "" {
-		err := commands.ValidateNodeSecret(nodeSecret, persister)
+		node, err := commands.ValidateNode(nodeSecret, permissions, nodeOnly, persister)
+		if err != nil {
+			return "", persistence.Actor{}, err.Prepend("api.validate: error validating node secret: ")
+		}
+		if userId == "" && ! nodeOnly {
+			return "", persistence.Actor{}, &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_USER_REQUIRED,
+				InternalMessage: "api.validate: node request without user",
+				ExternalMessage: "A user is required with a node secret.",
+			}
+		}
+		err = commands.AuditNodeAction(node, userId, r.Method + " " + r.URL.Path, persister)
 		if err != nil {
-			err.Prepend("api.validate: error validating node secret: ")
+			return "", persistence.Actor{}, err.Prepend("api.validate: error auditing node request: ")
 		}
-		return userId, err
+		logger.Logger = logger.With("userId", userId, "nodeId", node.Id)
+		return userId, persistence.Actor{Type: persistence.ACTOR_NODE, Id: node.Id}, nil
 	} else if clientToken != "" && !nodeOnly {
 		userId, err := commands.GetUserIdFromToken(clientToken, persister)
 		if err != nil {
-			return "", err.Prepend("api.validate: error getting id: ")
+			return "", persistence.Actor{}, err.Prepend("api.validate: error getting id: ")
 		}
-		err = commands.ValidateToken(userId, clientToken, permissions, persister)
+		actor, err := commands.ValidateToken(userId, clientToken, permissions, checklist, persister)
 		if err != nil {
-			err.Prepend("api.validate: error validating token: ")
+			return "", persistence.Actor{}, err.Prepend("api.validate: error validating token: ")
 		}
-		return userId, err
+		logger.Logger = logger.With("userId", userId, "tokenId", actor.Id)
+		usage.Record(userId, actor.Id, remoteHost(r))
+		return userId, actor, nil
 	} else {
-		return "", &errors.PreflightError{
+		return "", persistence.Actor{}, &errors.PreflightError{
 			Status: 401,
+			Code: errors.CODE_CREDENTIALS_REQUIRED,
 			InternalMessage: "api.validate: no token",
 			ExternalMessage: "A security token is required.",
 		}
 	}
 }
 
-func encloseHandler(f func(http.ResponseWriter, *http.Request, *persistence.ServerSettings, *persistence.LoggerCloser, *persistence.Persister), settings *persistence.ServerSettings, logger *persistence.LoggerCloser, persister *persistence.Persister) func(http.ResponseWriter, *http.Request) {
+/*
+ * route names the handler in metrics
+ */
+type handlerFunc func(http.ResponseWriter, *http.Request, *persistence.ServerSettings, *requestLogger, persistence.Store)
+
+func encloseHandler(route string, f handlerFunc, settings *persistence.ServerSettings, logger *persistence.LoggerCloser, persister persistence.Store) func(http.ResponseWriter, *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		requestId := newRequestId()
+		w.Header().Set("X-Request-Id", requestId)
+		rLogger := &requestLogger{logger.With("requestId", requestId, "route", route, "method", r.Method)}
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
 		pCopy := persister.Copy()
 		defer pCopy.Close()
-		f(w, r, settings, logger, pCopy)
+		f(recorder, r, settings, rLogger, pCopy)
+		duration := time.Since(start)
+		metrics.ObserveRequest(route, r.Method, recorder.status, duration)
+		rLogger.Info("request", "path", r.URL.Path, "status", recorder.status, "duration", duration)
+	}
+}
+
+/*
+ * the logger for a request, to which validate adds the user and credential
+ */
+type requestLogger struct {
+	*slog.Logger
+}
+
+/*
+ * logs errors the client caused as warnings and others as errors
+ */
+func (l *requestLogger) logError(err *errors.PreflightError) {
+	level := slog.LevelWarn
+	if err.Status >= 500 {
+		level = slog.LevelError
+	}
+	l.Log(context.Background(), level, "request failed", "error", err)
+}
+
+func newRequestId() string {
+	idBytes := make([]byte, 8)
+	_, err := rand.Read(idBytes)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(idBytes)
+}
+
+/*
+ * the limits on password authentication, shared by all requests
+ */
+type loginLimits struct {
+	perAddress *ratelimit.Limiter
+	perAccount *ratelimit.Limiter
+	lockout *ratelimit.Lockout
+}
+
+func newLoginLimits(settings *persistence.ServerSettings) *loginLimits {
+	lockoutDuration := time.Duration(settings.LoginLockoutMinutes) * time.Minute
+	return &loginLimits{
+		perAddress: ratelimit.NewLimiter(float64(settings.LoginRateLimit) / 60, settings.LoginRateLimit),
+		perAccount: ratelimit.NewLimiter(float64(settings.LoginAccountRateLimit) / 60, settings.LoginAccountRateLimit),
+		lockout: ratelimit.NewLockout(settings.LoginLockoutFailures, lockoutDuration, lockoutDuration),
 	}
 }
+
+/*
+ * throttles requests authenticated by password, by remote address and by
+ * account, and locks an account out after repeated failures, before f
+ * spends any time checking the password; unauthenticated requests are
+ * throttled by remote address, and those with a token or node secret are not
+ * throttled here; the account is the basic auth user, or the email of a
+ * consent form allowing an OAuth client
+ */
+func limitLogins(f handlerFunc, limits *loginLimits) handlerFunc {
+	return func(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
+		_, _, hasBasicAuth := r.BasicAuth()
+		clientToken, nodeSecret, _ := getCredentials(r, settings)
+		if ! strings.EqualFold(r.Method, "POST") ||
+			! hasBasicAuth && (clientToken != "" || nodeSecret != "") {
+			f(w, r, settings, logger, persister)
+			return
+		}
+		if ! limits.allowAddress(w, r, logger) {
+			return
+		}
+		username, ok := loginAccount(r)
+		if ! ok {
+			f(w, r, settings, logger, persister)
+			return
+		}
+		if ! limits.allowAccount(w, r, logger, username) {
+			return
+		}
+
+		recorder := &statusRecorder{ResponseWriter: w, status: 200}
+		f(recorder, r, settings, logger, persister)
+		limits.record(r, recorder.status, username, logger, persister)
+	}
+}
+
+/*
+ * writes a 429 and returns false if the remote address has made too many
+ * password attempts
+ */
+func (l *loginLimits) allowAddress(w http.ResponseWriter, r *http.Request, logger *requestLogger) bool {
+	address := remoteHost(r)
+	allowed, wait := l.perAddress.Allow(address)
+	if ! allowed {
+		writeRetryAfter(w, r, logger, wait, &errors.PreflightError{
+			Status: 429,
+			InternalMessage: "api.loginLimits.allowAddress: too many password attempts from " + address,
+			ExternalMessage: "Too many attempts; try again later.",
+		})
+	}
+	return allowed
+}
+
+/*
+ * writes a 429 and returns false if the account is locked out or has had too
+ * many password attempts
+ */
+func (l *loginLimits) allowAccount(w http.ResponseWriter, r *http.Request, logger *requestLogger, username string) bool {
+	account := strings.ToLower(username)
+	remaining := l.lockout.Locked(account)
+	if remaining > 0 {
+		writeRetryAfter(w, r, logger, remaining, &errors.PreflightError{
+			Status: 429,
+			Code: errors.CODE_ACCOUNT_LOCKED,
+			InternalMessage: "api.loginLimits.allowAccount: account \"" + account + "\" is locked out",
+			ExternalMessage: "Too many failed attempts; try again later.",
+		})
+		return false
+	}
+	allowed, wait := l.perAccount.Allow(account)
+	if ! allowed {
+		writeRetryAfter(w, r, logger, wait, &errors.PreflightError{
+			Status: 429,
+			InternalMessage: "api.loginLimits.allowAccount: too many password attempts for \"" + account + "\"",
+			ExternalMessage: "Too many attempts; try again later.",
+		})
+	}
+	return allowed
+}
+
+/*
+ * counts a password check answered with status as a failure or success for
+ * the account, locking it out after too many failures
+ */
+func (l *loginLimits) record(r *http.Request, status int, username string, logger *requestLogger, persister persistence.Store) {
+	account := strings.ToLower(username)
+	if status == 401 || status == 404 {
+		duration := l.lockout.Fail(account)
+		if duration > 0 {
+			address := remoteHost(r)
+			logger.Warn("account locked out", "email", account, "remoteAddress", address, "duration", duration)
+			auditLockout(username, address, duration, logger, persister)
+		}
+	} else if status < 400 {
+		l.lockout.Succeed(account)
+	}
+}
+
+/*
+ * returns the account a password request names; a consent form denying a
+ * client checks no password, so names none, lest it clear the failures
+ */
+func loginAccount(r *http.Request) (string, bool) {
+	username, _, ok := r.BasicAuth()
+	if ok {
+		return username, true
+	}
+	if r.URL.Path == "/oauth/authorize" && r.PostFormValue("decision") == "allow" {
+		email := r.PostFormValue("email")
+		return email, email != ""
+	}
+	return "", false
+}
+
+func auditLockout(email, address string, duration time.Duration, logger *requestLogger, persister persistence.Store) {
+	id, err := commands.GetUserIdFromEmail(email, persister)
+	if errors.Is(err, errors.ErrNotFound) {
+		return
+	} else if err != nil {
+		logger.logError(err.Prepend("api.auditLockout: error getting user: "))
+		return
+	}
+	err = commands.AuditLockout(id, address, duration, persister)
+	if err != nil {
+		logger.logError(err.Prepend("api.auditLockout: error auditing lockout: "))
+	}
+}
+
+func writeRetryAfter(w http.ResponseWriter, r *http.Request, logger *requestLogger, wait time.Duration, err *errors.PreflightError) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	logger.logError(err)
+	err.WriteResponse(w, r)
+}
+
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+/*
+ * records the status written by a handler, which is 200 if none is written
+ */
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
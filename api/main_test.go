@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/commands"
+	"github.com/jsutton9/preflight/persistence"
+	"github.com/jsutton9/preflight/security"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testSettings = &persistence.ServerSettings{
+	TokenGraceMinutes: 60,
+	OAuthAccessTokenHours: 1,
+	OAuthRefreshTokenDays: 30,
+}
+
+var testActor = persistence.Actor{Type: persistence.ACTOR_CLI}
+
+/*
+ * calls the handler directly, without the metrics and request ids added by
+ * encloseHandler
+ */
+func serve(f handlerFunc, r *http.Request, persister persistence.Store) *httptest.ResponseRecorder {
+	if usage == nil {
+		usage = commands.NewUsageTracker(time.Hour)
+	}
+	w := httptest.NewRecorder()
+	logger := &requestLogger{slog.New(slog.NewTextHandler(io.Discard, nil))}
+	f(w, r, testSettings, logger, persister)
+	return w
+}
+
+func addTestToken(t *testing.T, id, request string, persister persistence.Store) *security.Token {
+	tokenString, err := commands.AddToken(id, request, testActor, persister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := new(security.Token)
+	jsonErr := json.Unmarshal([]byte(tokenString), token)
+	if jsonErr != nil {
+		t.Fatal(jsonErr)
+	}
+	return token
+}
+
+/*
+ * returns the code of the json error response w, failing if it is not one
+ */
+func errorCode(t *testing.T, w *httptest.ResponseRecorder) string {
+	body := struct{
+		Code string `json:"code"`
+	}{}
+	err := json.Unmarshal(w.Body.Bytes(), &body)
+	if err != nil {
+		t.Logf("error response not json: %s", w.Body.String())
+		t.Fail()
+	}
+	return body.Code
+}
+
+func TestHandleTokens(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	id, err := commands.AddUser(`{"email": "api-tokens@preflight.com", "password": "pass"}`, persister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	broad := addTestToken(t, id, `{"noExpiry": true, "permissions": ` +
+		`{"checklistRead": true, "generalWrite": true}}`, persister)
+	scoped := addTestToken(t, id, `{"noExpiry": true, "permissions": ` +
+		`{"generalWrite": true}, "checklists": ["morning"]}`, persister)
+
+	request := func(method, path, token string) *http.Request {
+		r := httptest.NewRequest(method, path, nil)
+		r.Header.Set("Accept", "application/json")
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer " + token)
+		}
+		return r
+	}
+
+	// a token can't rotate one with permissions or checklists it lacks
+	w := serve(handleTokens, request("POST", "/tokens/" + broad.Id + "/rotate", scoped.Secret), persister)
+	if w.Code != 403 || errorCode(t, w) != errors.CODE_INSUFFICIENT_PERMISSIONS {
+		t.Logf("rotating broader token: expected 403 %s, got %d %s",
+			errors.CODE_INSUFFICIENT_PERMISSIONS, w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(handleTokens, request("POST", "/tokens/" + scoped.Id + "/rotate", scoped.Secret), persister)
+	if w.Code != 200 {
+		t.Fatalf("rotating own token: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	rotated := new(security.Token)
+	jsonErr := json.Unmarshal(w.Body.Bytes(), rotated)
+	if jsonErr != nil || rotated.Id != scoped.Id || rotated.Secret == "" || rotated.Secret == scoped.Secret {
+		t.Logf("rotated token wrong: got %s", w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(handleTokens, request("POST", "/tokens/missing/rotate", broad.Secret), persister)
+	if w.Code != 404 || errorCode(t, w) != errors.CODE_TOKEN_NOT_FOUND {
+		t.Logf("rotating missing token: expected 404 %s, got %d %s",
+			errors.CODE_TOKEN_NOT_FOUND, w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(handleTokens, request("GET", "/tokens/self", broad.Secret), persister)
+	if w.Code != 200 {
+		t.Fatalf("introspecting token: expected 200, got %d %s", w.Code, w.Body.String())
+	}
+	self := new(security.Token)
+	jsonErr = json.Unmarshal(w.Body.Bytes(), self)
+	if jsonErr != nil || self.Id != broad.Id || self.Secret != "" || strings.Contains(w.Body.String(), broad.Secret) {
+		t.Logf("introspected token wrong: got %s", w.Body.String())
+		t.Fail()
+	}
+
+	w = serve(handleTokens, request("GET", "/tokens/self", ""), persister)
+	if w.Code != 401 || errorCode(t, w) != errors.CODE_CREDENTIALS_REQUIRED {
+		t.Logf("introspecting without token: expected 401 %s, got %d %s",
+			errors.CODE_CREDENTIALS_REQUIRED, w.Code, w.Body.String())
+		t.Fail()
+	}
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/commands"
+	"github.com/jsutton9/preflight/persistence"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var scopeDescriptions = map[string]string{
+	"checklist:read": "read your checklists",
+	"checklist:write": "add, change and delete your checklists",
+	"checklist:invoke": "add your checklists to your inbox",
+	"general:read": "read your settings and tokens",
+	"general:write": "change your settings and password",
+}
+
+var consentPage = template.Must(template.New("consent").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Authorize {{.ClientName}}</title>
+</head>
+<body>
+<h1>Authorize {{.ClientName}}</h1>
+<p>{{.ClientName}} is asking to use your Preflight account to:</p>
+<ul>
+{{range .Permissions}}<li>{{.}}</li>
+{{end}}</ul>
+{{if .Message}}<p><strong>{{.Message}}</strong></p>
+{{end}}<form method="post" action="/oauth/authorize">
+<input type="hidden" name="response_type" value="code">
+<input type="hidden" name="client_id" value="{{.Request.ClientId}}">
+<input type="hidden" name="redirect_uri" value="{{.Request.RedirectUri}}">
+<input type="hidden" name="scope" value="{{.Request.Scope}}">
+<input type="hidden" name="state" value="{{.Request.State}}">
+<input type="hidden" name="code_challenge" value="{{.Request.CodeChallenge}}">
+<input type="hidden" name="code_challenge_method" value="{{.Request.CodeChallengeMethod}}">
+<p><label>Email <input type="email" name="email" value="{{.Email}}" autocomplete="username"></label></p>
+<p><label>Password <input type="password" name="password" autocomplete="current-password"></label></p>
+<p>
+<button type="submit" name="decision" value="allow">Allow</button>
+<button type="submit" name="decision" value="deny">Deny</button>
+</p>
+</form>
+</body>
+</html>
+`))
+
+type consentData struct {
+	ClientName string
+	Permissions []string
+	Request commands.AuthorizeRequest
+	Email string
+	Message string
+}
+
+type oauthErrorResponse struct {
+	Error string       `json:"error"`
+	Description string `json:"error_description,omitempty"`
+}
+
+/*
+ * shows the consent page for an authorization request on GET, and on POST
+ * issues a code if the user gives their password and allows it; the client is
+ * sent back to its redirect URI either way, unless the client or redirect URI
+ * is invalid
+ */
+func handleAuthorize(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
+	if ! strings.EqualFold(r.Method, "GET") && ! strings.EqualFold(r.Method, "POST") {
+		w.WriteHeader(404)
+		return
+	}
+	parseErr := r.ParseForm()
+	if parseErr != nil {
+		err := &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_REQUEST,
+			Cause: parseErr,
+			InternalMessage: "api.handleAuthorize: error parsing form: \n\t" + parseErr.Error(),
+			ExternalMessage: "The request could not be read.",
+		}
+		logger.logError(err)
+		err.WriteResponse(w, r)
+		return
+	}
+
+	request := commands.AuthorizeRequest{
+		ClientId: r.Form.Get("client_id"),
+		RedirectUri: r.Form.Get("redirect_uri"),
+		Scope: r.Form.Get("scope"),
+		State: r.Form.Get("state"),
+		CodeChallenge: r.Form.Get("code_challenge"),
+		CodeChallengeMethod: r.Form.Get("code_challenge_method"),
+	}
+	client, redirectUri, err := commands.GetOAuthRedirect(request.ClientId, request.RedirectUri, persister)
+	if err != nil {
+		err.Prepend("api.handleAuthorize: error checking client: ")
+		logger.logError(err)
+		err.WriteResponse(w, r)
+		return
+	}
+	request.RedirectUri = redirectUri
+
+	if r.Form.Get("response_type") != "code" {
+		err = &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_UNSUPPORTED_RESPONSE_TYPE,
+			InternalMessage: "api.handleAuthorize: response type \"" + r.Form.Get("response_type") + "\"",
+			ExternalMessage: "Only the code response type is supported.",
+		}
+		logger.logError(err)
+		redirectOAuthError(w, r, request, err)
+		return
+	}
+	permissions, err := commands.CheckAuthorizeRequest(request)
+	if err != nil {
+		err.Prepend("api.handleAuthorize: ")
+		logger.logError(err)
+		redirectOAuthError(w, r, request, err)
+		return
+	}
+	request.Scope = permissions.Scope()
+
+	data := consentData{
+		ClientName: client.Name,
+		Request: request,
+	}
+	for _, scope := range strings.Fields(request.Scope) {
+		data.Permissions = append(data.Permissions, scopeDescriptions[scope])
+	}
+	if strings.EqualFold(r.Method, "GET") {
+		writeConsentPage(w, 200, data, logger)
+		return
+	}
+
+	if r.PostForm.Get("decision") != "allow" {
+		redirectOAuth(w, r, request.RedirectUri, url.Values{
+			"error": {errors.CODE_ACCESS_DENIED},
+			"state": {request.State},
+		})
+		return
+	}
+	data.Email = r.PostForm.Get("email")
+	code, err := commands.Authorize(request, data.Email, r.PostForm.Get("password"), persister)
+	if err != nil {
+		err.Prepend("api.handleAuthorize: error authorizing client: ")
+		logger.logError(err)
+		if err.Status == 401 || errors.Is(err, errors.ErrNotFound) {
+			// 401 either way, so that the failure counts towards a lockout
+			// and does not reveal whether the email is registered
+			data.Message = "The email or password is incorrect."
+			writeConsentPage(w, 401, data, logger)
+		} else {
+			err.WriteResponse(w, r)
+		}
+		return
+	}
+
+	redirectOAuth(w, r, request.RedirectUri, url.Values{
+		"code": {code},
+		"state": {request.State},
+	})
+}
+
+/*
+ * exchanges an authorization code or refresh token for tokens, answering as
+ * RFC 6749 requires
+ */
+func handleOAuthToken(w http.ResponseWriter, r *http.Request, settings *persistence.ServerSettings, logger *requestLogger, persister persistence.Store) {
+	if ! strings.EqualFold(r.Method, "POST") {
+		w.WriteHeader(404)
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+
+	r.Body = http.MaxBytesReader(w, r.Body, 10000)
+	parseErr := r.ParseForm()
+	if parseErr != nil {
+		err := &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_REQUEST,
+			Cause: parseErr,
+			InternalMessage: "api.handleOAuthToken: error parsing form: \n\t" + parseErr.Error(),
+			ExternalMessage: "The request could not be read.",
+		}
+		logger.logError(err)
+		writeOAuthError(w, err)
+		return
+	}
+
+	form := r.PostForm
+	accessHours := settings.OAuthAccessTokenHours
+	refreshFor := time.Duration(settings.OAuthRefreshTokenDays) * 24 * time.Hour
+	var response string
+	var err *errors.PreflightError
+	switch form.Get("grant_type") {
+	case "authorization_code":
+		if form.Get("client_id") == "" || form.Get("code") == "" || form.Get("code_verifier") == "" {
+			err = &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_INVALID_REQUEST,
+				InternalMessage: "api.handleOAuthToken: missing client_id, code or code_verifier",
+				ExternalMessage: "client_id, code and code_verifier are required.",
+			}
+			break
+		}
+		response, err = commands.ExchangeOAuthCode(form.Get("client_id"), form.Get("code"),
+			form.Get("redirect_uri"), form.Get("code_verifier"), accessHours, refreshFor, persister)
+	case "refresh_token":
+		if form.Get("client_id") == "" || form.Get("refresh_token") == "" {
+			err = &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_INVALID_REQUEST,
+				InternalMessage: "api.handleOAuthToken: missing client_id or refresh_token",
+				ExternalMessage: "client_id and refresh_token are required.",
+			}
+			break
+		}
+		response, err = commands.RefreshOAuthToken(form.Get("client_id"), form.Get("refresh_token"),
+			accessHours, refreshFor, persister)
+	default:
+		err = &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_UNSUPPORTED_GRANT_TYPE,
+			InternalMessage: "api.handleOAuthToken: grant type \"" + form.Get("grant_type") + "\"",
+			ExternalMessage: "Only the authorization_code and refresh_token grant types are supported.",
+		}
+	}
+	if err != nil {
+		err.Prepend("api.handleOAuthToken: ")
+		logger.logError(err)
+		writeOAuthError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(200)
+	w.Write([]byte(response))
+}
+
+func writeConsentPage(w http.ResponseWriter, status int, data consentData, logger *requestLogger) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	// the page takes a password, so must not be framed by another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	w.Header().Set("Content-Security-Policy", "frame-ancestors 'none'")
+	w.WriteHeader(status)
+	templateErr := consentPage.Execute(w, data)
+	if templateErr != nil {
+		logger.Error("error writing consent page", "error", templateErr)
+	}
+}
+
+/*
+ * sends the client back to its redirect URI with params added to the query,
+ * omitting those which are empty
+ */
+func redirectOAuth(w http.ResponseWriter, r *http.Request, redirectUri string, params url.Values) {
+	// the redirect URI was checked when the client was registered
+	target, _ := url.Parse(redirectUri)
+	query := target.Query()
+	for key, values := range params {
+		if len(values) > 0 && values[0] != "" {
+			query[key] = values
+		}
+	}
+	target.RawQuery = query.Encode()
+	http.Redirect(w, r, target.String(), 302)
+}
+
+func redirectOAuthError(w http.ResponseWriter, r *http.Request, request commands.AuthorizeRequest, err *errors.PreflightError) {
+	redirectOAuth(w, r, request.RedirectUri, url.Values{
+		"error": {oauthErrorCode(err)},
+		"error_description": {err.ExternalMessage},
+		"state": {request.State},
+	})
+}
+
+func writeOAuthError(w http.ResponseWriter, err *errors.PreflightError) {
+	status := err.Status
+	if status < 500 && status != 401 {
+		status = 400
+	}
+	body, jsonErr := json.Marshal(oauthErrorResponse{
+		Error: oauthErrorCode(err),
+		Description: err.ExternalMessage,
+	})
+	if jsonErr != nil {
+		w.WriteHeader(500)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+/*
+ * returns the RFC 6749 error code for err; errors without one are the
+ * server's
+ */
+func oauthErrorCode(err *errors.PreflightError) string {
+	switch err.GetCode() {
+	case errors.CODE_INVALID_REQUEST, errors.CODE_INVALID_CLIENT, errors.CODE_INVALID_GRANT,
+		errors.CODE_INVALID_SCOPE, errors.CODE_UNSUPPORTED_GRANT_TYPE,
+		errors.CODE_UNSUPPORTED_RESPONSE_TYPE, errors.CODE_ACCESS_DENIED:
+		return err.GetCode()
+	}
+	if err.Status >= 500 {
+		return "server_error"
+	}
+	return errors.CODE_INVALID_REQUEST
+}
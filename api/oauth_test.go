@@ -0,0 +1,210 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/commands"
+	"github.com/jsutton9/preflight/persistence"
+	"github.com/jsutton9/preflight/security"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testVerifier = "a-verifier-of-at-least-forty-three-characters-long"
+
+func newOAuthTest(t *testing.T, email string) (persistence.Store, string, url.Values) {
+	persister := persistence.NewMemoryStore()
+	_, err := commands.AddUser(`{"email": "` + email + `", "password": "pass"}`, persister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientId, err := commands.RegisterOAuthClient("Test Client",
+		[]string{"https://example.com/callback"}, persister)
+	if err != nil {
+		t.Fatal(err)
+	}
+	params := url.Values{
+		"response_type": {"code"},
+		"client_id": {clientId},
+		"scope": {"general:read"},
+		"state": {"xyz"},
+		"code_challenge": {security.PKCEChallenge(testVerifier)},
+		"code_challenge_method": {"S256"},
+	}
+	return persister, clientId, params
+}
+
+func postForm(path string, form url.Values) *http.Request {
+	r := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return r
+}
+
+func copyValues(values url.Values) url.Values {
+	copied := url.Values{}
+	for key, value := range values {
+		copied[key] = append([]string(nil), value...)
+	}
+	return copied
+}
+
+/*
+ * returns the query of the redirect w makes, failing if it makes none
+ */
+func redirectQuery(t *testing.T, w *httptest.ResponseRecorder) url.Values {
+	if w.Code != 302 {
+		t.Logf("expected redirect, got %d %s", w.Code, w.Body.String())
+		t.Fail()
+		return url.Values{}
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil || ! strings.HasPrefix(location.String(), "https://example.com/callback?") {
+		t.Logf("redirect wrong: got %s", w.Header().Get("Location"))
+		t.Fail()
+		return url.Values{}
+	}
+	return location.Query()
+}
+
+func TestHandleAuthorize(t *testing.T) {
+	persister, _, params := newOAuthTest(t, "api-authorize@preflight.com")
+
+	w := serve(handleAuthorize, httptest.NewRequest("GET", "/oauth/authorize?" + params.Encode(), nil), persister)
+	if w.Code != 200 || ! strings.Contains(w.Body.String(), "Authorize Test Client") {
+		t.Logf("consent page wrong: got %d %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+	headers := map[string]string{
+		"Content-Type": "text/html; charset=utf-8",
+		"Cache-Control": "no-store",
+		"X-Frame-Options": "DENY",
+		"Content-Security-Policy": "frame-ancestors 'none'",
+	}
+	for header, value := range headers {
+		if w.Header().Get(header) != value {
+			t.Logf("consent page %s wrong: expected %s, got %s", header, value, w.Header().Get(header))
+			t.Fail()
+		}
+	}
+
+	// an unknown client is answered directly, not by redirect
+	unknown := copyValues(params)
+	unknown.Set("client_id", "unknown")
+	w = serve(handleAuthorize, httptest.NewRequest("GET", "/oauth/authorize?" + unknown.Encode(), nil), persister)
+	if w.Code < 400 || w.Header().Get("Location") != "" {
+		t.Logf("unknown client: expected error without redirect, got %d %s", w.Code, w.Header().Get("Location"))
+		t.Fail()
+	}
+
+	// errors in the rest of the request are sent to the client
+	badChallenge := copyValues(params)
+	badChallenge.Set("code_challenge", "short")
+	w = serve(handleAuthorize, httptest.NewRequest("GET", "/oauth/authorize?" + badChallenge.Encode(), nil), persister)
+	query := redirectQuery(t, w)
+	if query.Get("error") != errors.CODE_INVALID_REQUEST || query.Get("state") != "xyz" {
+		t.Logf("bad challenge: expected %s with state, got %v", errors.CODE_INVALID_REQUEST, query)
+		t.Fail()
+	}
+
+	form := copyValues(params)
+	form.Set("email", "api-authorize@preflight.com")
+	form.Set("password", "wrong")
+	form.Set("decision", "allow")
+	w = serve(handleAuthorize, postForm("/oauth/authorize", form), persister)
+	if w.Code != 401 || ! strings.Contains(w.Body.String(), "The email or password is incorrect.") ||
+			w.Header().Get("X-Frame-Options") != "DENY" {
+		t.Logf("wrong password: expected consent page with 401, got %d %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	form.Set("password", "pass")
+	form.Set("decision", "deny")
+	w = serve(handleAuthorize, postForm("/oauth/authorize", form), persister)
+	query = redirectQuery(t, w)
+	if query.Get("error") != errors.CODE_ACCESS_DENIED || query.Get("code") != "" {
+		t.Logf("denied: expected %s, got %v", errors.CODE_ACCESS_DENIED, query)
+		t.Fail()
+	}
+
+	form.Set("decision", "allow")
+	w = serve(handleAuthorize, postForm("/oauth/authorize", form), persister)
+	query = redirectQuery(t, w)
+	if query.Get("code") == "" || query.Get("state") != "xyz" || query.Get("error") != "" {
+		t.Logf("allowed: expected code with state, got %v", query)
+		t.Fail()
+	}
+}
+
+func TestHandleOAuthToken(t *testing.T) {
+	email := "api-oauth-token@preflight.com"
+	persister, clientId, params := newOAuthTest(t, email)
+	authorize := func() string {
+		code, err := commands.Authorize(commands.AuthorizeRequest{
+			ClientId: clientId,
+			Scope: params.Get("scope"),
+			CodeChallenge: params.Get("code_challenge"),
+			CodeChallengeMethod: "S256",
+		}, email, "pass", persister)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	token := func(form url.Values) (*httptest.ResponseRecorder, map[string]interface{}) {
+		w := serve(handleOAuthToken, postForm("/oauth/token", form), persister)
+		if w.Header().Get("Cache-Control") != "no-store" || w.Header().Get("Content-Type") != "application/json" {
+			t.Logf("token response headers wrong: got %v", w.Header())
+			t.Fail()
+		}
+		body := make(map[string]interface{})
+		err := json.Unmarshal(w.Body.Bytes(), &body)
+		if err != nil {
+			t.Logf("token response not json: %s", w.Body.String())
+			t.Fail()
+		}
+		return w, body
+	}
+
+	cases := []struct{
+		name string
+		form url.Values
+		error string
+	}{
+		{"missing verifier", url.Values{"grant_type": {"authorization_code"}, "client_id": {clientId},
+			"code": {authorize()}}, errors.CODE_INVALID_REQUEST},
+		{"unsupported grant", url.Values{"grant_type": {"password"}, "client_id": {clientId}},
+			errors.CODE_UNSUPPORTED_GRANT_TYPE},
+		{"wrong verifier", url.Values{"grant_type": {"authorization_code"}, "client_id": {clientId},
+			"code": {authorize()}, "code_verifier": {"wrong-verifier"}}, errors.CODE_INVALID_GRANT},
+		{"unknown refresh token", url.Values{"grant_type": {"refresh_token"}, "client_id": {clientId},
+			"refresh_token": {"unknown"}}, errors.CODE_INVALID_GRANT},
+	}
+	for _, c := range cases {
+		w, body := token(c.form)
+		if w.Code != 400 || body["error"] != c.error {
+			t.Logf("%s: expected 400 %s, got %d %s", c.name, c.error, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+
+	w, body := token(url.Values{"grant_type": {"authorization_code"}, "client_id": {clientId},
+		"code": {authorize()}, "code_verifier": {testVerifier}})
+	if w.Code != 200 || body["token_type"] != "Bearer" || body["access_token"] == nil {
+		t.Fatalf("exchanging code: expected tokens, got %d %s", w.Code, w.Body.String())
+	}
+	refresh := url.Values{"grant_type": {"refresh_token"}, "client_id": {clientId},
+		"refresh_token": {body["refresh_token"].(string)}}
+	w, body = token(refresh)
+	if w.Code != 200 || body["access_token"] == nil {
+		t.Logf("refreshing: expected tokens, got %d %s", w.Code, w.Body.String())
+		t.Fail()
+	}
+	w, body = token(refresh)
+	if w.Code != 400 || body["error"] != errors.CODE_INVALID_GRANT {
+		t.Logf("refreshing twice: expected 400 %s, got %d %s", errors.CODE_INVALID_GRANT, w.Code, w.Body.String())
+		t.Fail()
+	}
+}
@@ -24,7 +24,7 @@ type Schedule struct {
 }
 
 type UpdateRecord struct {
-	Ids []int           `json:"ids"`
+	Ids []string        `json:"ids"`
 	Time time.Time      `json:"time"`
 	AddTime time.Time   `json:"addTime"`
 }
@@ -48,6 +48,7 @@ func parseWeekday(s string) (time.Weekday, *errors.PreflightError) {
 	default:
 		return time.Sunday, &errors.PreflightError{
 			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
 			InternalMessage: "checklist.parseWeekday: unable to parse \"" + s + "\"",
 			ExternalMessage: "day of week \"" + s + "\" not understood",
 		}
@@ -94,6 +95,8 @@ func (s *Schedule) Action(lastAdd time.Time, lastUpdate time.Time, now time.Time
 	if err != nil {
 		return 0, lastUpdate, &errors.PreflightError{
 			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			Cause: err,
 			InternalMessage: "checklist.Schedule.Action: error parsing start time " +
 				"\"" + s.Start + "\": \n\t" + err.Error(),
 			ExternalMessage: "Unable to parse start time \"" + s.Start + "\"; should be like \"15:04\"",
@@ -110,6 +113,8 @@ func (s *Schedule) Action(lastAdd time.Time, lastUpdate time.Time, now time.Time
 		if err != nil {
 			return 0, lastUpdate, &errors.PreflightError{
 				Status: 422,
+				Code: errors.CODE_CHECKLIST_INVALID,
+				Cause: err,
 				InternalMessage: "checklist.Schedule.Action: error parsing end time " +
 					"\"" + s.Start + "\": \n\t" + err.Error(),
 				ExternalMessage: "Unable to parse end time \"" + s.End + "\"; should be like \"15:04\"",
@@ -134,6 +139,73 @@ func (s *Schedule) Action(lastAdd time.Time, lastUpdate time.Time, now time.Time
 	}
 }
 
+/*
+ * returns the first start or end time after now, or the zero time if there
+ * is no schedule
+ */
+func (s *Schedule) Next(now time.Time) (time.Time, *errors.PreflightError) {
+	var next time.Time
+	if s == nil {
+		return next, nil
+	}
+
+	location := now.Location()
+	startTime, err := time.ParseInLocation("15:04", s.Start, location)
+	if err != nil {
+		return next, &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			Cause: err,
+			InternalMessage: "checklist.Schedule.Next: error parsing start time " +
+				"\"" + s.Start + "\": \n\t" + err.Error(),
+			ExternalMessage: "Unable to parse start time \"" + s.Start + "\"; should be like \"15:04\"",
+		}
+	}
+	transitions := []time.Time{startTime}
+	if s.End != "" {
+		endTime, err := time.ParseInLocation("15:04", s.End, location)
+		if err != nil {
+			return next, &errors.PreflightError{
+				Status: 422,
+				Code: errors.CODE_CHECKLIST_INVALID,
+				Cause: err,
+				InternalMessage: "checklist.Schedule.Next: error parsing end time " +
+					"\"" + s.End + "\": \n\t" + err.Error(),
+				ExternalMessage: "Unable to parse end time \"" + s.End + "\"; should be like \"15:04\"",
+			}
+		}
+		transitions = append(transitions, endTime)
+	}
+
+	scheduledDays := make(map[time.Weekday]bool)
+	for _, weekdayString := range s.Days {
+		weekday, pErr := parseWeekday(weekdayString)
+		if pErr != nil {
+			return next, pErr.Prepend("checklist.Schedule.Next: error parsing weekday: ")
+		}
+		scheduledDays[weekday] = true
+	}
+
+	y, m, d := now.Date()
+	for i := 0; i <= 7; i++ {
+		day := time.Date(y, m, d+i, 0, 0, 0, 0, location)
+		if len(scheduledDays) > 0 && ! scheduledDays[day.Weekday()] {
+			continue
+		}
+		for _, transition := range transitions {
+			t := time.Date(y, m, d+i, transition.Hour(), transition.Minute(), 0, 0, location)
+			if t.After(now) && (next.IsZero() || t.Before(next)) {
+				next = t
+			}
+		}
+		if ! next.IsZero() {
+			break
+		}
+	}
+
+	return next, nil
+}
+
 /*
  * returns 1 for add, -1 for delete, 0 for no action
  */
@@ -144,3 +216,11 @@ func (c Checklist) Action(lastAdd time.Time, lastUpdate time.Time, now time.Time
 	}
 	return action, updateTime, err
 }
+
+func (c Checklist) Next(now time.Time) (time.Time, *errors.PreflightError) {
+	next, err := c.Schedule.Next(now)
+	if err != nil {
+		err.Prepend("checklist.Checklist.Next: error: ")
+	}
+	return next, err
+}
@@ -149,3 +149,69 @@ func TestConfigScheduling(test *testing.T) {
 	actionTest(test, intervalWeekdays, mondayNoon, fridayMorning, fridayNoon, 1)
 	test.Log("")
 }
+
+func nextTest(test *testing.T, s Schedule, now time.Time, correctNext time.Time) {
+	next, err := s.Next(now)
+	if err != nil {
+		test.Error(err)
+	} else if ! next.Equal(correctNext) {
+		test.Log("test failure: ")
+		test.Logf("\tnow: %s\n", now.String())
+		test.Logf("\texpected %s, got %s\n", correctNext.String(), next.String())
+		test.Fail()
+	}
+}
+
+func TestScheduleNext(test *testing.T) {
+	dailyEnd := Schedule{
+		Start: "9:00",
+		End: "17:00",
+	}
+	weekdays := Schedule{
+		Days: []string{"Monday", "Wednesday", "Friday"},
+		Start: "9:00",
+	}
+
+	format := "2006-01-02 15:04:05"
+	location, err := time.LoadLocation("America/Denver")
+	if err != nil {
+		test.Fatal(err)
+	}
+	mondayMorning, err := time.ParseInLocation(format, "2016-04-04 01:00:00", location)
+	if err != nil {
+		test.Fatal(err)
+	}
+	mondayStart, err := time.ParseInLocation(format, "2016-04-04 09:00:00", location)
+	if err != nil {
+		test.Fatal(err)
+	}
+	mondayNoon := mondayStart.Add(3*time.Hour)
+	mondayEnd := mondayStart.Add(8*time.Hour)
+	mondayEvening := mondayStart.Add(14*time.Hour)
+	tuesdayStart := mondayStart.AddDate(0, 0, 1)
+	wednesdayStart := mondayStart.AddDate(0, 0, 2)
+	fridayNoon := mondayNoon.AddDate(0, 0, 4)
+	nextMondayStart := mondayStart.AddDate(0, 0, 7)
+
+	test.Log("testing dailyEnd")
+	nextTest(test, dailyEnd, mondayMorning, mondayStart)
+	nextTest(test, dailyEnd, mondayStart, mondayEnd)
+	nextTest(test, dailyEnd, mondayNoon, mondayEnd)
+	nextTest(test, dailyEnd, mondayEvening, tuesdayStart)
+	test.Log("")
+
+	test.Log("testing weekdays")
+	nextTest(test, weekdays, mondayMorning, mondayStart)
+	nextTest(test, weekdays, mondayNoon, wednesdayStart)
+	nextTest(test, weekdays, fridayNoon, nextMondayStart)
+	test.Log("")
+
+	test.Log("testing nil schedule")
+	next, pErr := (*Schedule)(nil).Next(mondayMorning)
+	if pErr != nil {
+		test.Error(pErr)
+	} else if ! next.IsZero() {
+		test.Logf("test failure: expected zero time, got %s", next.String())
+		test.Fail()
+	}
+}
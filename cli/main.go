@@ -3,42 +3,63 @@ package main
 import (
 	"fmt"
 	"github.com/jsutton9/preflight/commands"
+	"github.com/jsutton9/preflight/metrics"
 	"github.com/jsutton9/preflight/persistence"
+	"github.com/jsutton9/preflight/scheduler"
+	"github.com/jsutton9/preflight/security"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"text/tabwriter"
+	"time"
 )
 
+var cliActor = persistence.Actor{Type: persistence.ACTOR_CLI}
+
 func main() {
 	usage := "Usage:\n"
-	usage += "\tpreflight add-user EMAIL PASSWORD\n"
+	usage += "\tpreflight add-user CONFIG_FILE EMAIL PASSWORD\n"
 	usage += "\tpreflight update CONFIG_FILE EMAIL TRELLO_KEY\n"
-	usage += "\tpreflight invoke EMAIL CHECKLIST_NAME TRELLO_KEY\n"
-	usage += "\tpreflight get-checklists EMAIL\n"
-	usage += "\tpreflight add-checklist EMAIL CHECKLIST_NAME CHECKLIST_FILE\n"
-	usage += "\tpreflight update-checklist EMAIL CHECKLIST_NAME CHECKLIST_FILE\n"
-	usage += "\tpreflight delete-checklist EMAIL CHECKLIST_NAME\n"
+	usage += "\tpreflight scheduler CONFIG_FILE\n"
+	usage += "\tpreflight invoke CONFIG_FILE EMAIL CHECKLIST_NAME TRELLO_KEY\n"
+	usage += "\tpreflight get-checklists CONFIG_FILE EMAIL\n"
+	usage += "\tpreflight add-checklist CONFIG_FILE EMAIL CHECKLIST_NAME CHECKLIST_FILE\n"
+	usage += "\tpreflight update-checklist CONFIG_FILE EMAIL CHECKLIST_NAME CHECKLIST_FILE\n"
+	usage += "\tpreflight delete-checklist CONFIG_FILE EMAIL CHECKLIST_NAME\n"
 	usage += "\tpreflight set-todoist-token CONFIG_FILE EMAIL TOKEN\n"
 	usage += "\tpreflight set-trello-token CONFIG_FILE EMAIL TOKEN\n"
-	usage += "\tpreflight get-general-settings EMAIL\n"
-	usage += "\tpreflight set-general-setting EMAIL SETTING VALUE\n"
-	usage += "\tpreflight register-node CONFIG_FILE\n"
+	usage += "\tpreflight get-general-settings CONFIG_FILE EMAIL\n"
+	usage += "\tpreflight set-general-setting CONFIG_FILE EMAIL SETTING VALUE\n"
+	usage += "\tpreflight list-tokens CONFIG_FILE EMAIL\n"
+	usage += "\tpreflight register-node CONFIG_FILE [CAPABILITY...]\n"
+	usage += "\tpreflight register-oauth-client CONFIG_FILE NAME REDIRECT_URI...\n"
+	usage += "\tpreflight migrate CONFIG_FILE\n"
 
 	logger := log.New(os.Stderr, "", log.Ldate | log.Ltime)
 	if len(os.Args) < 2 {
 		logger.Println(usage)
 	} else if os.Args[1] == "add-user" {
-		if len(os.Args) != 4 {
+		if len(os.Args) != 5 {
 			logger.Println(usage)
 			return
 		}
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
-		email := os.Args[2]
-		password := os.Args[3]
+		email := os.Args[3]
+		password := os.Args[4]
 		userReq := fmt.Sprintf("{\"email\":\"%s\",\"password\":\"%s\"}", email, password)
 		id, err := commands.AddUser(userReq, persister)
 		if err != nil {
@@ -57,7 +78,7 @@ func main() {
 			logger.Println(err.Prepend("main: error loading server settings: ").Error())
 			return
 		}
-		persister, err := persistence.New(settings.DatabaseServer, settings.DatabaseUsersCollection)
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
@@ -69,45 +90,108 @@ func main() {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
 			return
 		}
-		err = commands.Update(id, trelloKey, persister)
+		err = commands.Update(id, trelloKey, slog.Default(), persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error updating: ").Error())
 			return
 		}
+	} else if os.Args[1] == "scheduler" {
+		if len(os.Args) != 3 {
+			logger.Println(usage)
+			return
+		}
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		schedulerLogger, err := settings.GetLogger()
+		if err != nil {
+			logger.Println(err.Prepend("main: error getting logger: ").Error())
+			return
+		}
+		defer schedulerLogger.Close()
+		hangups := make(chan os.Signal, 1)
+		signal.Notify(hangups, syscall.SIGHUP)
+		go func() {
+			for range hangups {
+				err := schedulerLogger.Reopen()
+				if err != nil {
+					logger.Println(err.Prepend("main: error reopening log: ").Error())
+				}
+			}
+		}()
+		persister, err := settings.GetPersister()
+		if err != nil {
+			logger.Println(err.Prepend("main: error getting persister: ").Error())
+			return
+		}
+		defer persister.Close()
+
+		if settings.SchedulerMetricsAddress != "" {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", metrics.Handler())
+			go func() {
+				goErr := http.ListenAndServe(settings.SchedulerMetricsAddress, mux)
+				schedulerLogger.Error("error serving metrics", "error", goErr.Error())
+			}()
+		}
+
+		s := scheduler.New(settings, persister, schedulerLogger.Logger)
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+		go func() {
+			<-signals
+			s.Stop()
+		}()
+		s.Run()
 	} else if os.Args[1] == "invoke" {
-		if len(os.Args) != 5 {
+		if len(os.Args) != 6 {
 			logger.Println(usage)
 			return
 		}
-		email := os.Args[2]
-		name := os.Args[3]
-		trelloKey := os.Args[4]
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
+		email := os.Args[3]
+		name := os.Args[4]
+		trelloKey := os.Args[5]
 		id, err := commands.GetUserIdFromEmail(email, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
 			return
 		}
-		err = commands.Invoke(id, name, trelloKey, persister)
+		err = commands.Invoke(id, name, trelloKey, cliActor, slog.Default(), persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error invoking \"").Error())
 			return
 		}
 	} else if os.Args[1] == "get-checklists" {
-		if len(os.Args) != 3 {
+		if len(os.Args) != 4 {
 			logger.Println(usage)
 			return
 		}
-		email := os.Args[2]
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
+		email := os.Args[3]
 		id, err := commands.GetUserIdFromEmail(email, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
@@ -120,18 +204,24 @@ func main() {
 		}
 		fmt.Println(checklistsString)
 	} else if os.Args[1] == "add-checklist" {
-		if len(os.Args) != 5 {
+		if len(os.Args) != 6 {
 			logger.Println(usage)
 			return
 		}
-		email := os.Args[2]
-		name := os.Args[3]
-		filename := os.Args[4]
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
+		email := os.Args[3]
+		name := os.Args[4]
+		filename := os.Args[5]
 		id, err := commands.GetUserIdFromEmail(email, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
@@ -144,24 +234,30 @@ func main() {
 			return
 		}
 		checklistReq := fmt.Sprintf("{\"name\":\"%s\",\"checklist\":%s}", name, string(checklistBytes))
-		_, err = commands.AddChecklist(id, checklistReq, persister)
+		_, err = commands.AddChecklist(id, checklistReq, cliActor, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error adding checklist: ").Error())
 			return
 		}
 	} else if os.Args[1] == "update-checklist" {
-		if len(os.Args) != 5 {
+		if len(os.Args) != 6 {
 			logger.Println(usage)
 			return
 		}
-		email := os.Args[2]
-		name := os.Args[3]
-		filename := os.Args[4]
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
+		email := os.Args[3]
+		name := os.Args[4]
+		filename := os.Args[5]
 		id, err := commands.GetUserIdFromEmail(email, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
@@ -173,29 +269,35 @@ func main() {
 				"\": \n\t" + goErr.Error())
 			return
 		}
-		err = commands.UpdateChecklist(id, name, string(checklistBytes), persister)
+		err = commands.UpdateChecklist(id, name, string(checklistBytes), cliActor, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error updating checklist: ").Error())
 			return
 		}
 	} else if os.Args[1] == "delete-checklist" {
-		if len(os.Args) != 4 {
+		if len(os.Args) != 5 {
 			logger.Println(usage)
 			return
 		}
-		email := os.Args[2]
-		name := os.Args[3]
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
+		email := os.Args[3]
+		name := os.Args[4]
 		id, err := commands.GetUserIdFromEmail(email, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
 			return
 		}
-		err = commands.DeleteChecklist(id, name, persister)
+		err = commands.DeleteChecklist(id, name, cliActor, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error deleting checklist: ").Error())
 			return
@@ -213,7 +315,7 @@ func main() {
 			logger.Println(err.Prepend("main: error loading server settings: ").Error())
 			return
 		}
-		persister, err := persistence.New(settings.DatabaseServer, settings.DatabaseUsersCollection)
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
@@ -245,7 +347,7 @@ func main() {
 			logger.Println(err.Prepend("main: error loading server settings: ").Error())
 			return
 		}
-		persister, err := persistence.New(settings.DatabaseServer, settings.DatabaseUsersCollection)
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
@@ -261,40 +363,52 @@ func main() {
 			return
 		}
 	} else if os.Args[1] == "get-general-settings" {
-		if len(os.Args) != 3 {
+		if len(os.Args) != 4 {
 			logger.Println(usage)
 			return
 		}
-		email := os.Args[2]
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
+		email := os.Args[3]
 		id, err := commands.GetUserIdFromEmail(email, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
 			return
 		}
-		settings, err := commands.GetGeneralSettings(id, persister)
+		generalSettings, err := commands.GetGeneralSettings(id, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting settings: ").Error())
 			return
 		}
-		fmt.Println(settings)
+		fmt.Println(generalSettings)
 	} else if os.Args[1] == "set-general-setting" {
-		if len(os.Args) != 5 {
+		if len(os.Args) != 6 {
 			logger.Println(usage)
 			return
 		}
-		email := os.Args[2]
-		setting := os.Args[3]
-		value := os.Args[4]
-		persister, err := persistence.New("localhost", "users")
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
+		email := os.Args[3]
+		setting := os.Args[4]
+		value := os.Args[5]
 		id, err := commands.GetUserIdFromEmail(email, persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting user id: ").Error())
@@ -305,8 +419,37 @@ func main() {
 			logger.Println(err.Prepend("main: error setting \"" +setting + "\": ").Error())
 			return
 		}
+	} else if os.Args[1] == "list-tokens" {
+		if len(os.Args) != 4 {
+			logger.Println(usage)
+			return
+		}
+		configFile := os.Args[2]
+		email := os.Args[3]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
+		if err != nil {
+			logger.Println(err.Prepend("main: error getting persister: ").Error())
+			return
+		}
+		defer persister.Close()
+		id, err := commands.GetUserIdFromEmail(email, persister)
+		if err != nil {
+			logger.Println(err.Prepend("main: error getting user id: ").Error())
+			return
+		}
+		tokens, err := commands.ListTokens(id, persister)
+		if err != nil {
+			logger.Println(err.Prepend("main: error listing tokens: ").Error())
+			return
+		}
+		printTokens(tokens)
 	} else if os.Args[1] == "register-node" {
-		if len(os.Args) != 3 {
+		if len(os.Args) < 3 {
 			logger.Println(usage)
 			return
 		}
@@ -316,17 +459,94 @@ func main() {
 			logger.Println(err.Prepend("main: error loading server settings: ").Error())
 			return
 		}
-		persister, err := persistence.New(settings.DatabaseServer, settings.DatabaseUsersCollection)
+		persister, err := settings.GetPersister()
 		if err != nil {
 			logger.Println(err.Prepend("main: error getting persister: ").Error())
 			return
 		}
-		err = persister.RegisterNode(settings.SecretFile)
+		id, err := commands.RegisterNode(settings.SecretFile, os.Args[3:], persister)
 		if err != nil {
 			logger.Println(err.Prepend("main: error registering node: ").Error())
 			return
 		}
+		fmt.Println("node id: " + id)
+	} else if os.Args[1] == "register-oauth-client" {
+		if len(os.Args) < 5 {
+			logger.Println(usage)
+			return
+		}
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
+		if err != nil {
+			logger.Println(err.Prepend("main: error getting persister: ").Error())
+			return
+		}
+		id, err := commands.RegisterOAuthClient(os.Args[3], os.Args[4:], persister)
+		if err != nil {
+			logger.Println(err.Prepend("main: error registering client: ").Error())
+			return
+		}
+		fmt.Println("client id: " + id)
+	} else if os.Args[1] == "migrate" {
+		if len(os.Args) != 3 {
+			logger.Println(usage)
+			return
+		}
+		configFile := os.Args[2]
+		settings, err := persistence.GetServerSettings(configFile)
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading server settings: ").Error())
+			return
+		}
+		err = settings.LoadTokenKey()
+		if err != nil {
+			logger.Println(err.Prepend("main: error loading token key: ").Error())
+			return
+		}
+		persister, err := settings.GetPersister()
+		if err != nil {
+			logger.Println(err.Prepend("main: error getting persister: ").Error())
+			return
+		}
+		defer persister.Close()
+		if mongoStore, ok := persister.(*persistence.MongoStore); ok {
+			n, err := mongoStore.MigrateTaskIds()
+			if err != nil {
+				logger.Println(err.Prepend("main: error migrating task ids: ").Error())
+				return
+			}
+			fmt.Printf("migrated task ids for %d users\n", n)
+		}
+		n, err := commands.MigrateTokenSecrets(persister)
+		if err != nil {
+			logger.Println(err.Prepend("main: error migrating token secrets: ").Error())
+			return
+		}
+		fmt.Printf("hashed token secrets for %d users\n", n)
 	} else {
 		logger.Println(usage)
 	}
 }
+
+func printTokens(tokens []security.Token) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tDESCRIPTION\tEXPIRY\tLAST USED\tLAST ADDRESS\tUSES")
+	for _, token := range tokens {
+		expiry := "never"
+		if ! token.NoExpiry {
+			expiry = token.Expiry.Format(time.RFC3339)
+		}
+		lastUsed := "never"
+		if ! token.LastUsed.IsZero() {
+			lastUsed = token.LastUsed.Format(time.RFC3339)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%d\n", token.Id, token.Description,
+			expiry, lastUsed, token.LastAddress, token.UseCount)
+	}
+	w.Flush()
+}
@@ -0,0 +1,95 @@
+package source
+
+import (
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/checklist"
+	"github.com/jsutton9/preflight/clients/trello"
+	"github.com/jsutton9/preflight/security"
+	"log/slog"
+	"sync"
+)
+
+type Source interface {
+	Tasks(cl checklist.Checklist) ([]string, *errors.PreflightError)
+}
+
+type Config struct {
+	Security *security.SecurityInfo
+	TrelloKey string
+	TrelloBoard string
+	Logger *slog.Logger
+}
+
+type Constructor func(config Config) Source
+
+type inline struct{}
+
+type trelloSource struct {
+	client trello.Client
+}
+
+var (
+	mutex sync.RWMutex
+	constructors = map[string]Constructor{
+		"preflight": func(config Config) Source {
+			return inline{}
+		},
+		"trello": func(config Config) Source {
+			client := trello.New(config.Security.Trello, config.TrelloKey, config.TrelloBoard)
+			client.Logger = config.Logger
+			return trelloSource{client: client}
+		},
+	}
+)
+
+func Register(name string, constructor Constructor) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	constructors[name] = constructor
+}
+
+func Exists(name string) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	_, found := constructors[name]
+	return found
+}
+
+func New(name string, config Config) (Source, *errors.PreflightError) {
+	mutex.RLock()
+	constructor, found := constructors[name]
+	mutex.RUnlock()
+	if ! found {
+		return nil, &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			InternalMessage: "source.New: tasks source \"" + name + "\" not recognized",
+			ExternalMessage: "Tasks source \"" + name + "\" not recognized.",
+		}
+	}
+
+	return constructor(config), nil
+}
+
+func (s inline) Tasks(cl checklist.Checklist) ([]string, *errors.PreflightError) {
+	tasks := make([]string, len(cl.Tasks))
+	copy(tasks, cl.Tasks)
+	return tasks, nil
+}
+
+func (s trelloSource) Tasks(cl checklist.Checklist) ([]string, *errors.PreflightError) {
+	if cl.Trello == nil {
+		return nil, &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			InternalMessage: "source.trelloSource.Tasks: checklist has no trello list",
+			ExternalMessage: "A Trello list is required for a checklist with tasks source \"trello\".",
+		}
+	}
+
+	tasks, pErr := s.client.Tasks(cl.Trello)
+	if pErr != nil {
+		return nil, pErr.Prepend("source.trelloSource.Tasks: error getting tasks from trello: ")
+	}
+	return tasks, nil
+}
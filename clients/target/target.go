@@ -0,0 +1,60 @@
+package target
+
+import (
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/clients/todoist"
+	"github.com/jsutton9/preflight/security"
+	"log/slog"
+	"sync"
+)
+
+type Target interface {
+	PostTasks(tasks []string) ([]string, *errors.PreflightError)
+	DeleteTasks(ids []string) *errors.PreflightError
+	OpenTasks(ids []string) ([]string, *errors.PreflightError)
+}
+
+/*
+ * logger receives a line for each call the target makes
+ */
+type Constructor func(sec *security.SecurityInfo, logger *slog.Logger) Target
+
+var (
+	mutex sync.RWMutex
+	constructors = map[string]Constructor{
+		"todoist": func(sec *security.SecurityInfo, logger *slog.Logger) Target {
+			client := todoist.New(sec.Todoist)
+			client.Logger = logger
+			return client
+		},
+	}
+)
+
+func Register(name string, constructor Constructor) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	constructors[name] = constructor
+}
+
+func Exists(name string) bool {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	_, found := constructors[name]
+	return found
+}
+
+func New(name string, sec *security.SecurityInfo, logger *slog.Logger) (Target, *errors.PreflightError) {
+	mutex.RLock()
+	constructor, found := constructors[name]
+	mutex.RUnlock()
+	if ! found {
+		return nil, &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			InternalMessage: "target.New: tasks target \"" + name + "\" not recognized",
+			ExternalMessage: "Tasks target \"" + name + "\" not recognized.",
+		}
+	}
+
+	return constructor(sec, logger), nil
+}
@@ -1,21 +1,30 @@
 package todoist
 
 import (
+	"bytes"
+	"crypto/rand"
 	"encoding/json"
 	"fmt"
 	"github.com/jsutton9/preflight/api/errors"
-	"math/rand"
+	"github.com/jsutton9/preflight/metrics"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
-	"os/exec"
 	"time"
 )
 
+const MAX_PAGE_SIZE = 200
+
+/*
+ * Logger, if set, receives a line for each call to the API
+ */
 type Client struct {
 	Url      string
 	Security Security
+	Logger   *slog.Logger
 }
 
 type Security struct {
@@ -23,37 +32,67 @@ type Security struct {
 }
 
 type taskArgs struct {
+	Content string `json:"content"`
+}
+
+type Task struct {
+	Id string       `json:"id"`
+	Content string  `json:"content"`
+	Checked bool    `json:"checked"`
+	IsDeleted bool  `json:"is_deleted"`
+}
+
+type Command struct {
+	Type string       `json:"type"`
+	Uuid string       `json:"uuid"`
+	TempId string     `json:"temp_id,omitempty"`
+	Args CommandArgs  `json:"args"`
+}
+
+type CommandArgs struct {
 	Content string `json:"content,omitempty"`
-	Ids []int      `json:"ids,omitempty"`
+	Id string      `json:"id,omitempty"`
+}
+
+type CommandStatus struct {
+	Command Command
+	Ok bool
+	Error string
+	Id string
 }
 
-type command struct {
-	Type string    `json:"type"`
-	Uuid string    `json:"uuid"`
-	TempId string  `json:"temp_id,omitempty"`
-	Args *taskArgs `json:"args"`
+type syncResponse struct {
+	SyncStatus map[string]json.RawMessage `json:"sync_status"`
+	TempIdMapping map[string]string       `json:"temp_id_mapping"`
 }
 
-type AddResponse struct {
-	SyncStatus map[string]string `json:"SyncStatus"`
-	TempIdMapping map[string]int `json:"TempIdMapping"`
+type syncError struct {
+	ErrorCode int `json:"error_code"`
+	Error string  `json:"error"`
 }
 
-type DeleteResponse struct {
-	SyncStatus map[string]string `json:"SyncStatus"`
+type tasksPage struct {
+	Results []Task `json:"results"`
 }
 
 func New(security Security) Client {
-	rand.Seed(time.Now().UnixNano())
 	return Client{
-		Url:   "https://todoist.com/API/v6/sync",
+		Url:   "https://api.todoist.com/api/v1/",
 		Security: security,
 	}
 }
 
+func (c Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
+
 func buildApiError(function string, command string, status string, body string) *errors.PreflightError {
 	return &errors.PreflightError{
 		Status: 500,
+		Kind: errors.ErrUpstream,
 		InternalMessage: fmt.Sprintf("%s: bad API response for \"%s\": \n" +
 			"\t\tStatus: %s\n\t\tBody: %s\n", function, command, status, body),
 		ExternalMessage: fmt.Sprintf("Todoist returned an error response: \n" +
@@ -61,57 +100,95 @@ func buildApiError(function string, command string, status string, body string)
 	}
 }
 
-func (c Client) PostTask(task string) (int, *errors.PreflightError) {
-	task = url.QueryEscape(task)
+func (c Client) do(method, path string, content interface{}) (*http.Response, []byte, *errors.PreflightError) {
+	var requestBody io.Reader
+	contentType := "application/json"
+	if form, isForm := content.(url.Values); isForm {
+		requestBody = strings.NewReader(form.Encode())
+		contentType = "application/x-www-form-urlencoded"
+	} else if content != nil {
+		contentBytes, err := json.Marshal(content)
+		if err != nil {
+			return nil, nil, &errors.PreflightError{
+				Status: 500,
+				Cause: err,
+				InternalMessage: "todoist.Client.do: error marshalling request: " +
+					"\n\t" + err.Error(),
+				ExternalMessage: "There was an error posting to Todoist.",
+			}
+		}
+		requestBody = bytes.NewReader(contentBytes)
+	}
 
-	uuid := strconv.FormatInt(rand.Int63(), 16)
-	tempIdBytes, err := exec.Command("uuidgen").Output()
+	request, err := http.NewRequest(method, c.Url + path, requestBody)
 	if err != nil {
-		return 0, &errors.PreflightError{
+		return nil, nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "todoist.Client.PostTask: error generating uuid: " +
-				"\n\t" + err.Error(),
+			Cause: err,
+			InternalMessage: "todoist.Client.do: error building request for " +
+				path + ": \n\t" + err.Error(),
 			ExternalMessage: "There was an error posting to Todoist.",
 		}
 	}
-	tempId := string(tempIdBytes[:len(tempIdBytes)-1])
-	cmd := command{
-		Type: "item_add",
-		Uuid: uuid,
-		TempId: tempId,
-		Args: &taskArgs{Content: task},
+	request.Header.Set("Authorization", "Bearer " + c.Security.Token)
+	if content != nil {
+		request.Header.Set("Content-Type", contentType)
 	}
 
-	cmdBytes, _ := json.Marshal(cmd)
-	request := c.Url + "?token=" + c.Security.Token +
-		"&commands=[" + string(cmdBytes) + "]"
-
-	response, err := http.Post(request, "", strings.NewReader(""))
+	start := time.Now()
+	response, err := http.DefaultClient.Do(request)
 	if err != nil {
-		return 0, &errors.PreflightError{
+		metrics.ObserveClientCall(metrics.SERVICE_TODOIST, 0)
+		c.logger().Warn("todoist call failed", "method", method, "path", path,
+			"duration", time.Since(start), "error", err.Error())
+		return nil, nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "todoist.Client.PostTask: error posting task: " +
-				"\n\t" + err.Error(),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "todoist.Client.do: error sending " + method + " " +
+				path + ": \n\t" + err.Error(),
 			ExternalMessage: "There was an error posting to Todoist.",
 		}
 	}
-	body := make([]byte, 10000)
-	bodyLen, err := response.Body.Read(body)
-	if err != nil && err.Error() != "EOF" {
-		return 0, &errors.PreflightError{
+	body, err := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	if err != nil {
+		metrics.ObserveClientCall(metrics.SERVICE_TODOIST, 0)
+		c.logger().Warn("todoist call failed", "method", method, "path", path,
+			"duration", time.Since(start), "error", err.Error())
+		return nil, nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "todoist.Client.PostTask: error reading response: " +
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "todoist.Client.do: error reading response: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error posting to Todoist.",
 		}
 	}
-	response.Body.Close()
+	metrics.ObserveClientCall(metrics.SERVICE_TODOIST, response.StatusCode)
+	c.logger().Debug("todoist call", "method", method, "path", path,
+		"status", response.StatusCode, "duration", time.Since(start))
+
+	return response, body, nil
+}
+
+func (c Client) PostTask(task string) (string, *errors.PreflightError) {
+	response, body, pErr := c.do("POST", "tasks", taskArgs{Content: task})
+	if pErr != nil {
+		return "", pErr.Prepend("todoist.Client.PostTask: error posting task: ")
+	}
+	if response.StatusCode != 200 {
+		return "", buildApiError("todoist.Client.PostTask", "POST tasks "+task,
+			response.Status, string(body))
+	}
 
-	responseContent := new(AddResponse)
-	err = json.Unmarshal(body[:bodyLen], responseContent)
+	responseContent := new(Task)
+	err := json.Unmarshal(body, responseContent)
 	if err != nil {
-		return 0, &errors.PreflightError{
+		return "", &errors.PreflightError{
 			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
 			InternalMessage: "todoist.Client.PostTask: error parsing response \"" +
 				string(body) + "\": \n\t" + err.Error(),
 			ExternalMessage: "We recieved an unrecognized response from Todoist: " +
@@ -119,81 +196,317 @@ func (c Client) PostTask(task string) (int, *errors.PreflightError) {
 		}
 	}
 
-	if (response.StatusCode != 200) || (responseContent.SyncStatus[uuid] != "ok") {
-		return 0, buildApiError("todoist.Client.PostTask", "item_add "+task,
-			response.Status, string(body))
+	return responseContent.Id, nil
+}
+
+func (c Client) DeleteTask(id string) *errors.PreflightError {
+	if id == "" {
+		return nil
 	}
 
-	id := responseContent.TempIdMapping[tempId]
+	response, body, pErr := c.do("DELETE", "tasks/"+url.PathEscape(id), nil)
+	if pErr != nil {
+		return pErr.Prepend("todoist.Client.DeleteTask: error posting deletion: ")
+	}
+	if response.StatusCode != 200 && response.StatusCode != 204 {
+		return buildApiError("todoist.Client.DeleteTask", "DELETE tasks/"+id,
+			response.Status, string(body))
+	}
 
-	return id, nil
+	return nil
 }
 
-func (c Client) DeleteTask(id int) *errors.PreflightError {
-	if id == 0 {
-		return nil
+func (c Client) TaskDone(id string) (bool, *errors.PreflightError) {
+	if id == "" {
+		return true, nil
+	}
+
+	response, body, pErr := c.do("GET", "tasks/"+url.PathEscape(id), nil)
+	if pErr != nil {
+		return false, pErr.Prepend("todoist.Client.TaskDone: error getting task: ")
 	}
-	uuid := strconv.FormatInt(rand.Int63(), 16)
-	tempIdBytes, err := exec.Command("uuidgen").Output()
+	if response.StatusCode == 404 {
+		return true, nil
+	} else if response.StatusCode != 200 {
+		return false, buildApiError("todoist.Client.TaskDone", "GET tasks/"+id,
+			response.Status, string(body))
+	}
+
+	responseContent := new(Task)
+	err := json.Unmarshal(body, responseContent)
 	if err != nil {
-		return &errors.PreflightError{
+		return false, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "todoist.Client.DeleteTask: error generating uuid: " +
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "todoist.Client.TaskDone: error parsing response \"" +
+				string(body) + "\": \n\t" + err.Error(),
+			ExternalMessage: "We recieved an unrecognized response from Todoist: " +
+				"\n\t\"" + string(body) + "\"",
+		}
+	}
+
+	return responseContent.Checked || responseContent.IsDeleted, nil
+}
+
+func newUuid() (string, *errors.PreflightError) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "todoist.newUuid: error generating uuid: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error posting to Todoist.",
 		}
 	}
-	tempId := string(tempIdBytes[:len(tempIdBytes)-1])
-	ids := []int{id}
-	cmd := command{
-		Type: "item_delete",
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:]), nil
+}
+
+func NewAddCommand(task string) (Command, *errors.PreflightError) {
+	uuid, pErr := newUuid()
+	if pErr != nil {
+		return Command{}, pErr.Prepend("todoist.NewAddCommand: ")
+	}
+	tempId, pErr := newUuid()
+	if pErr != nil {
+		return Command{}, pErr.Prepend("todoist.NewAddCommand: ")
+	}
+
+	return Command{
+		Type: "item_add",
 		Uuid: uuid,
 		TempId: tempId,
-		Args: &taskArgs{Ids: ids},
+		Args: CommandArgs{Content: task},
+	}, nil
+}
+
+func NewDeleteCommand(id string) (Command, *errors.PreflightError) {
+	uuid, pErr := newUuid()
+	if pErr != nil {
+		return Command{}, pErr.Prepend("todoist.NewDeleteCommand: ")
 	}
 
-	cmdBytes, _ := json.Marshal(cmd)
-	request := c.Url + "?token=" + c.Security.Token +
-	        "&commands=[" + string(cmdBytes) + "]"
+	return Command{
+		Type: "item_delete",
+		Uuid: uuid,
+		Args: CommandArgs{Id: id},
+	}, nil
+}
+
+/*
+ * sends all commands in one sync request, returning the status of each
+ * command in order; for item_add commands, Id is the new task's id
+ */
+func (c Client) Batch(commands []Command) ([]CommandStatus, *errors.PreflightError) {
+	statuses := make([]CommandStatus, 0, len(commands))
+	if len(commands) == 0 {
+		return statuses, nil
+	}
 
-	response, err := http.Post(request, "", strings.NewReader(""))
+	commandsBytes, err := json.Marshal(commands)
 	if err != nil {
-		return &errors.PreflightError{
+		return nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "todoist.Client.DeleteTask: error posting deletion: " +
+			Cause: err,
+			InternalMessage: "todoist.Client.Batch: error marshalling commands: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error posting to Todoist.",
 		}
 	}
-	body := make([]byte, 10000)
-	bodyLen, err := response.Body.Read(body)
-	if err != nil && err.Error() != "EOF" {
-		return &errors.PreflightError{
-			Status: 500,
-			InternalMessage: "todoist.Client.DeleteTask: error reading response: " +
-				"\n\t" + err.Error(),
-			ExternalMessage: "There was an error posting to Todoist.",
-		}
+	form := url.Values{}
+	form.Set("commands", string(commandsBytes))
+
+	response, body, pErr := c.do("POST", "sync", form)
+	if pErr != nil {
+		return nil, pErr.Prepend("todoist.Client.Batch: error posting commands: ")
+	}
+	if response.StatusCode != 200 {
+		return nil, buildApiError("todoist.Client.Batch", "sync",
+			response.Status, string(body))
 	}
-	response.Body.Close()
 
-	responseContent := new(DeleteResponse)
-	err = json.Unmarshal(body[:bodyLen], responseContent)
+	responseContent := new(syncResponse)
+	err = json.Unmarshal(body, responseContent)
 	if err != nil {
-		return &errors.PreflightError{
+		return nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "todoist.Client.DeleteTask: error parsing response \"" +
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "todoist.Client.Batch: error parsing response \"" +
 				string(body) + "\": \n\t" + err.Error(),
 			ExternalMessage: "We recieved an unrecognized response from Todoist: " +
 				"\n\t\"" + string(body) + "\"",
 		}
 	}
 
-	syncStatus := responseContent.SyncStatus[uuid]
-	if (response.StatusCode != 200) || (syncStatus != "ok") {
-		return buildApiError("todoist.Client.DeleteTask", "item_delete "+string(id),
-			response.Status, string(body))
+	for _, cmd := range commands {
+		status := CommandStatus{Command: cmd}
+		rawStatus, found := responseContent.SyncStatus[cmd.Uuid]
+		okString := ""
+		if ! found {
+			status.Error = "no status returned"
+		} else if json.Unmarshal(rawStatus, &okString) == nil {
+			status.Ok = okString == "ok"
+			if ! status.Ok {
+				status.Error = okString
+			}
+		} else {
+			cmdError := syncError{}
+			json.Unmarshal(rawStatus, &cmdError)
+			status.Error = fmt.Sprintf("%d: %s", cmdError.ErrorCode, cmdError.Error)
+		}
+		if status.Ok && cmd.TempId != "" {
+			status.Id = responseContent.TempIdMapping[cmd.TempId]
+		}
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func buildBatchError(function string, failed []CommandStatus) *errors.PreflightError {
+	lines := make([]string, 0, len(failed))
+	for _, status := range failed {
+		lines = append(lines, fmt.Sprintf("\t\t%s %s%s: %s", status.Command.Type,
+			status.Command.Args.Content, status.Command.Args.Id, status.Error))
+	}
+
+	return &errors.PreflightError{
+		Status: 500,
+		Kind: errors.ErrUpstream,
+		InternalMessage: fmt.Sprintf("%s: %d commands failed: \n%s",
+			function, len(failed), strings.Join(lines, "\n")),
+		ExternalMessage: fmt.Sprintf("Todoist rejected %d commands.", len(failed)),
+	}
+}
+
+/*
+ * posts all tasks in one request; if any fail, the rest are removed again
+ */
+func (c Client) PostTasks(tasks []string) ([]string, *errors.PreflightError) {
+	commands := make([]Command, 0, len(tasks))
+	for _, task := range tasks {
+		cmd, pErr := NewAddCommand(task)
+		if pErr != nil {
+			return nil, pErr.Prepend("todoist.Client.PostTasks: error building command: ")
+		}
+		commands = append(commands, cmd)
+	}
+
+	statuses, pErr := c.Batch(commands)
+	if pErr != nil {
+		return nil, pErr.Prepend("todoist.Client.PostTasks: error posting tasks: ")
+	}
+
+	ids := make([]string, 0, len(statuses))
+	failed := make([]CommandStatus, 0)
+	for _, status := range statuses {
+		if status.Ok {
+			ids = append(ids, status.Id)
+		} else {
+			failed = append(failed, status)
+		}
+	}
+
+	if len(failed) > 0 {
+		pErr = buildBatchError("todoist.Client.PostTasks", failed)
+		rollbackErr := c.DeleteTasks(ids)
+		if rollbackErr != nil {
+			pErr.Prepend("todoist.Client.PostTasks: error removing posted tasks after failure: " +
+				"\n\t" + rollbackErr.Error())
+			return ids, pErr
+		}
+		return make([]string, 0), pErr
+	}
+
+	return ids, nil
+}
+
+func (c Client) DeleteTasks(ids []string) *errors.PreflightError {
+	commands := make([]Command, 0, len(ids))
+	for _, id := range ids {
+		if id == "" {
+			continue
+		}
+		cmd, pErr := NewDeleteCommand(id)
+		if pErr != nil {
+			return pErr.Prepend("todoist.Client.DeleteTasks: error building command: ")
+		}
+		commands = append(commands, cmd)
+	}
+
+	statuses, pErr := c.Batch(commands)
+	if pErr != nil {
+		return pErr.Prepend("todoist.Client.DeleteTasks: error deleting tasks: ")
+	}
+
+	failed := make([]CommandStatus, 0)
+	for _, status := range statuses {
+		if ! status.Ok {
+			failed = append(failed, status)
+		}
+	}
+	if len(failed) > 0 {
+		return buildBatchError("todoist.Client.DeleteTasks", failed)
 	}
 
 	return nil
 }
+
+/*
+ * returns the ids which are still open, i.e. neither completed nor deleted
+ */
+func (c Client) OpenTasks(ids []string) ([]string, *errors.PreflightError) {
+	open := make([]string, 0, len(ids))
+	requested := make([]string, 0, len(ids))
+	for _, id := range ids {
+		if id != "" {
+			requested = append(requested, id)
+		}
+	}
+
+	for start := 0; start < len(requested); start += MAX_PAGE_SIZE {
+		end := start + MAX_PAGE_SIZE
+		if end > len(requested) {
+			end = len(requested)
+		}
+		query := url.Values{}
+		query.Set("ids", strings.Join(requested[start:end], ","))
+		query.Set("limit", fmt.Sprintf("%d", MAX_PAGE_SIZE))
+
+		response, body, pErr := c.do("GET", "tasks?"+query.Encode(), nil)
+		if pErr != nil {
+			return nil, pErr.Prepend("todoist.Client.OpenTasks: error getting tasks: ")
+		}
+		if response.StatusCode != 200 {
+			return nil, buildApiError("todoist.Client.OpenTasks", "GET tasks",
+				response.Status, string(body))
+		}
+
+		page := new(tasksPage)
+		err := json.Unmarshal(body, page)
+		if err != nil {
+			return nil, &errors.PreflightError{
+				Status: 500,
+				Kind: errors.ErrUpstream,
+				Cause: err,
+				InternalMessage: "todoist.Client.OpenTasks: error parsing response \"" +
+					string(body) + "\": \n\t" + err.Error(),
+				ExternalMessage: "We recieved an unrecognized response from Todoist: " +
+					"\n\t\"" + string(body) + "\"",
+			}
+		}
+		for _, task := range page.Results {
+			if ! task.Checked && ! task.IsDeleted {
+				open = append(open, task.Id)
+			}
+		}
+	}
+
+	return open, nil
+}
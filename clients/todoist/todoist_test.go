@@ -31,3 +31,42 @@ func TestPostTasks(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestBatchTasks(t *testing.T) {
+	key := os.Getenv("TEST_API_KEY")
+	if key == "" {
+		t.Fatal("missing environment variable TEST_API_KEY")
+	}
+
+	c := New(Security{key})
+
+	ids, err := c.PostTasks([]string{"foo", "bar", "baz"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 3 {
+		t.Logf("ids wrong: expected 3 ids, got %v", ids)
+		t.Fail()
+	}
+
+	open, err := c.OpenTasks(ids)
+	if err != nil {
+		t.Error(err)
+	} else if len(open) != len(ids) {
+		t.Logf("open tasks wrong: expected %v, got %v", ids, open)
+		t.Fail()
+	}
+
+	err = c.DeleteTasks(ids)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	open, err = c.OpenTasks(ids)
+	if err != nil {
+		t.Error(err)
+	} else if len(open) != 0 {
+		t.Logf("open tasks wrong: expected none, got %v", open)
+		t.Fail()
+	}
+}
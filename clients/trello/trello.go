@@ -4,15 +4,23 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/metrics"
 	"io/ioutil"
+	"log/slog"
 	"net/http"
+	"net/url"
+	"time"
 )
 
+/*
+ * Logger, if set, receives a line for each call to the API
+ */
 type Client struct {
 	Url       string
 	Security  Security
 	BoardName string
 	Key       string
+	Logger    *slog.Logger
 }
 
 type board struct {
@@ -43,44 +51,72 @@ type ListKey struct {
 
 func (c Client) get(query string) ([]byte, *errors.PreflightError) {
 	request := c.Url + query + "&key=" + c.Key + "&token=" + c.Security.Token
+	start := time.Now()
 	response, err := http.Get(request)
 	if err != nil {
+		metrics.ObserveClientCall(metrics.SERVICE_TRELLO, 0)
+		// the error includes the url, and so the key and token, which must
+		// not be logged
+		urlErr, ok := err.(*url.Error)
+		if ok {
+			err = &url.Error{Op: urlErr.Op, URL: c.Url + query, Err: urlErr.Err}
+		}
+		c.logger().Warn("trello call failed", "query", query, "duration", time.Since(start),
+			"error", err.Error())
 		return nil, &errors.PreflightError{
 			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
 			InternalMessage: "trello.Client.get: error getting " +
-				request + ": \n\t" + err.Error(),
+				c.Url + query + ": \n\t" + err.Error(),
 			ExternalMessage: "There was an error querying Trello.",
 		}
 	}
 
 	body, err := ioutil.ReadAll(response.Body)
 	if err != nil {
+		metrics.ObserveClientCall(metrics.SERVICE_TRELLO, 0)
+		c.logger().Warn("trello call failed", "query", query, "duration", time.Since(start),
+			"error", err.Error())
 		return nil, &errors.PreflightError{
 			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
 			InternalMessage: "trello.Client.get: error reading response: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error querying Trello.",
 		}
 	}
 	response.Body.Close()
+	metrics.ObserveClientCall(metrics.SERVICE_TRELLO, response.StatusCode)
+	c.logger().Debug("trello call", "query", query, "status", response.StatusCode,
+		"duration", time.Since(start))
 
 	if response.StatusCode != 200 {
 		return nil, &errors.PreflightError{
 			Status: 500,
+			Kind: errors.ErrUpstream,
 			InternalMessage: fmt.Sprintf(
 				"trello.Client.get: bad API response getting %s: " +
 				"\n\t\tStatus: %s\n\t\tBody: %s",
-				request, response.Status, string(body)),
+				c.Url + query, response.Status, string(body)),
 			ExternalMessage: fmt.Sprintf(
 				"Trello returned an error response: " +
 				"\n\t\tStatus: %s\n\t\tBody: %s",
 				response.Status, string(body)),
-			}
+		}
 	}
 
 	return body, nil
 }
 
+func (c Client) logger() *slog.Logger {
+	if c.Logger == nil {
+		return slog.Default()
+	}
+	return c.Logger
+}
+
 func (c Client) boardId(boardName string) (string, *errors.PreflightError) {
 	body, pErr := c.get("members/me/boards?fields=name")
 	if pErr != nil {
@@ -92,6 +128,8 @@ func (c Client) boardId(boardName string) (string, *errors.PreflightError) {
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
 			InternalMessage: "trello.Client.boardId: error parsing response " +
 				string(body) + "\n\t" + err.Error(),
 			ExternalMessage: "There was an error querying Todoist.",
@@ -122,6 +160,8 @@ func (c Client) cardNames(boardId, listName string) ([]string, *errors.Preflight
 	if err != nil {
 		return nil, &errors.PreflightError{
 			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
 			InternalMessage: "trello.Client.cardName: error parsing response " +
 				string(body) + "\n\t" + err.Error(),
 			ExternalMessage: "There was an error querying Todoist.",
@@ -1,7 +1,10 @@
 package trello
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
 )
 
@@ -62,3 +65,29 @@ func TestGetList(t *testing.T) {
 		}
 	}
 }
+
+func TestErrorsOmitCredentials(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(401)
+		w.Write([]byte("invalid token"))
+	}))
+	defer server.Close()
+
+	c := Client{Url: server.URL + "/", Key: "secret-key", Security: Security{Token: "secret-token"}}
+	_, err := c.get("boards?fields=name")
+	if err == nil {
+		t.Fatal("test failure: expected error for 401 response")
+	}
+	c.Url = "http://127.0.0.1:0/"
+	_, err2 := c.get("boards?fields=name")
+	if err2 == nil {
+		t.Fatal("test failure: expected error for unreachable server")
+	}
+	for _, e := range []error{err, err2, err2.Cause} {
+		message := e.Error()
+		if strings.Contains(message, "secret-key") || strings.Contains(message, "secret-token") {
+			t.Logf("test failure: error contains credentials: %s", message)
+			t.Fail()
+		}
+	}
+}
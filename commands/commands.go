@@ -1,18 +1,27 @@
 package commands
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/jsutton9/preflight/api/errors"
 	"github.com/jsutton9/preflight/checklist"
-	"github.com/jsutton9/preflight/clients/todoist"
-	"github.com/jsutton9/preflight/clients/trello"
+	"github.com/jsutton9/preflight/clients/source"
+	"github.com/jsutton9/preflight/clients/target"
+	"github.com/jsutton9/preflight/metrics"
 	"github.com/jsutton9/preflight/persistence"
 	"github.com/jsutton9/preflight/security"
+	"log/slog"
 	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
+const MAX_AUDIT_PAGE = 500
+
 type updateJob struct {
+	Name string
 	Checklist *checklist.Checklist
 	Action int
 	Time time.Time
@@ -38,7 +47,31 @@ type checklistRequest struct {
 type tokenRequest struct {
 	Permissions security.PermissionFlags `json:"permissions"`
 	ExpiryHours int                      `json:"expiryHours"`
+	NoExpiry bool                        `json:"noExpiry"`
 	Description string                   `json:"description"`
+	Checklists []string                  `json:"checklists"`
+}
+
+type rotateRequest struct {
+	GraceMinutes *int `json:"graceMinutes"`
+	ExpiryHours int   `json:"expiryHours"`
+}
+
+type passwordRequest struct {
+	CurrentPassword string `json:"currentPassword"`
+	NewPassword string     `json:"newPassword"`
+	RevokeOtherTokens bool `json:"revokeOtherTokens"`
+}
+
+type resetRequest struct {
+	Email string       `json:"email"`
+	ResetToken string  `json:"resetToken"`
+	NewPassword string `json:"newPassword"`
+}
+
+type resetResponse struct {
+	ResetToken string `json:"resetToken"`
+	Expiry time.Time  `json:"expiry"`
 }
 
 type userRequest struct {
@@ -46,12 +79,14 @@ type userRequest struct {
 	Password string `json:"password"`
 }
 
-func AddUser(userReqString string, persister *persistence.Persister) (string, *errors.PreflightError) {
+func AddUser(userReqString string, persister persistence.Store) (string, *errors.PreflightError) {
 	request := userRequest{}
 	err := json.Unmarshal([]byte(userReqString), &request)
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			Cause: err,
 			InternalMessage: "commands.AddUser: error parsing userReqString: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "Request body is invalid.",
@@ -66,7 +101,7 @@ func AddUser(userReqString string, persister *persistence.Persister) (string, *e
 	return user.GetId(), nil
 }
 
-func DeleteUser(id string, persister *persistence.Persister) *errors.PreflightError {
+func DeleteUser(id string, persister persistence.Store) *errors.PreflightError {
 	user, err := persister.GetUser(id)
 	if err != nil {
 		return err.Prepend("commands.DeleteUser: error getting user: ")
@@ -80,7 +115,7 @@ func DeleteUser(id string, persister *persistence.Persister) *errors.PreflightEr
 	return nil
 }
 
-func GetUserIdFromEmail(email string, persister *persistence.Persister) (string, *errors.PreflightError) {
+func GetUserIdFromEmail(email string, persister persistence.Store) (string, *errors.PreflightError) {
 	user, err := persister.GetUserByEmail(email)
 	if err != nil {
 		return "", err.Prepend("commands.GetUserIdFromEmail: error getting user: ")
@@ -89,8 +124,27 @@ func GetUserIdFromEmail(email string, persister *persistence.Persister) (string,
 	return user.GetId(), nil
 }
 
-func GetUserIdFromToken(secret string, persister *persistence.Persister) (string, *errors.PreflightError) {
-	user, err := persister.GetUserByToken(secret)
+func GetEmail(id string, persister persistence.Store) (string, *errors.PreflightError) {
+	user, err := persister.GetUser(id)
+	if err != nil {
+		return "", err.Prepend("commands.GetEmail: error getting user: ")
+	}
+
+	return user.Email, nil
+}
+
+/*
+ * finds the user holding a token; the token itself is checked by ValidateToken
+ */
+func GetUserIdFromToken(presented string, persister persistence.Store) (string, *errors.PreflightError) {
+	var user *persistence.User
+	var err *errors.PreflightError
+	tokenId, secret := security.ParseToken(presented)
+	if tokenId != "" {
+		user, err = persister.GetUserByTokenId(tokenId)
+	} else {
+		user, err = persister.GetUserByTokenHash(security.HashTokenSecret(secret))
+	}
 	if err != nil {
 		return "", err.Prepend("commands.GetUserIdFromToken: error getting user: ")
 	}
@@ -98,7 +152,7 @@ func GetUserIdFromToken(secret string, persister *persistence.Persister) (string
 	return user.GetId(), nil
 }
 
-func ChangePassword(id string, newPassword string, persister *persistence.Persister) *errors.PreflightError {
+func ChangePassword(id string, newPassword string, actor persistence.Actor, persister persistence.Store) *errors.PreflightError {
 	user, err := persister.GetUser(id)
 	if err != nil {
 		return err.Prepend("commands.ChangePassword: error getting user: ")
@@ -114,10 +168,189 @@ func ChangePassword(id string, newPassword string, persister *persistence.Persis
 		return err.Prepend("commands.ChangePassword: error updating user in db: ")
 	}
 
+	err = audit(id, actor, "changePassword", "changed password", persister)
+	if err != nil {
+		return err.Prepend("commands.ChangePassword: ")
+	}
+
 	return nil
 }
 
-func ValidatePassword(id string, password string, persister *persistence.Persister) *errors.PreflightError {
+/*
+ * changes the password if the request gives the current one, and if asked,
+ * revokes every token but the one making the request
+ */
+func UpdatePassword(id, passwordReqString string, actor persistence.Actor, persister persistence.Store) *errors.PreflightError {
+	request := passwordRequest{}
+	err := json.Unmarshal([]byte(passwordReqString), &request)
+	if err != nil {
+		return &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			Cause: err,
+			InternalMessage: "commands.UpdatePassword: error unmarshalling request: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "Request body is invalid.",
+		}
+	}
+	if request.NewPassword == "" {
+		return &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			InternalMessage: "commands.UpdatePassword: no new password",
+			ExternalMessage: "A new password is required.",
+		}
+	}
+
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		return pErr.Prepend("commands.UpdatePassword: error getting user: ")
+	}
+	pErr = user.Security.ValidatePassword(request.CurrentPassword)
+	if pErr != nil {
+		return pErr.Prepend("commands.UpdatePassword: error validating current password: ")
+	}
+	pErr = user.Security.SetPassword(request.NewPassword)
+	if pErr != nil {
+		return pErr.Prepend("commands.UpdatePassword: error setting password: ")
+	}
+	summary := "changed password"
+	if request.RevokeOtherTokens {
+		keepId := ""
+		if actor.Type == persistence.ACTOR_TOKEN {
+			keepId = actor.Id
+		}
+		revoked := user.Security.RevokeTokens(keepId)
+		if len(revoked) > 0 {
+			summary += ", revoking tokens " + strings.Join(revoked, ", ")
+		}
+	}
+
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		return pErr.Prepend("commands.UpdatePassword: error updating user in db: ")
+	}
+
+	pErr = audit(id, actor, "changePassword", summary, persister)
+	if pErr != nil {
+		return pErr.Prepend("commands.UpdatePassword: ")
+	}
+
+	return nil
+}
+
+/*
+ * issues a token with which the user may reset their password within
+ * validFor, replacing any issued before, and returns it as json for the node
+ * to pass on to the user
+ */
+func IssuePasswordReset(id string, validFor time.Duration, actor persistence.Actor, persister persistence.Store) (string, *errors.PreflightError) {
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.IssuePasswordReset: error getting user: ")
+	}
+
+	resetToken, expiry, pErr := user.Security.IssueResetToken(validFor)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.IssuePasswordReset: error issuing reset token: ")
+	}
+
+	responseBytes, err := json.Marshal(resetResponse{ResetToken: resetToken, Expiry: expiry})
+	if err != nil {
+		return "", &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "commands.IssuePasswordReset: error marshalling response: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
+		}
+	}
+
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.IssuePasswordReset: error updating user in db: ")
+	}
+
+	summary := "issued password reset token, expiring " + expiry.Format(time.RFC3339)
+	pErr = audit(id, actor, "issuePasswordReset", summary, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.IssuePasswordReset: ")
+	}
+
+	return string(responseBytes), nil
+}
+
+/*
+ * sets a new password with a reset token, using the token up and revoking all
+ * of the user's tokens; an unknown email is reported as an invalid reset
+ * token, so that the request reveals nothing about which users exist
+ */
+func ResetPassword(resetReqString string, persister persistence.Store) *errors.PreflightError {
+	request := resetRequest{}
+	err := json.Unmarshal([]byte(resetReqString), &request)
+	if err != nil {
+		return &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			Cause: err,
+			InternalMessage: "commands.ResetPassword: error unmarshalling request: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "Request body is invalid.",
+		}
+	}
+	if request.NewPassword == "" {
+		return &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			InternalMessage: "commands.ResetPassword: no new password",
+			ExternalMessage: "A new password is required.",
+		}
+	}
+
+	user, pErr := persister.GetUserByEmail(request.Email)
+	if errors.Is(pErr, errors.ErrNotFound) {
+		return &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_RESET_TOKEN_INVALID,
+			Cause: pErr,
+			InternalMessage: "commands.ResetPassword: user \"" + request.Email + "\" not found",
+			ExternalMessage: "The password reset token was not recognized.",
+		}
+	} else if pErr != nil {
+		return pErr.Prepend("commands.ResetPassword: error getting user: ")
+	}
+	id := user.GetId()
+
+	// an expired token is refused whether or not it is stored, and is left
+	// for SweepTokens to remove
+	pErr = user.Security.UseResetToken(request.ResetToken)
+	if pErr != nil {
+		return pErr.Prepend("commands.ResetPassword: error using reset token: ")
+	}
+	pErr = user.Security.SetPassword(request.NewPassword)
+	if pErr != nil {
+		return pErr.Prepend("commands.ResetPassword: error setting password: ")
+	}
+	revoked := user.Security.RevokeTokens("")
+
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		return pErr.Prepend("commands.ResetPassword: error updating user in db: ")
+	}
+
+	summary := "reset password"
+	if len(revoked) > 0 {
+		summary += ", revoking tokens " + strings.Join(revoked, ", ")
+	}
+	pErr = audit(id, persistence.Actor{Type: persistence.ACTOR_RESET}, "resetPassword", summary, persister)
+	if pErr != nil {
+		return pErr.Prepend("commands.ResetPassword: ")
+	}
+
+	return nil
+}
+
+func ValidatePassword(id string, password string, persister persistence.Store) *errors.PreflightError {
 	user, err := persister.GetUser(id)
 	if err != nil {
 		return err.Prepend("commands.ValidatePassword: error getting user: ")
@@ -131,42 +364,133 @@ func ValidatePassword(id string, password string, persister *persistence.Persist
 	return nil
 }
 
-func ValidateNodeSecret(secret string, persister *persistence.Persister) *errors.PreflightError {
-	valid, err := persister.ValidateNodeSecret(secret)
+/*
+ * registers a node with the named capabilities, which are userAdmin and the
+ * names of token permissions, or every capability if none are named
+ */
+func RegisterNode(secretFile string, capabilityNames []string, persister persistence.Store) (string, *errors.PreflightError) {
+	capabilities := persistence.NodeCapabilities{}
+	if len(capabilityNames) == 0 {
+		capabilityNames = []string{"userAdmin", "checklistRead", "checklistWrite",
+			"checklistInvoke", "generalRead", "generalWrite"}
+	}
+	for _, name := range capabilityNames {
+		switch name {
+		case "userAdmin":
+			capabilities.UserAdmin = true
+		case "checklistRead":
+			capabilities.Permissions.ChecklistRead = true
+		case "checklistWrite":
+			capabilities.Permissions.ChecklistWrite = true
+		case "checklistInvoke":
+			capabilities.Permissions.ChecklistInvoke = true
+		case "generalRead":
+			capabilities.Permissions.GeneralRead = true
+		case "generalWrite":
+			capabilities.Permissions.GeneralWrite = true
+		default:
+			return "", &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_INVALID_PARAMETER,
+				InternalMessage: "commands.RegisterNode: capability \"" + name + "\" not recognized",
+				ExternalMessage: "Capability \"" + name + "\" not recognized.",
+			}
+		}
+	}
+
+	node, err := persister.RegisterNode(secretFile, capabilities)
 	if err != nil {
-		err.Prepend("commands.ValidateNodeSecret: error validating node secret: ")
-		return err
-	} else if ! valid {
-		return &errors.PreflightError{
+		return "", err.Prepend("commands.RegisterNode: error registering node: ")
+	}
+
+	return node.Id, nil
+}
+
+/*
+ * checks that the node secret is valid, and that the node has the permissions
+ * or, if userAdmin is set, may administer users
+ */
+func ValidateNode(secret string, permissions security.PermissionFlags, userAdmin bool, persister persistence.Store) (*persistence.Node, *errors.PreflightError) {
+	node, err := persister.GetNode(secret)
+	if err != nil {
+		return nil, err.Prepend("commands.ValidateNode: error getting node: ")
+	}
+
+	if userAdmin && ! node.Capabilities.UserAdmin {
+		return nil, &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_INSUFFICIENT_PERMISSIONS,
+			InternalMessage: "commands.ValidateNode: node " + node.Id + " may not administer users",
+			ExternalMessage: "The node does not have sufficient permissions.",
+		}
+	} else if ! node.Capabilities.Permissions.Allows(permissions) {
+		return nil, &errors.PreflightError{
 			Status: 401,
-			InternalMessage: "commands.ValidateNodeSecret: Node secret invalid",
-			ExternalMessage: "Node secret invalid",
+			Code: errors.CODE_INSUFFICIENT_PERMISSIONS,
+			InternalMessage: "commands.ValidateNode: node " + node.Id + " has insufficient permissions",
+			ExternalMessage: "The node does not have sufficient permissions.",
 		}
 	}
 
+	return node, nil
+}
+
+/*
+ * records in the audit log that a node acted on a user's behalf
+ */
+func AuditNodeAction(node *persistence.Node, userId, action string, persister persistence.Store) *errors.PreflightError {
+	err := persister.AddAuditEntry(&persistence.AuditEntry{
+		UserId: userId,
+		Actor: persistence.Actor{Type: persistence.ACTOR_NODE, Id: node.Id},
+		Action: action,
+	})
+	if err != nil {
+		return err.Prepend("commands.AuditNodeAction: error adding audit entry: ")
+	}
+
+	return nil
+}
+
+/*
+ * records that too many failed password attempts have locked out the user
+ */
+func AuditLockout(id, remoteAddr string, duration time.Duration, persister persistence.Store) *errors.PreflightError {
+	summary := fmt.Sprintf("locked out of password authentication for %v after failed attempts, the last from %s",
+		duration, remoteAddr)
+	err := audit(id, persistence.Actor{Type: persistence.ACTOR_PASSWORD}, "lockout", summary, persister)
+	if err != nil {
+		return err.Prepend("commands.AuditLockout: ")
+	}
+
 	return nil
 }
 
-func ValidateToken(id string, secret string, permissions security.PermissionFlags, persister *persistence.Persister) *errors.PreflightError {
+/*
+ * returns the token as the actor for the audit log
+ */
+func ValidateToken(id string, secret string, permissions security.PermissionFlags, checklist string, persister persistence.Store) (persistence.Actor, *errors.PreflightError) {
 	user, err := persister.GetUser(id)
 	if err != nil {
-		return err.Prepend("commands.ValidateToken: error getting user: ")
+		return persistence.Actor{}, err.Prepend("commands.ValidateToken: error getting user: ")
 	}
 
-	err = user.Security.ValidateToken(secret, permissions)
+	err = user.Security.ValidateToken(secret, permissions, checklist)
 	if err != nil {
-		return err.Prepend("commands.ValidateToken: error validating token: ")
+		return persistence.Actor{}, err.Prepend("commands.ValidateToken: error validating token: ")
 	}
 
-	return nil
+	token := user.Security.FindToken(secret)
+	return persistence.Actor{Type: persistence.ACTOR_TOKEN, Id: token.Id}, nil
 }
 
-func AddToken(id, tokenReqString string, persister *persistence.Persister) (string, *errors.PreflightError) {
+func AddToken(id, tokenReqString string, actor persistence.Actor, persister persistence.Store) (string, *errors.PreflightError) {
 	request := tokenRequest{}
 	err := json.Unmarshal([]byte(tokenReqString), &request)
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			Cause: err,
 			InternalMessage: "commands.AddToken: error unmarshalling request: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "Request body is invalid.",
@@ -177,8 +501,14 @@ func AddToken(id, tokenReqString string, persister *persistence.Persister) (stri
 	if pErr != nil {
 		return "", pErr.Prepend("commands.AddToken: error getting user: ")
 	}
+	swept, _ := user.Security.SweepTokens(time.Now())
 
-	token, pErr := user.Security.AddToken(request.Permissions, request.ExpiryHours, request.Description)
+	expiryHours := request.ExpiryHours
+	if request.NoExpiry {
+		expiryHours = security.NO_EXPIRY
+	}
+	token, pErr := user.Security.AddToken(request.Permissions, expiryHours,
+		request.Description, request.Checklists)
 	if pErr != nil {
 		return "", pErr.Prepend("commands.AddToken: error adding token: ")
 	}
@@ -187,6 +517,7 @@ func AddToken(id, tokenReqString string, persister *persistence.Persister) (stri
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "commands.AddToken: error marshalling token: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error creating the token.",
@@ -197,11 +528,25 @@ func AddToken(id, tokenReqString string, persister *persistence.Persister) (stri
 	if pErr != nil {
 		return "", pErr.Prepend("commands.AddToken: error updating user in db: ")
 	}
+	pErr = auditSweep(id, swept, actor, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.AddToken: ")
+	}
+
+	summary := fmt.Sprintf("added token %s with permissions %+v, %s",
+		token.Id, token.Permissions, describeExpiry(token))
+	if len(token.Checklists) > 0 {
+		summary += ", limited to checklists " + strings.Join(token.Checklists, ", ")
+	}
+	pErr = audit(id, actor, "addToken", summary, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.AddToken: ")
+	}
 
 	return string(tokenBytes[:]), nil
 }
 
-func DeleteToken(id, tokenId string, persister *persistence.Persister) *errors.PreflightError {
+func DeleteToken(id, tokenId string, actor persistence.Actor, persister persistence.Store) *errors.PreflightError {
 	user, err := persister.GetUser(id)
 	if err != nil {
 		return err.Prepend("commands.DeleteToken: error getting user: ")
@@ -214,6 +559,7 @@ func DeleteToken(id, tokenId string, persister *persistence.Persister) *errors.P
 			found = true
 			tokens[i] = tokens[len(tokens)-1]
 			user.Security.Tokens = tokens[:len(tokens)-1]
+			user.Security.DropRefreshTokens([]string{tokenId})
 			break
 		}
 	}
@@ -221,6 +567,7 @@ func DeleteToken(id, tokenId string, persister *persistence.Persister) *errors.P
 	if ! found {
 		return &errors.PreflightError{
 			Status: 404,
+			Code: errors.CODE_TOKEN_NOT_FOUND,
 			InternalMessage: "commands.DeleteToken: token id \"" + tokenId + "\" not found",
 			ExternalMessage: "Token not found",
 		}
@@ -231,22 +578,239 @@ func DeleteToken(id, tokenId string, persister *persistence.Persister) *errors.P
 		return err.Prepend("commands.DeleteToken: error updating user in db: ")
 	}
 
+	err = audit(id, actor, "deleteToken", "deleted token " + tokenId, persister)
+	if err != nil {
+		return err.Prepend("commands.DeleteToken: ")
+	}
+
+	return nil
+}
+
+/*
+ * hashes the secrets of tokens stored before secrets were hashed, returning
+ * the number of users updated
+ */
+func MigrateTokenSecrets(persister persistence.Store) (int, *errors.PreflightError) {
+	ids, pErr := persister.GetUserIds()
+	if pErr != nil {
+		return 0, pErr.Prepend("commands.MigrateTokenSecrets: error getting user ids: ")
+	}
+
+	updated := 0
+	for _, id := range ids {
+		user, pErr := persister.GetUser(id)
+		if pErr != nil {
+			return updated, pErr.Prepend("commands.MigrateTokenSecrets: error getting user: ")
+		}
+		if user.Security == nil || ! user.Security.HashTokenSecrets() {
+			continue
+		}
+		pErr = persister.UpdateUser(user)
+		if pErr != nil {
+			return updated, pErr.Prepend("commands.MigrateTokenSecrets: error updating user in db: ")
+		}
+		updated++
+	}
+
+	return updated, nil
+}
+
+/*
+ * returns the token with the given id, without its secret, as json
+ */
+func GetToken(id, tokenId string, persister persistence.Store) (string, *errors.PreflightError) {
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.GetToken: error getting user: ")
+	}
+
+	for _, token := range user.Security.Tokens {
+		if token.Id != tokenId {
+			continue
+		}
+		token.Secret = ""
+		tokenBytes, err := json.Marshal(token)
+		if err != nil {
+			return "", &errors.PreflightError{
+				Status: 500,
+				Cause: err,
+				InternalMessage: "commands.GetToken: error marshalling token: " +
+					"\n\t" + err.Error(),
+				ExternalMessage: "There was an error getting the token.",
+			}
+		}
+		return string(tokenBytes), nil
+	}
+
+	return "", &errors.PreflightError{
+		Status: 404,
+		Code: errors.CODE_TOKEN_NOT_FOUND,
+		InternalMessage: "commands.GetToken: token id \"" + tokenId + "\" not found",
+		ExternalMessage: "Token not found",
+	}
+}
+
+/*
+ * gives a token a new secret, returning the token with it as json; the old
+ * secret stays valid for the request's graceMinutes, or defaultGrace if it
+ * gives none
+ */
+func RotateToken(id, tokenId, rotateReqString string, defaultGrace time.Duration, actor persistence.Actor, persister persistence.Store) (string, *errors.PreflightError) {
+	request := rotateRequest{}
+	if strings.TrimSpace(rotateReqString) != "" {
+		err := json.Unmarshal([]byte(rotateReqString), &request)
+		if err != nil {
+			return "", &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_INVALID_BODY,
+				Cause: err,
+				InternalMessage: "commands.RotateToken: error unmarshalling request: " +
+					"\n\t" + err.Error(),
+				ExternalMessage: "Request body is invalid.",
+			}
+		}
+	}
+	grace := defaultGrace
+	if request.GraceMinutes != nil {
+		grace = time.Duration(*request.GraceMinutes) * time.Minute
+	}
+
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.RotateToken: error getting user: ")
+	}
+
+	// a token may rotate another only if it has every permission and
+	// checklist of the other, since the new secret is returned to it
+	if actor.Type == persistence.ACTOR_TOKEN && actor.Id != tokenId {
+		var caller, target *security.Token
+		for i, _ := range user.Security.Tokens {
+			if user.Security.Tokens[i].Id == actor.Id {
+				caller = &user.Security.Tokens[i]
+			} else if user.Security.Tokens[i].Id == tokenId {
+				target = &user.Security.Tokens[i]
+			}
+		}
+		if caller == nil || (target != nil && ! caller.Covers(*target)) {
+			return "", &errors.PreflightError{
+				Status: 403,
+				Code: errors.CODE_INSUFFICIENT_PERMISSIONS,
+				InternalMessage: "commands.RotateToken: token " + actor.Id +
+					" may not rotate token " + tokenId,
+				ExternalMessage: "The user token may not rotate a token with " +
+					"permissions or checklists it does not have.",
+			}
+		}
+	}
+
+	token, pErr := user.Security.RotateToken(tokenId, grace, request.ExpiryHours)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.RotateToken: error rotating token: ")
+	}
+
+	tokenBytes, err := json.Marshal(token)
+	if err != nil {
+		return "", &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "commands.RotateToken: error marshalling token: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error rotating the token.",
+		}
+	}
+
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.RotateToken: error updating user in db: ")
+	}
+
+	summary := fmt.Sprintf("rotated token %s, accepting the old secret for %v, %s",
+		tokenId, grace, describeExpiry(token))
+	pErr = audit(id, actor, "rotateToken", summary, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.RotateToken: ")
+	}
+
+	return string(tokenBytes), nil
+}
+
+/*
+ * removes the user's expired tokens, and the old secrets of rotated tokens
+ * once their grace period has ended
+ */
+func SweepTokens(id string, actor persistence.Actor, persister persistence.Store) *errors.PreflightError {
+	user, err := persister.GetUser(id)
+	if err != nil {
+		return err.Prepend("commands.SweepTokens: error getting user: ")
+	}
+
+	removed, changed := user.Security.SweepTokens(time.Now())
+	if ! changed {
+		return nil
+	}
+	err = persister.UpdateUser(user)
+	if err != nil {
+		return err.Prepend("commands.SweepTokens: error updating user in db: ")
+	}
+
+	err = auditSweep(id, removed, actor, persister)
+	if err != nil {
+		return err.Prepend("commands.SweepTokens: ")
+	}
+
+	return nil
+}
+
+/*
+ * records the removal of expired tokens; commands which issue tokens or codes
+ * also sweep the user first, so that expired ones don't pile up where no
+ * scheduler runs, and record the removal once the user is written
+ */
+func auditSweep(id string, removed []string, actor persistence.Actor, persister persistence.Store) *errors.PreflightError {
+	if len(removed) == 0 {
+		return nil
+	}
+	summary := "removed expired tokens " + strings.Join(removed, ", ")
+	err := audit(id, actor, "sweepTokens", summary, persister)
+	if err != nil {
+		return err.Prepend("commands.auditSweep: ")
+	}
 	return nil
 }
 
-func GetTokens(id string, persister *persistence.Persister) (string, *errors.PreflightError) {
+func describeExpiry(token *security.Token) string {
+	if token.NoExpiry {
+		return "never expiring"
+	}
+	return "expiring " + token.Expiry.Format(time.RFC3339)
+}
+
+/*
+ * returns the user's tokens, without secrets
+ */
+func ListTokens(id string, persister persistence.Store) ([]security.Token, *errors.PreflightError) {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
-		return "", pErr.Prepend("commands.GetTokens: error getting user: ")
+		return nil, pErr.Prepend("commands.ListTokens: error getting user: ")
 	}
 
 	for i, _ := range user.Security.Tokens {
 		user.Security.Tokens[i].Secret = ""
 	}
-	tokensBytes, err := json.Marshal(user.Security.Tokens)
+	return user.Security.Tokens, nil
+}
+
+func GetTokens(id string, persister persistence.Store) (string, *errors.PreflightError) {
+	tokens, pErr := ListTokens(id, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.GetTokens: ")
+	}
+
+	tokensBytes, err := json.Marshal(tokens)
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "commands.GetTokens: error marshalling tokens: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error getting the tokens.",
@@ -256,7 +820,7 @@ func GetTokens(id string, persister *persistence.Persister) (string, *errors.Pre
 	return string(tokensBytes), nil
 }
 
-func SetTodoistToken(id string, token string, persister *persistence.Persister) *errors.PreflightError {
+func SetTodoistToken(id string, token string, persister persistence.Store) *errors.PreflightError {
 	user, err := persister.GetUser(id)
 	if err != nil {
 		return err.Prepend("commands.SetTodoistToken: error getting user: ")
@@ -272,7 +836,7 @@ func SetTodoistToken(id string, token string, persister *persistence.Persister)
 	return nil
 }
 
-func SetTrelloToken(id string, token string, persister *persistence.Persister) *errors.PreflightError {
+func SetTrelloToken(id string, token string, persister persistence.Store) *errors.PreflightError {
 	user, err := persister.GetUser(id)
 	if err != nil {
 		return err.Prepend("commands.SetTrelloToken: error getting user: ")
@@ -288,19 +852,28 @@ func SetTrelloToken(id string, token string, persister *persistence.Persister) *
 	return nil
 }
 
-func Update(id string, trelloKey string, persister *persistence.Persister) *errors.PreflightError {
+/*
+ * logger receives lines for the checklists posted and removed, and is passed
+ * on to the clients
+ */
+func Update(id string, trelloKey string, logger *slog.Logger, persister persistence.Store) *errors.PreflightError {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return pErr.Prepend("commands.Update: error getting user: ")
 	}
 
-	td := todoist.New(user.Security.Todoist)
-	trelloClient := trello.New(user.Security.Trello, trelloKey, user.Settings.TrelloBoard)
+	sourceConfig := source.Config{
+		Security: user.Security,
+		TrelloKey: trelloKey,
+		TrelloBoard: user.Settings.TrelloBoard,
+		Logger: logger,
+	}
 
 	loc, err := time.LoadLocation(user.Settings.Timezone)
 	if err != nil {
 		return &errors.PreflightError{
 			Status: 424,
+			Cause: err,
 			InternalMessage: "commands.Update: error loading timezone: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "Could not find your timezone in the IANA database.",
@@ -309,9 +882,12 @@ func Update(id string, trelloKey string, persister *persistence.Persister) *erro
 	now := time.Now().In(loc)
 
 	jobs := make(jobsByTime, 0)
-	for _, cl := range user.Checklists {
+	for name, cl := range user.Checklists {
+		if ! cl.IsScheduled {
+			continue
+		}
 		if cl.Record == nil {
-			cl.Record = &checklist.UpdateRecord{Ids:make([]int,0)}
+			cl.Record = &checklist.UpdateRecord{Ids:make([]string,0)}
 		}
 		action, updateTime, pErr := cl.Action(cl.Record.AddTime, cl.Record.Time, now)
 		if pErr != nil {
@@ -319,6 +895,7 @@ func Update(id string, trelloKey string, persister *persistence.Persister) *erro
 		}
 		if action != 0 {
 			jobs = append(jobs, updateJob{
+				Name: name,
 				Checklist: cl,
 				Action: action,
 				Time: updateTime,
@@ -327,37 +904,106 @@ func Update(id string, trelloKey string, persister *persistence.Persister) *erro
 	}
 
 	sort.Stable(jobs)
+	records := make(map[string]*checklist.UpdateRecord)
 	for _, job := range jobs {
 		if job.Checklist.Record == nil {
 			job.Checklist.Record = new(checklist.UpdateRecord)
 		}
+		tasksTarget, pErr := target.New(job.Checklist.TasksTarget, user.Security, logger)
+		if pErr != nil {
+			return pErr.Prepend("commands.Update: error getting tasks target: ")
+		}
 		if job.Action > 0 {
-			job.Checklist.Record.Ids, pErr = postTasks(td, trelloClient, *job.Checklist)
+			tasksSource, pErr := source.New(job.Checklist.TasksSource, sourceConfig)
+			if pErr != nil {
+				return pErr.Prepend("commands.Update: error getting tasks source: ")
+			}
+			job.Checklist.Record.Ids, pErr = postTasks(tasksTarget, tasksSource, *job.Checklist)
 			if pErr != nil {
 				return pErr.Prepend("commands.Update: error posting tasks: ")
 			}
 			job.Checklist.Record.AddTime = now
+			metrics.ChecklistPosted()
+			logger.Info("posted checklist", "checklist", job.Name,
+				"tasks", len(job.Checklist.Record.Ids))
 		} else {
-			for _, id := range job.Checklist.Record.Ids {
-				pErr = td.DeleteTask(id)
-				if pErr != nil {
-					return pErr.Prepend("commands.Update: error deleting tasks: ")
-				}
+			pErr = deleteTasks(tasksTarget, job.Checklist.Record.Ids)
+			if pErr != nil {
+				return pErr.Prepend("commands.Update: error deleting tasks: ")
 			}
-			job.Checklist.Record.Ids = make([]int, 0)
+			metrics.ChecklistRemoved()
+			logger.Info("removed checklist", "checklist", job.Name)
+			job.Checklist.Record.Ids = make([]string, 0)
 		}
 		job.Checklist.Record.Time = now
+		records[job.Name] = job.Checklist.Record
 	}
 
-	pErr = persister.UpdateUser(user)
-	if pErr != nil {
-		return pErr.Prepend("commands.Update: error updating user in db: ")
+	if len(records) > 0 {
+		pErr = persister.UpdateChecklistRecords(id, records)
+		if pErr != nil {
+			return pErr.Prepend("commands.Update: error updating records in db: ")
+		}
 	}
 
 	return nil
 }
 
-func Invoke(id string, name string, trelloKey string, persister *persistence.Persister) *errors.PreflightError {
+/*
+ * returns the time at which Update should next be run for the user, which is
+ * now if an action is already pending, or the zero time if nothing is scheduled
+ */
+func NextUpdate(id string, persister persistence.Store) (time.Time, *errors.PreflightError) {
+	var next time.Time
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		return next, pErr.Prepend("commands.NextUpdate: error getting user: ")
+	}
+
+	loc, err := time.LoadLocation(user.Settings.Timezone)
+	if err != nil {
+		return next, &errors.PreflightError{
+			Status: 424,
+			Cause: err,
+			InternalMessage: "commands.NextUpdate: error loading timezone: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "Could not find your timezone in the IANA database.",
+		}
+	}
+	now := time.Now().In(loc)
+
+	for _, cl := range user.Checklists {
+		if ! cl.IsScheduled {
+			continue
+		}
+		record := cl.Record
+		if record == nil {
+			record = new(checklist.UpdateRecord)
+		}
+		action, _, pErr := cl.Action(record.AddTime, record.Time, now)
+		if pErr != nil {
+			return next, pErr.Prepend("commands.NextUpdate: error determining action: ")
+		}
+		if action != 0 {
+			return now, nil
+		}
+
+		clNext, pErr := cl.Next(now)
+		if pErr != nil {
+			return next, pErr.Prepend("commands.NextUpdate: error determining next update: ")
+		}
+		if ! clNext.IsZero() && (next.IsZero() || clNext.Before(next)) {
+			next = clNext
+		}
+	}
+
+	return next, nil
+}
+
+/*
+ * logger is as for Update
+ */
+func Invoke(id string, name string, trelloKey string, actor persistence.Actor, logger *slog.Logger, persister persistence.Store) *errors.PreflightError {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return pErr.Prepend("commands.Invoke: error getting user: ")
@@ -366,15 +1012,27 @@ func Invoke(id string, name string, trelloKey string, persister *persistence.Per
 	if ! found {
 		return &errors.PreflightError{
 			Status: 404,
+			Code: errors.CODE_CHECKLIST_NOT_FOUND,
 			InternalMessage: "commands.Invoke: checklist \""+name+"\" not found",
 			ExternalMessage: "Checklist \""+name+"\" not found",
 		}
 	}
 
-	todoistClient := todoist.New(user.Security.Todoist)
-	trelloClient := trello.New(user.Security.Trello, trelloKey, user.Settings.TrelloBoard)
+	tasksTarget, pErr := target.New(cl.TasksTarget, user.Security, logger)
+	if pErr != nil {
+		return pErr.Prepend("commands.Invoke: error getting tasks target: ")
+	}
+	tasksSource, pErr := source.New(cl.TasksSource, source.Config{
+		Security: user.Security,
+		TrelloKey: trelloKey,
+		TrelloBoard: user.Settings.TrelloBoard,
+		Logger: logger,
+	})
+	if pErr != nil {
+		return pErr.Prepend("commands.Invoke: error getting tasks source: ")
+	}
 	if cl.Record == nil {
-		cl.Record = &checklist.UpdateRecord{Ids:make([]int, 0)}
+		cl.Record = &checklist.UpdateRecord{Ids:make([]string, 0)}
 	}
 
 	// TODO: move time and ids updates to postTasks?
@@ -382,6 +1040,7 @@ func Invoke(id string, name string, trelloKey string, persister *persistence.Per
 	if err != nil {
 		return &errors.PreflightError{
 			Status: 424,
+			Cause: err,
 			InternalMessage: "commands.Invoke: error loading timezone: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "Could not find your timezone in the IANA database.",
@@ -389,31 +1048,50 @@ func Invoke(id string, name string, trelloKey string, persister *persistence.Per
 	}
 	now := time.Now().In(loc)
 
-	cl.Record.Ids, pErr = postTasks(todoistClient, trelloClient, *cl)
+	cl.Record.Ids, pErr = postTasks(tasksTarget, tasksSource, *cl)
 	if pErr != nil {
 		return pErr.Prepend("commands.Invoke: error posting tasks: ")
 	}
+	metrics.ChecklistPosted()
+	logger.Info("posted checklist", "checklist", name, "tasks", len(cl.Record.Ids))
 	cl.Record.Time = now
-	pErr = persister.UpdateUser(user)
+	pErr = persister.UpdateChecklistRecords(id, map[string]*checklist.UpdateRecord{name: cl.Record})
+	if pErr != nil {
+		return pErr.Prepend("commands.Invoke: error updating record in db: ")
+	}
+
+	summary := fmt.Sprintf("invoked checklist %s, posting %d tasks", name, len(cl.Record.Ids))
+	pErr = audit(id, actor, "invoke", summary, persister)
 	if pErr != nil {
-		return pErr.Prepend("commands.Invoke: error updating user in db: ")
+		return pErr.Prepend("commands.Invoke: ")
 	}
 
 	return nil
 }
 
-func AddChecklist(id, checklistReqString string, persister *persistence.Persister) (string, *errors.PreflightError) {
+func AddChecklist(id, checklistReqString string, actor persistence.Actor, persister persistence.Store) (string, *errors.PreflightError) {
 	request := checklistRequest{}
 	err := json.Unmarshal([]byte(checklistReqString), &request)
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			Cause: err,
 			InternalMessage: "commands.AddUser: error parsing checklistReqString: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "Request body is invalid.",
 		}
 	}
 
+	pErr := validateChecklistName(request.Name)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.AddChecklist: ")
+	}
+	pErr = validateChecklist(&request.Checklist)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.AddChecklist: invalid checklist: ")
+	}
+
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return "", pErr.Prepend("commands.AddChecklist: error getting user: ")
@@ -422,6 +1100,7 @@ func AddChecklist(id, checklistReqString string, persister *persistence.Persiste
 	if found {
 		return "", &errors.PreflightError{
 			Status: 409,
+			Code: errors.CODE_CHECKLIST_EXISTS,
 			InternalMessage: "commands.AddChecklist: checklist \"" +
 				request.Name + "\" already exists",
 			ExternalMessage: "Checklist \"" + request.Name + "\" already exists.",
@@ -434,21 +1113,33 @@ func AddChecklist(id, checklistReqString string, persister *persistence.Persiste
 		return "", pErr.Prepend("commands.AddChecklist: error updating user in db: ")
 	}
 
+	pErr = audit(id, actor, "addChecklist", "added checklist " + request.Name, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.AddChecklist: ")
+	}
+
 	return request.Name, nil
 }
 
-func UpdateChecklist(id, name, checklistString string, persister *persistence.Persister) *errors.PreflightError {
+func UpdateChecklist(id, name, checklistString string, actor persistence.Actor, persister persistence.Store) *errors.PreflightError {
 	cl := checklist.Checklist{}
 	err := json.Unmarshal([]byte(checklistString), &cl)
 	if err != nil {
 		return &errors.PreflightError{
 			Status: 400,
+			Code: errors.CODE_INVALID_BODY,
+			Cause: err,
 			InternalMessage: "commands.UpdateChecklist: error parsing templateString:" +
 				"\n\t" + err.Error(),
 			ExternalMessage: "Request body is invalid.",
 		}
 	}
 
+	pErr := validateChecklist(&cl)
+	if pErr != nil {
+		return pErr.Prepend("commands.UpdateChecklist: invalid checklist: ")
+	}
+
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return pErr.Prepend("commands.UpdateChecklist: error getting user: ")
@@ -457,6 +1148,7 @@ func UpdateChecklist(id, name, checklistString string, persister *persistence.Pe
 	if ! found {
 		return &errors.PreflightError{
 			Status: 404,
+			Code: errors.CODE_CHECKLIST_NOT_FOUND,
 			InternalMessage: "command.UpdateChecklist: checklist \""+name+"\" not found",
 			ExternalMessage: "Checklist \""+name+"\" not found.",
 		}
@@ -470,10 +1162,20 @@ func UpdateChecklist(id, name, checklistString string, persister *persistence.Pe
 		return pErr.Prepend("commands.UpdateChecklist: error updating user in db: ")
 	}
 
+	summary := "updated checklist " + name
+	changed := changedFields(clOld, &cl)
+	if len(changed) > 0 {
+		summary += ", changing " + strings.Join(changed, ", ")
+	}
+	pErr = audit(id, actor, "updateChecklist", summary, persister)
+	if pErr != nil {
+		return pErr.Prepend("commands.UpdateChecklist: ")
+	}
+
 	return nil
 }
 
-func DeleteChecklist(id, name string, persister *persistence.Persister) *errors.PreflightError {
+func DeleteChecklist(id, name string, actor persistence.Actor, persister persistence.Store) *errors.PreflightError {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return pErr.Prepend("commands.DeleteChecklist: error getting user: ")
@@ -482,6 +1184,7 @@ func DeleteChecklist(id, name string, persister *persistence.Persister) *errors.
 	if ! found {
 		return &errors.PreflightError{
 			Status: 404,
+			Code: errors.CODE_CHECKLIST_NOT_FOUND,
 			InternalMessage: "commands.DeleteChecklist: checklist \""+name+"\"not found",
 			ExternalMessage: "Checklist \""+name+"\" not found.",
 		}
@@ -494,10 +1197,74 @@ func DeleteChecklist(id, name string, persister *persistence.Persister) *errors.
 		return pErr.Prepend("commands.DeleteChecklist: error updating user in db: ")
 	}
 
+	pErr = audit(id, actor, "deleteChecklist", "deleted checklist " + name, persister)
+	if pErr != nil {
+		return pErr.Prepend("commands.DeleteChecklist: ")
+	}
+
 	return nil
 }
 
-func GetChecklistString(id, name string, persister *persistence.Persister) (string, *errors.PreflightError) {
+type auditPage struct {
+	Entries []persistence.AuditEntry `json:"entries"`
+	Next string                      `json:"next,omitempty"`
+}
+
+/*
+ * returns a page of the user's audit log, newest first, from before the
+ * RFC 3339 time before, or from the latest entry if before is empty; before
+ * may be followed by a comma and an entry id to continue from that entry
+ * among several at the same time, as in the next value included in the page
+ */
+func GetAuditLog(id, before string, limit int, persister persistence.Store) (string, *errors.PreflightError) {
+	var beforeTime time.Time
+	beforeId := ""
+	if before != "" {
+		var err error
+		if comma := strings.Index(before, ","); comma >= 0 {
+			before, beforeId = before[:comma], before[comma+1:]
+		}
+		beforeTime, err = time.Parse(time.RFC3339Nano, before)
+		if err != nil {
+			return "", &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_INVALID_PARAMETER,
+				Cause: err,
+				InternalMessage: "commands.GetAuditLog: error parsing before: " +
+					"\n\t" + err.Error(),
+				ExternalMessage: "\"before\" must be an RFC 3339 time.",
+			}
+		}
+	}
+	if limit <= 0 || limit > MAX_AUDIT_PAGE {
+		limit = MAX_AUDIT_PAGE
+	}
+
+	entries, pErr := persister.GetAuditEntries(id, beforeTime, beforeId, limit)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.GetAuditLog: error getting entries: ")
+	}
+
+	page := auditPage{Entries: entries}
+	if len(entries) == limit {
+		last := entries[len(entries)-1]
+		page.Next = last.Time.Format(time.RFC3339Nano) + "," + last.Id
+	}
+	pageBytes, err := json.Marshal(page)
+	if err != nil {
+		return "", &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "commands.GetAuditLog: error marshalling entries: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error getting the audit log.",
+		}
+	}
+
+	return string(pageBytes), nil
+}
+
+func GetChecklistString(id, name string, persister persistence.Store) (string, *errors.PreflightError) {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return "", pErr.Prepend("commands.GetChecklistString: error getting user: ")
@@ -506,6 +1273,7 @@ func GetChecklistString(id, name string, persister *persistence.Persister) (stri
 	if ! found {
 		return "", &errors.PreflightError{
 			Status: 404,
+			Code: errors.CODE_CHECKLIST_NOT_FOUND,
 			InternalMessage: "commands.GetChecklistString: checklist \"" +
 				name + "\" not found",
 			ExternalMessage: "Checklist \""+name+"\" not found.",
@@ -516,6 +1284,7 @@ func GetChecklistString(id, name string, persister *persistence.Persister) (stri
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "commands.GetChecklistString: error marshalling checklist: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error getting the checklist.",
@@ -525,7 +1294,7 @@ func GetChecklistString(id, name string, persister *persistence.Persister) (stri
 	return string(jsonBytes[:]), nil
 }
 
-func GetChecklistsString(id string, persister *persistence.Persister) (string, *errors.PreflightError) {
+func GetChecklistsString(id string, persister persistence.Store) (string, *errors.PreflightError) {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return "", pErr.Prepend("commands.GetChecklistsString: error getting user: ")
@@ -535,6 +1304,7 @@ func GetChecklistsString(id string, persister *persistence.Persister) (string, *
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "commands.GetChecklistsString: error marshalling checklists: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error getting the checklists.",
@@ -544,7 +1314,7 @@ func GetChecklistsString(id string, persister *persistence.Persister) (string, *
 	return string(jsonBytes[:]), nil
 }
 
-func GetGeneralSettings(id string, persister *persistence.Persister) (string, *errors.PreflightError) {
+func GetGeneralSettings(id string, persister persistence.Store) (string, *errors.PreflightError) {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return "", pErr.Prepend("commands.GetGeneralSettings: error getting settings: ")
@@ -554,6 +1324,7 @@ func GetGeneralSettings(id string, persister *persistence.Persister) (string, *e
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "commands.GetGeneralSettings: error marshalling settings: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error getting the settings.",
@@ -563,7 +1334,7 @@ func GetGeneralSettings(id string, persister *persistence.Persister) (string, *e
 	return string(settingsBytes), nil
 }
 
-func SetGeneralSetting(id, name, value string, persister *persistence.Persister) *errors.PreflightError {
+func SetGeneralSetting(id, name, value string, persister persistence.Store) *errors.PreflightError {
 	user, pErr := persister.GetUser(id)
 	if pErr != nil {
 		return pErr.Prepend("commands.SetGeneralSetting: error getting user: ")
@@ -576,6 +1347,7 @@ func SetGeneralSetting(id, name, value string, persister *persistence.Persister)
 	} else {
 		return &errors.PreflightError{
 			Status: 404,
+			Code: errors.CODE_SETTING_NOT_FOUND,
 			InternalMessage: "commands.SetGeneralSetting: setting \"" +
 				name + "\" not recognized",
 			ExternalMessage: "Setting \"" + name + "\" not recognized.",
@@ -589,30 +1361,231 @@ func SetGeneralSetting(id, name, value string, persister *persistence.Persister)
 	return nil
 }
 
-func postTasks(c todoist.Client, trl trello.Client, checklist checklist.Checklist) ([]int, *errors.PreflightError) {
-	ids := make([]int, 0)
+func postTasks(c target.Target, s source.Source, checklist checklist.Checklist) ([]string, *errors.PreflightError) {
+	tasks, pErr := s.Tasks(checklist)
+	if pErr != nil {
+		return make([]string, 0), pErr.Prepend("commands.postTasks: error getting tasks:")
+	}
 
-	if checklist.TasksSource == "preflight" {
-		for _, task := range checklist.Tasks {
-			id, pErr := c.PostTask(task)
-			if pErr != nil {
-				return ids, pErr.Prepend("commands.postTasks: error posting tasks:")
-			}
-			ids = append(ids, id)
+	ids, pErr := c.PostTasks(tasks)
+	if pErr != nil {
+		return ids, pErr.Prepend("commands.postTasks: error posting tasks:")
+	}
+
+	return ids, nil
+}
+
+func deleteTasks(c target.Target, ids []string) *errors.PreflightError {
+	open, pErr := c.OpenTasks(ids)
+	if pErr != nil {
+		return pErr.Prepend("commands.deleteTasks: error checking task status: ")
+	}
+
+	pErr = c.DeleteTasks(open)
+	if pErr != nil {
+		return pErr.Prepend("commands.deleteTasks: error deleting tasks: ")
+	}
+
+	return nil
+}
+
+func validateChecklist(cl *checklist.Checklist) *errors.PreflightError {
+	if ! source.Exists(cl.TasksSource) {
+		return &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			InternalMessage: "commands.validateChecklist: tasks source \"" +
+				cl.TasksSource + "\" not recognized",
+			ExternalMessage: "Tasks source \"" + cl.TasksSource + "\" not recognized.",
 		}
-	} else if checklist.TasksSource == "trello" {
-		tasks, pErr := trl.Tasks(checklist.Trello)
-		if pErr != nil {
-			return ids, pErr.Prepend("commands.postTasks: error getting tasks from trello:")
+	}
+	if ! target.Exists(cl.TasksTarget) {
+		return &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			InternalMessage: "commands.validateChecklist: tasks target \"" +
+				cl.TasksTarget + "\" not recognized",
+			ExternalMessage: "Tasks target \"" + cl.TasksTarget + "\" not recognized.",
 		}
-		for _, task := range tasks {
-			id, pErr := c.PostTask(task)
-			if pErr != nil {
-				return ids, pErr.Prepend("commands.postTasks: error posting tasks:")
+	}
+
+	return nil
+}
+
+/*
+ * checklist names are keys in the stored user, so must not be empty or hold
+ * the characters MongoDB gives meaning to in field paths
+ */
+func validateChecklistName(name string) *errors.PreflightError {
+	if name == "" || strings.ContainsAny(name, ".$") {
+		return &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_CHECKLIST_INVALID,
+			InternalMessage: "commands.validateChecklistName: invalid name \"" + name + "\"",
+			ExternalMessage: "Checklist names must not be empty or contain \".\" or \"$\".",
+		}
+	}
+
+	return nil
+}
+
+func audit(id string, actor persistence.Actor, action, summary string, persister persistence.Store) *errors.PreflightError {
+	err := persister.AddAuditEntry(&persistence.AuditEntry{
+		UserId: id,
+		Actor: actor,
+		Action: action,
+		Summary: summary,
+	})
+	if err != nil {
+		return err.Prepend("commands.audit: error adding audit entry: ")
+	}
+
+	return nil
+}
+
+/*
+ * returns the json names of the top-level fields which differ between two
+ * checklists, ignoring the update record
+ */
+func changedFields(before, after *checklist.Checklist) []string {
+	beforeFields := make(map[string]json.RawMessage)
+	afterFields := make(map[string]json.RawMessage)
+	beforeBytes, _ := json.Marshal(before)
+	afterBytes, _ := json.Marshal(after)
+	json.Unmarshal(beforeBytes, &beforeFields)
+	json.Unmarshal(afterBytes, &afterFields)
+
+	changed := make([]string, 0)
+	for name, value := range afterFields {
+		if name != "updateRecord" && ! bytes.Equal(beforeFields[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name, _ := range beforeFields {
+		if _, found := afterFields[name]; ! found && name != "updateRecord" {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+
+	return changed
+}
+
+/*
+ * collects uses of tokens in memory, so that authenticating a request does
+ * not write to the database; Run writes them once per interval
+ */
+type UsageTracker struct {
+	interval time.Duration
+	lock sync.Mutex
+	uses map[string]*tokenUses
+	stop chan struct{}
+	done chan struct{}
+}
+
+type tokenUses struct {
+	userId string
+	tokenId string
+	count int
+	last time.Time
+	address string
+}
+
+func NewUsageTracker(interval time.Duration) *UsageTracker {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return &UsageTracker{
+		interval: interval,
+		uses: make(map[string]*tokenUses),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+/*
+ * records a use of the token from address now
+ */
+func (u *UsageTracker) Record(userId, tokenId, address string) {
+	key := userId + "/" + tokenId
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	uses, found := u.uses[key]
+	if ! found {
+		uses = &tokenUses{userId: userId, tokenId: tokenId}
+		u.uses[key] = uses
+	}
+	uses.count++
+	uses.last = time.Now()
+	uses.address = address
+}
+
+/*
+ * writes the uses collected once per interval until Stop is called, then
+ * writes those left
+ */
+func (u *UsageTracker) Run(persister persistence.Store, logger *slog.Logger) {
+	defer close(u.done)
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+	for {
+		stopped := false
+		select {
+		case <-ticker.C:
+		case <-u.stop:
+			stopped = true
+		}
+		err := u.Flush(persister)
+		if err != nil {
+			logger.Error("error recording token uses", "error", err.Prepend("commands.UsageTracker.Run: "))
+		}
+		if stopped {
+			return
+		}
+	}
+}
+
+/*
+ * stops Run and waits for it to write the uses left
+ */
+func (u *UsageTracker) Stop() {
+	close(u.stop)
+	<-u.done
+}
+
+/*
+ * writes every use not yet written, forgetting those written; uses which
+ * can't be written are kept to be tried again
+ */
+func (u *UsageTracker) Flush(persister persistence.Store) *errors.PreflightError {
+	u.lock.Lock()
+	pending := u.uses
+	u.uses = make(map[string]*tokenUses)
+	u.lock.Unlock()
+
+	var firstErr *errors.PreflightError
+	for key, uses := range pending {
+		err := persister.RecordTokenUse(uses.userId, uses.tokenId, uses.count, uses.last, uses.address)
+		if err != nil {
+			u.restore(key, uses)
+			if firstErr == nil {
+				firstErr = err.Prepend("commands.UsageTracker.Flush: ")
 			}
-			ids = append(ids, id)
 		}
 	}
+	return firstErr
+}
 
-	return ids, nil
+/*
+ * puts back uses which could not be written, to be written with the next
+ */
+func (u *UsageTracker) restore(key string, pending *tokenUses) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	uses, found := u.uses[key]
+	if ! found {
+		u.uses[key] = pending
+		return
+	}
+	uses.count += pending.count
 }
@@ -2,18 +2,26 @@ package commands
 
 import (
 	"fmt"
+	"github.com/jsutton9/preflight/api/errors"
 	"github.com/jsutton9/preflight/checklist"
 	"github.com/jsutton9/preflight/persistence"
 	"github.com/jsutton9/preflight/security"
 	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"math/rand"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
 
+var testActor = persistence.Actor{Type: persistence.ACTOR_CLI}
+
 func TestUserCommands(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
-	persister, pErr := persistence.New("localhost", "commands-test")
+	persister := persistence.NewMemoryStore()
 	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
 	oldPassword := "old-pass"
 	newPassword := "new-pass"
@@ -42,7 +50,7 @@ func TestUserCommands(t *testing.T) {
 		t.Fatal(pErr)
 	}
 
-	tokenString, pErr := AddToken(id, tokenReqString, persister)
+	tokenString, pErr := AddToken(id, tokenReqString, testActor, persister)
 	if pErr != nil {
 		t.Fatal(pErr)
 	}
@@ -67,7 +75,7 @@ func TestUserCommands(t *testing.T) {
 	}
 
 	passwordValidBefore := ValidatePassword(id, oldPassword, persister)
-	pErr = ChangePassword(id, newPassword, persister)
+	pErr = ChangePassword(id, newPassword, testActor, persister)
 	if pErr != nil {
 		t.Log("error changing password: " +
 			"\n\t" + pErr.Error())
@@ -113,7 +121,7 @@ func TestUserCommands(t *testing.T) {
 func TestChecklistCommands(t *testing.T) {
 	// setup
 	rand.Seed(time.Now().UnixNano())
-	persister, pErr := persistence.New("localhost", "commands-test")
+	persister := persistence.NewMemoryStore()
 	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
 	name := "foo"
 	userReq := userRequest{
@@ -159,7 +167,7 @@ func TestChecklistCommands(t *testing.T) {
 	checklistIn2String := string(checklistIn2Bytes[:])
 
 	// execute checklist commands
-	_, pErr = AddChecklist(id, checklistReqString, persister)
+	_, pErr = AddChecklist(id, checklistReqString, testActor, persister)
 	if pErr != nil {
 		t.Fatal(pErr)
 	}
@@ -170,7 +178,7 @@ func TestChecklistCommands(t *testing.T) {
 		t.Fail()
 	}
 
-	pErr = UpdateChecklist(id, name, checklistIn2String, persister)
+	pErr = UpdateChecklist(id, name, checklistIn2String, testActor, persister)
 	if pErr != nil {
 		t.Log("error updating checklist: " +
 			"\n\t" + pErr.Error())
@@ -190,7 +198,7 @@ func TestChecklistCommands(t *testing.T) {
 		t.Fail()
 	}
 
-	pErr = DeleteChecklist(id, name, persister)
+	pErr = DeleteChecklist(id, name, testActor, persister)
 	if pErr != nil {
 		t.Log("error deleting checklist: " +
 			"\n\t" + pErr.Error())
@@ -247,7 +255,7 @@ func TestChecklistCommands(t *testing.T) {
 
 func TestTokenCommands(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
-	persister, pErr := persistence.New("localhost", "commands-test")
+	persister := persistence.NewMemoryStore()
 	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
 	userReq := userRequest{
 		Email: email,
@@ -273,7 +281,7 @@ func TestTokenCommands(t *testing.T) {
 	}
 	tokenReqString := string(tokenReqBytes[:])
 
-	tokenString, pErr := AddToken(id, tokenReqString, persister)
+	tokenString, pErr := AddToken(id, tokenReqString, testActor, persister)
 	if pErr != nil {
 		t.Fatal(pErr)
 	}
@@ -289,7 +297,7 @@ func TestTokenCommands(t *testing.T) {
 			"\n\t" + pErr.Error())
 		t.Fail()
 	}
-	pErr = DeleteToken(id, token.Id, persister)
+	pErr = DeleteToken(id, token.Id, testActor, persister)
 	if pErr != nil {
 		t.Log("error deleting token: " +
 			pErr.Error())
@@ -337,9 +345,51 @@ func TestTokenCommands(t *testing.T) {
 	}
 }
 
+func TestNextUpdate(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	user, pErr := persister.AddUser("next-update@preflight.com", "pass")
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	user.Settings.Timezone = "UTC"
+	user.Checklists["unscheduled"] = &checklist.Checklist{
+		TasksSource: "preflight",
+		TasksTarget: "todoist",
+		IsScheduled: false,
+		Schedule: &checklist.Schedule{Start: "00:00"},
+	}
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	next, pErr := NextUpdate(user.GetId(), persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if ! next.IsZero() {
+		t.Logf("test failure: unscheduled checklist gave next update %v", next)
+		t.Fail()
+	}
+
+	user.Checklists["unscheduled"].IsScheduled = true
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	next, pErr = NextUpdate(user.GetId(), persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if next.IsZero() {
+		t.Log("test failure: scheduled checklist gave no next update")
+		t.Fail()
+	}
+}
+
 func TestSettingsCommands(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
-	persister, pErr := persistence.New("localhost", "commands-test")
+	persister := persistence.NewMemoryStore()
 	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
 	userReq := userRequest{
 		Email: email,
@@ -371,10 +421,750 @@ func TestSettingsCommands(t *testing.T) {
 	}
 
 	if settings.Timezone != timezone {
-		t.Log("test failure: timezone incorrect: " +
+		t.Logf("test failure: timezone incorrect: " +
 			"\n\texpected %s, got %s", timezone, settings.Timezone)
 		t.Fail()
 	}
 }
 
+func TestValidateChecklist(t *testing.T) {
+	valid := checklist.Checklist{
+		TasksSource: "preflight",
+		TasksTarget: "todoist",
+		Tasks: []string{"foo"},
+	}
+	badSource := valid
+	badSource.TasksSource = "bogus"
+	badTarget := valid
+	badTarget.TasksTarget = "bogus"
+
+	pErr := validateChecklist(&valid)
+	if pErr != nil {
+		t.Log("error validating valid checklist: " +
+			"\n\t" + pErr.Error())
+		t.Fail()
+	}
+	pErr = validateChecklist(&badSource)
+	if pErr == nil || pErr.Status != 422 {
+		t.Logf("test failure: expected 422 for unknown source, got %v", pErr)
+		t.Fail()
+	}
+	pErr = validateChecklist(&badTarget)
+	if pErr == nil || pErr.Status != 422 {
+		t.Logf("test failure: expected 422 for unknown target, got %v", pErr)
+		t.Fail()
+	}
+
+	for _, name := range []string{"", "a.b", "$set", "cost$"} {
+		pErr = validateChecklistName(name)
+		if pErr == nil || pErr.Status != 422 {
+			t.Logf("test failure: expected 422 for name \"%s\", got %v", name, pErr)
+			t.Fail()
+		}
+	}
+	if pErr = validateChecklistName("morning-run"); pErr != nil {
+		t.Logf("error validating valid name: %s", pErr.Error())
+		t.Fail()
+	}
+}
+
 //TODO: test Update, Invoke, ValidateToken
+
+func TestMigrateTokenSecrets(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	persister := persistence.NewMemoryStore()
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	legacySecret := "fedcba9876543210"
+
+	user, pErr := persister.AddUser(email, "password")
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	user.Security.Tokens = append(user.Security.Tokens, security.Token{
+		Id: "0123456789abcdef",
+		Secret: legacySecret,
+		Permissions: security.PermissionFlags{ChecklistRead: true},
+		Expiry: time.Now().Add(time.Hour),
+	})
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	n, pErr := MigrateTokenSecrets(persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if n != 1 {
+		t.Logf("users migrated wrong: expected 1, got %d", n)
+		t.Fail()
+	}
+
+	id, pErr := GetUserIdFromToken(legacySecret, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	_, pErr = ValidateToken(id, legacySecret, security.PermissionFlags{ChecklistRead: true}, "", persister)
+	if pErr != nil {
+		t.Log("error validating migrated token: " +
+			"\n\t" + pErr.Error())
+		t.Fail()
+	}
+
+	user, pErr = persister.GetUser(id)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if user.Security.Tokens[0].Secret != "" {
+		t.Log("test failure: plaintext secret still stored after migration")
+		t.Fail()
+	}
+}
+
+func TestNodeCommands(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	dir, err := ioutil.TempDir("", "preflight-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	secretFile := filepath.Join(dir, "secret")
+
+	_, pErr := RegisterNode(secretFile, []string{"checklistFly"}, persister)
+	if pErr == nil {
+		t.Log("test failure: expected error registering unknown capability, got nil")
+		t.Fail()
+	}
+
+	_, pErr = RegisterNode(secretFile, []string{"checklistInvoke"}, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	secret, pErr := persistence.GetNodeSecret(secretFile)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	invoke := security.PermissionFlags{ChecklistInvoke: true}
+	write := security.PermissionFlags{ChecklistWrite: true}
+	if _, pErr = ValidateNode(secret, invoke, false, persister); pErr != nil {
+		t.Log("error validating node for invoke: " +
+			"\n\t" + pErr.Error())
+		t.Fail()
+	}
+	if _, pErr = ValidateNode(secret, write, false, persister); pErr == nil {
+		t.Log("test failure: expected error validating node for write, got nil")
+		t.Fail()
+	}
+	if _, pErr = ValidateNode(secret, security.PermissionFlags{}, true, persister); pErr == nil {
+		t.Log("test failure: expected error validating node for user admin, got nil")
+		t.Fail()
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	persister := persistence.NewMemoryStore()
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+
+	user, pErr := persister.AddUser(email, "password")
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	id := user.GetId()
+
+	checklistReqString := `{"name":"foo","checklist":{"tasksSource":"preflight",` +
+		`"tasksTarget":"todoist","isScheduled":false,"tasks":["before"]}}`
+	_, pErr = AddChecklist(id, checklistReqString, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	/* entries in the same millisecond are ordered by id, not by insertion */
+	time.Sleep(2*time.Millisecond)
+	pErr = UpdateChecklist(id, "foo", `{"tasksSource":"preflight","tasksTarget":"todoist",` +
+		`"isScheduled":false,"tasks":["after"]}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	pageString, pErr := GetAuditLog(id, "", 1, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	page := auditPage{}
+	err := json.Unmarshal([]byte(pageString), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Action != "updateChecklist" {
+		t.Fatalf("first page wrong: %s", pageString)
+	}
+	if page.Entries[0].Summary != "updated checklist foo, changing tasks" {
+		t.Logf("summary wrong: got \"%s\"", page.Entries[0].Summary)
+		t.Fail()
+	}
+	if page.Entries[0].Actor != testActor {
+		t.Logf("actor wrong: expected %+v, got %+v", testActor, page.Entries[0].Actor)
+		t.Fail()
+	}
+
+	pageString, pErr = GetAuditLog(id, page.Next, 10, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	page = auditPage{}
+	err = json.Unmarshal([]byte(pageString), &page)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Entries) != 1 || page.Entries[0].Action != "addChecklist" {
+		t.Logf("second page wrong: %s", pageString)
+		t.Fail()
+	}
+	if page.Next != "" {
+		t.Logf("test failure: expected no next page, got \"%s\"", page.Next)
+		t.Fail()
+	}
+
+	_, pErr = GetAuditLog(id, "yesterday", 10, persister)
+	if pErr == nil || pErr.Status != 400 {
+		t.Logf("test failure: expected 400 for bad before, got %v", pErr)
+		t.Fail()
+	}
+}
+
+func TestPasswordCommands(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	email := "password-test@preflight.com"
+	id, pErr := AddUser(`{"email": "` + email + `", "password": "old-pass"}`, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	tokenString, pErr := AddToken(id, `{"expiryHours": 24}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	kept := new(security.Token)
+	err := json.Unmarshal([]byte(tokenString), kept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, pErr = AddToken(id, `{"expiryHours": 24}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	tokenActor := persistence.Actor{Type: persistence.ACTOR_TOKEN, Id: kept.Id}
+
+	pErr = UpdatePassword(id, `{"currentPassword": "wrong", "newPassword": "new-pass"}`, tokenActor, persister)
+	if pErr == nil {
+		t.Log("test failure: changed password without current password")
+		t.Fail()
+	}
+	pErr = UpdatePassword(id, `{"currentPassword": "old-pass", "newPassword": "new-pass", "revokeOtherTokens": true}`,
+		tokenActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error updating password: "))
+	}
+	if ValidatePassword(id, "new-pass", persister) != nil {
+		t.Log("test failure: new password invalid after change")
+		t.Fail()
+	}
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if len(user.Security.Tokens) != 1 || user.Security.Tokens[0].Id != kept.Id {
+		t.Logf("tokens wrong after revoking others: expected only %s, got %+v", kept.Id, user.Security.Tokens)
+		t.Fail()
+	}
+
+	responseString, pErr := IssuePasswordReset(id, time.Hour, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error issuing password reset: "))
+	}
+	response := resetResponse{}
+	err = json.Unmarshal([]byte(responseString), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pErr = ResetPassword(`{"email": "nobody@preflight.com", "resetToken": "` + response.ResetToken +
+		`", "newPassword": "reset-pass"}`, persister)
+	if pErr == nil || pErr.Status != 401 {
+		t.Logf("test failure: expected 401 resetting password of unknown user, got %v", pErr)
+		t.Fail()
+	}
+	resetReq := `{"email": "` + email + `", "resetToken": "` + response.ResetToken +
+		`", "newPassword": "reset-pass"}`
+	pErr = ResetPassword(resetReq, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error resetting password: "))
+	}
+	if ValidatePassword(id, "reset-pass", persister) != nil {
+		t.Log("test failure: new password invalid after reset")
+		t.Fail()
+	}
+	user, pErr = persister.GetUser(id)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if len(user.Security.Tokens) != 0 {
+		t.Logf("test failure: tokens not revoked by reset: %+v", user.Security.Tokens)
+		t.Fail()
+	}
+	if ResetPassword(resetReq, persister) == nil {
+		t.Log("test failure: reset token used twice")
+		t.Fail()
+	}
+}
+
+func TestTokenLifecycle(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	id, pErr := AddUser(`{"email": "token-lifecycle@preflight.com", "password": "pass"}`, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	_, pErr = AddToken(id, `{"expiryHours": 0}`, testActor, persister)
+	if pErr == nil {
+		t.Log("test failure: added token without expiry or noExpiry")
+		t.Fail()
+	}
+	tokenString, pErr := AddToken(id, `{"noExpiry": true}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	token := new(security.Token)
+	err := json.Unmarshal([]byte(tokenString), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotatedString, pErr := RotateToken(id, token.Id, `{"graceMinutes": 0}`, time.Hour, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error rotating token: "))
+	}
+	rotated := new(security.Token)
+	err = json.Unmarshal([]byte(rotatedString), rotated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, pErr = ValidateToken(id, token.Secret, security.PermissionFlags{}, "", persister); pErr == nil {
+		t.Log("test failure: old secret valid after rotation without grace")
+		t.Fail()
+	}
+	if _, pErr = ValidateToken(id, rotated.Secret, security.PermissionFlags{}, "", persister); pErr != nil {
+		t.Logf("error validating rotated token: %s", pErr.Error())
+		t.Fail()
+	}
+
+	introspected, pErr := GetToken(id, token.Id, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error getting token: "))
+	}
+	if strings.Contains(introspected, rotated.Secret) || ! strings.Contains(introspected, `"noExpiry":true`) {
+		t.Logf("introspected token wrong: %s", introspected)
+		t.Fail()
+	}
+
+	// a token may rotate itself, or a token it covers, but not a broader one
+	broadString, pErr := AddToken(id, `{"noExpiry": true, "permissions": ` +
+		`{"checklistRead": true, "generalWrite": true}}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	scopedString, pErr := AddToken(id, `{"noExpiry": true, "permissions": ` +
+		`{"generalWrite": true}, "checklists": ["morning"]}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	broad := new(security.Token)
+	scoped := new(security.Token)
+	if err = json.Unmarshal([]byte(broadString), broad); err != nil {
+		t.Fatal(err)
+	}
+	if err = json.Unmarshal([]byte(scopedString), scoped); err != nil {
+		t.Fatal(err)
+	}
+	broadActor := persistence.Actor{Type: persistence.ACTOR_TOKEN, Id: broad.Id}
+	scopedActor := persistence.Actor{Type: persistence.ACTOR_TOKEN, Id: scoped.Id}
+	_, pErr = RotateToken(id, broad.Id, "", time.Hour, scopedActor, persister)
+	if pErr == nil || pErr.Status != 403 {
+		t.Logf("test failure: scoped token rotated broader token: %v", pErr)
+		t.Fail()
+	}
+	if _, pErr = ValidateToken(id, broad.Secret, security.PermissionFlags{}, "", persister); pErr != nil {
+		t.Logf("broader token invalid after refused rotation: %s", pErr.Error())
+		t.Fail()
+	}
+	_, pErr = RotateToken(id, scoped.Id, "", time.Hour, scopedActor, persister)
+	if pErr != nil {
+		t.Logf("error rotating token as itself: %s", pErr.Error())
+		t.Fail()
+	}
+	_, pErr = RotateToken(id, scoped.Id, "", time.Hour, broadActor, persister)
+	if pErr != nil {
+		t.Logf("error rotating token as a broader token: %s", pErr.Error())
+		t.Fail()
+	}
+	for _, tokenId := range []string{broad.Id, scoped.Id} {
+		pErr = DeleteToken(id, tokenId, testActor, persister)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+	}
+
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	user.Security.Tokens = append(user.Security.Tokens, security.Token{
+		Id: "expired",
+		Expiry: time.Now().Add(-time.Minute),
+	})
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	_, pErr = RotateToken(id, "expired", `{"expiryHours": 24}`, time.Hour, testActor, persister)
+	if pErr == nil {
+		t.Log("test failure: rotated expired token")
+		t.Fail()
+	}
+	pErr = SweepTokens(id, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error sweeping tokens: "))
+	}
+	user, pErr = persister.GetUser(id)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if len(user.Security.Tokens) != 1 || user.Security.Tokens[0].Id != token.Id {
+		t.Logf("tokens wrong after sweep: expected only %s, got %+v", token.Id, user.Security.Tokens)
+		t.Fail()
+	}
+
+	// adding a token sweeps expired ones too, where no scheduler runs
+	user.Security.Tokens = append(user.Security.Tokens, security.Token{
+		Id: "expired",
+		Expiry: time.Now().Add(-time.Minute),
+	})
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	_, pErr = AddToken(id, `{"expiryHours": 1}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	tokens, pErr := ListTokens(id, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	for _, listed := range tokens {
+		if listed.Id == "expired" {
+			t.Log("test failure: expired token kept after adding a token")
+			t.Fail()
+		}
+	}
+}
+
+func TestUsageTracker(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	id, pErr := AddUser(`{"email": "usage@preflight.com", "password": "pass"}`, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	tokenString, pErr := AddToken(id, `{"expiryHours": 24}`, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	token := new(security.Token)
+	err := json.Unmarshal([]byte(tokenString), token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	getToken := func() security.Token {
+		tokens, pErr := ListTokens(id, persister)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+		if len(tokens) != 1 {
+			t.Fatalf("expected 1 token, got %d", len(tokens))
+		}
+		return tokens[0]
+	}
+
+	tracker := NewUsageTracker(time.Hour)
+	for _, address := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		tracker.Record(id, token.Id, address)
+	}
+	if written := getToken(); written.UseCount != 0 || ! written.LastUsed.IsZero() {
+		t.Logf("test failure: expected no uses written before flush, got %+v", written)
+		t.Fail()
+	}
+
+	pErr = tracker.Flush(persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error flushing token uses: "))
+	}
+	flushed := getToken()
+	if flushed.UseCount != 3 || flushed.LastAddress != "10.0.0.3" {
+		t.Logf("test failure: expected 3 uses, the last from 10.0.0.3, got %+v", flushed)
+		t.Fail()
+	}
+	if len(tracker.uses) != 0 {
+		t.Logf("test failure: uses kept after they were written: %d", len(tracker.uses))
+		t.Fail()
+	}
+
+	// recording uses does not conflict with an update of the user read before
+	user, pErr := persister.GetUser(id)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	tracker.Record(id, token.Id, "10.0.0.4")
+	pErr = tracker.Flush(persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error flushing token uses: "))
+	}
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		t.Logf("error updating user after token use: %s", pErr.Error())
+		t.Fail()
+	}
+
+	// Stop writes the uses left
+	tracker.Record(id, token.Id, "10.0.0.5")
+	go tracker.Run(persister, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	tracker.Stop()
+	if stopped := getToken(); stopped.LastAddress != "10.0.0.5" {
+		t.Logf("test failure: expected the use from 10.0.0.5 written on stop, got %+v", stopped)
+		t.Fail()
+	}
+	if strings.Contains(tokenString, "lastUsed") {
+		t.Logf("test failure: unused token has lastUsed: %s", tokenString)
+		t.Fail()
+	}
+}
+
+func TestOAuthFlow(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	email := "oauth-test@preflight.com"
+	id, pErr := AddUser(`{"email": "` + email + `", "password": "pass"}`, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	uri := "https://example.com/callback"
+	if _, pErr = RegisterOAuthClient("bad", []string{"/relative"}, persister); pErr == nil {
+		t.Log("test failure: registered client with relative redirect uri")
+		t.Fail()
+	}
+	clientId, pErr := RegisterOAuthClient("Test Client", []string{uri}, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error registering client: "))
+	}
+
+	verifier := "a-verifier-of-at-least-forty-three-characters-long"
+	request := AuthorizeRequest{
+		ClientId: clientId,
+		Scope: "checklist:read general:read",
+		CodeChallenge: security.PKCEChallenge(verifier),
+		CodeChallengeMethod: "S256",
+	}
+	if _, pErr = Authorize(request, email, "wrong", persister); pErr == nil || pErr.Status != 401 {
+		t.Logf("test failure: expected 401 authorizing with wrong password, got %v", pErr)
+		t.Fail()
+	}
+	plain := request
+	plain.CodeChallengeMethod = "plain"
+	if _, pErr = Authorize(plain, email, "pass", persister); pErr == nil {
+		t.Log("test failure: authorized without S256 challenge")
+		t.Fail()
+	}
+	for _, challenge := range []string{"short", strings.Repeat("a", 129),
+			strings.Repeat("a", 42) + "/", strings.Repeat("a", 42) + "="} {
+		bad := request
+		bad.CodeChallenge = challenge
+		if _, pErr = Authorize(bad, email, "pass", persister); pErr == nil {
+			t.Logf("test failure: authorized with code challenge \"%s\"", challenge)
+			t.Fail()
+		}
+	}
+	code, pErr := Authorize(request, email, "pass", persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error authorizing: "))
+	}
+
+	_, pErr = ExchangeOAuthCode(clientId, code, "", "wrong-verifier", 1, time.Hour, persister)
+	if pErr == nil {
+		t.Log("test failure: exchanged code with wrong verifier")
+		t.Fail()
+	}
+	code, pErr = Authorize(request, email, "pass", persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error authorizing: "))
+	}
+	responseString, pErr := ExchangeOAuthCode(clientId, code, uri, verifier, 1, time.Hour, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error exchanging code: "))
+	}
+	response := oauthTokenResponse{}
+	err := json.Unmarshal([]byte(responseString), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.TokenType != "Bearer" || response.Scope != "checklist:read general:read" ||
+			response.ExpiresIn <= 0 || response.ExpiresIn > 3600 {
+		t.Logf("token response wrong: got %s", responseString)
+		t.Fail()
+	}
+	_, pErr = ValidateToken(id, response.AccessToken, security.PermissionFlags{GeneralRead: true}, "", persister)
+	if pErr != nil {
+		t.Logf("error validating access token: %s", pErr.Error())
+		t.Fail()
+	}
+	_, pErr = ValidateToken(id, response.AccessToken, security.PermissionFlags{GeneralWrite: true}, "", persister)
+	if pErr == nil {
+		t.Log("test failure: access token has permission outside its scope")
+		t.Fail()
+	}
+
+	refreshedString, pErr := RefreshOAuthToken(clientId, response.RefreshToken, 1, time.Hour, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error refreshing token: "))
+	}
+	refreshed := oauthTokenResponse{}
+	err = json.Unmarshal([]byte(refreshedString), &refreshed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, pErr = ValidateToken(id, response.AccessToken, security.PermissionFlags{}, "", persister); pErr == nil {
+		t.Log("test failure: old access token valid after refresh")
+		t.Fail()
+	}
+	if _, pErr = RefreshOAuthToken(clientId, response.RefreshToken, 1, time.Hour, persister); pErr == nil {
+		t.Log("test failure: refresh token used twice")
+		t.Fail()
+	}
+
+	tokens, pErr := ListTokens(id, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if len(tokens) != 1 || tokens[0].ClientId != clientId {
+		t.Fatalf("tokens wrong after refresh: %+v", tokens)
+	}
+	pErr = DeleteToken(id, tokens[0].Id, testActor, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	if _, pErr = RefreshOAuthToken(clientId, refreshed.RefreshToken, 1, time.Hour, persister); pErr == nil {
+		t.Log("test failure: refreshed deleted access token")
+		t.Fail()
+	}
+}
+
+/*
+ * a store whose UpdateUser first writes the user itself, the given number of
+ * times, so that the update conflicts, or fails with fail if it is set
+ */
+type conflictStore struct {
+	persistence.Store
+	conflicts int
+	fail *errors.PreflightError
+}
+
+func (c *conflictStore) UpdateUser(user *persistence.User) *errors.PreflightError {
+	if c.fail != nil {
+		return c.fail
+	}
+	if c.conflicts > 0 {
+		c.conflicts--
+		other, err := c.Store.GetUser(user.GetId())
+		if err != nil {
+			return err
+		}
+		err = c.Store.UpdateUser(other)
+		if err != nil {
+			return err
+		}
+	}
+	return c.Store.UpdateUser(user)
+}
+
+func TestOAuthMisuseSaved(t *testing.T) {
+	persister := persistence.NewMemoryStore()
+	email := "oauth-misuse@preflight.com"
+	_, pErr := AddUser(`{"email": "` + email + `", "password": "pass"}`, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	uri := "https://example.com/callback"
+	clientId, pErr := RegisterOAuthClient("Test Client", []string{uri}, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	otherId, pErr := RegisterOAuthClient("Other Client", []string{uri}, persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	verifier := "a-verifier-of-at-least-forty-three-characters-long"
+	request := AuthorizeRequest{
+		ClientId: clientId,
+		Scope: "general:read",
+		CodeChallenge: security.PKCEChallenge(verifier),
+		CodeChallengeMethod: "S256",
+	}
+
+	// a code presented wrongly is used up, even if the user is written
+	// meanwhile
+	code, pErr := Authorize(request, email, "pass", persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	conflicting := &conflictStore{Store: persister, conflicts: 1}
+	_, pErr = ExchangeOAuthCode(clientId, code, uri, "wrong-verifier", 1, time.Hour, conflicting)
+	if pErr == nil || pErr.Code != errors.CODE_INVALID_GRANT {
+		t.Logf("test failure: expected invalid grant with wrong verifier, got %v", pErr)
+		t.Fail()
+	}
+	if _, pErr = ExchangeOAuthCode(clientId, code, uri, verifier, 1, time.Hour, persister); pErr == nil {
+		t.Log("test failure: code usable after being presented wrongly")
+		t.Fail()
+	}
+
+	// if the removal can't be saved, the request fails as a server error
+	code, pErr = Authorize(request, email, "pass", persister)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	failing := &conflictStore{Store: persister, fail: &errors.PreflightError{Status: 503}}
+	_, pErr = ExchangeOAuthCode(clientId, code, uri, "wrong-verifier", 1, time.Hour, failing)
+	if pErr == nil || pErr.Status != 500 {
+		t.Logf("test failure: expected 500 when removal of code not saved, got %v", pErr)
+		t.Fail()
+	}
+
+	responseString, pErr := ExchangeOAuthCode(clientId, code, uri, verifier, 1, time.Hour, persister)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error exchanging code: "))
+	}
+	response := oauthTokenResponse{}
+	err := json.Unmarshal([]byte(responseString), &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// as is a refresh token presented by another client
+	conflicting.conflicts = 1
+	_, pErr = RefreshOAuthToken(otherId, response.RefreshToken, 1, time.Hour, conflicting)
+	if pErr == nil || pErr.Code != errors.CODE_INVALID_GRANT {
+		t.Logf("test failure: expected invalid grant refreshing as other client, got %v", pErr)
+		t.Fail()
+	}
+	if _, pErr = RefreshOAuthToken(clientId, response.RefreshToken, 1, time.Hour, persister); pErr == nil {
+		t.Log("test failure: refresh token usable after being presented by other client")
+		t.Fail()
+	}
+}
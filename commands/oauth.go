@@ -0,0 +1,383 @@
+package commands
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/persistence"
+	"github.com/jsutton9/preflight/security"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	OAUTH_CODE_VALIDITY = 10 * time.Minute
+	OAUTH_SAVE_ATTEMPTS = 3
+)
+
+/*
+ * the parameters of an OAuth2 authorization request, as sent to the consent
+ * page and back
+ */
+type AuthorizeRequest struct {
+	ClientId string
+	RedirectUri string
+	Scope string
+	State string
+	CodeChallenge string
+	CodeChallengeMethod string
+}
+
+type oauthTokenResponse struct {
+	AccessToken string  `json:"access_token"`
+	TokenType string    `json:"token_type"`
+	ExpiresIn int       `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope string        `json:"scope"`
+}
+
+/*
+ * registers a client which may ask users for tokens, returning its id
+ */
+func RegisterOAuthClient(name string, redirectUris []string, persister persistence.Store) (string, *errors.PreflightError) {
+	if len(redirectUris) == 0 {
+		return "", &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_PARAMETER,
+			InternalMessage: "commands.RegisterOAuthClient: no redirect uri",
+			ExternalMessage: "A client needs at least one redirect URI.",
+		}
+	}
+	for _, uri := range redirectUris {
+		parsed, err := url.Parse(uri)
+		if err != nil || ! parsed.IsAbs() || parsed.Fragment != "" {
+			return "", &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_INVALID_PARAMETER,
+				Cause: err,
+				InternalMessage: "commands.RegisterOAuthClient: bad redirect uri \"" + uri + "\"",
+				ExternalMessage: "Redirect URI \"" + uri + "\" must be absolute, without a fragment.",
+			}
+		}
+	}
+
+	client, pErr := persister.AddOAuthClient(name, redirectUris)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.RegisterOAuthClient: error adding client: ")
+	}
+
+	return client.Id, nil
+}
+
+/*
+ * returns the client making an authorization request and the redirect URI to
+ * use, which is the one requested if it is registered, or the client's only
+ * one if none is requested; until these are checked, errors can't be sent
+ * to the client by redirect
+ */
+func GetOAuthRedirect(clientId, redirectUri string, persister persistence.Store) (*persistence.OAuthClient, string, *errors.PreflightError) {
+	client, err := persister.GetOAuthClient(clientId)
+	if err != nil {
+		return nil, "", err.Prepend("commands.GetOAuthRedirect: error getting client: ")
+	}
+
+	if redirectUri == "" && len(client.RedirectUris) == 1 {
+		return client, client.RedirectUris[0], nil
+	}
+	for _, registered := range client.RedirectUris {
+		if registered == redirectUri {
+			return client, redirectUri, nil
+		}
+	}
+	return nil, "", &errors.PreflightError{
+		Status: 400,
+		Code: errors.CODE_INVALID_REQUEST,
+		InternalMessage: "commands.GetOAuthRedirect: redirect uri \"" + redirectUri +
+			"\" not registered for client " + clientId,
+		ExternalMessage: "The redirect URI is not registered for this client.",
+	}
+}
+
+/*
+ * checks the rest of an authorization request, whose client and redirect URI
+ * have been checked by GetOAuthRedirect, and returns the permissions it asks
+ * for
+ */
+func CheckAuthorizeRequest(request AuthorizeRequest) (security.PermissionFlags, *errors.PreflightError) {
+	if request.CodeChallenge == "" || request.CodeChallengeMethod != "S256" {
+		return security.PermissionFlags{}, &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_REQUEST,
+			InternalMessage: "commands.CheckAuthorizeRequest: no S256 code challenge",
+			ExternalMessage: "PKCE with code challenge method S256 is required.",
+		}
+	}
+	if ! validCodeChallenge(request.CodeChallenge) {
+		return security.PermissionFlags{}, &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_REQUEST,
+			InternalMessage: "commands.CheckAuthorizeRequest: bad code challenge \"" +
+				request.CodeChallenge + "\"",
+			ExternalMessage: "The code challenge must be 43 to 128 unreserved characters.",
+		}
+	}
+	permissions, err := security.ParseScopes(request.Scope)
+	if err != nil {
+		return security.PermissionFlags{}, err.Prepend("commands.CheckAuthorizeRequest: ")
+	}
+
+	return permissions, nil
+}
+
+/*
+ * returns whether the challenge is 43 to 128 characters from the unreserved
+ * set, as in RFC 7636
+ */
+func validCodeChallenge(challenge string) bool {
+	if len(challenge) < 43 || len(challenge) > 128 {
+		return false
+	}
+	for _, c := range challenge {
+		if ! (c >= 'A' && c <= 'Z' || c >= 'a' && c <= 'z' || c >= '0' && c <= '9' ||
+				strings.ContainsRune("-._~", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+/*
+ * issues an authorization code to the client once the user has given their
+ * password and consented
+ */
+func Authorize(request AuthorizeRequest, email, password string, persister persistence.Store) (string, *errors.PreflightError) {
+	client, redirectUri, err := GetOAuthRedirect(request.ClientId, request.RedirectUri, persister)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: ")
+	}
+	permissions, err := CheckAuthorizeRequest(request)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: ")
+	}
+
+	user, err := persister.GetUserByEmail(email)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: error getting user: ")
+	}
+	id := user.GetId()
+	err = user.Security.ValidatePassword(password)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: error validating password: ")
+	}
+
+	swept, _ := user.Security.SweepTokens(time.Now())
+	code, err := user.Security.IssueOAuthCode(client.Id, redirectUri, request.CodeChallenge,
+		permissions, OAUTH_CODE_VALIDITY)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: error issuing code: ")
+	}
+	err = persister.UpdateUser(user)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: error updating user in db: ")
+	}
+	actor := persistence.Actor{Type: persistence.ACTOR_PASSWORD}
+	err = auditSweep(id, swept, actor, persister)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: ")
+	}
+
+	summary := fmt.Sprintf("authorized client %s (%s) for scopes %s", client.Name, client.Id,
+		permissions.Scope())
+	err = audit(id, actor, "authorizeClient", summary, persister)
+	if err != nil {
+		return "", err.Prepend("commands.Authorize: ")
+	}
+
+	return id + "." + code, nil
+}
+
+/*
+ * exchanges an authorization code, with the PKCE verifier, for an access
+ * token valid for accessHours and a refresh token valid for refreshFor,
+ * returned as an OAuth2 token response; redirectUri may be omitted as it may
+ * be in the authorization request
+ */
+func ExchangeOAuthCode(clientId, code, redirectUri, verifier string, accessHours int, refreshFor time.Duration, persister persistence.Store) (string, *errors.PreflightError) {
+	client, redirectUri, err := GetOAuthRedirect(clientId, redirectUri, persister)
+	if err != nil {
+		return "", err.Prepend("commands.ExchangeOAuthCode: ")
+	}
+	user, err := getOAuthUser(code, persister)
+	if err != nil {
+		return "", err.Prepend("commands.ExchangeOAuthCode: ")
+	}
+	_, code = splitOAuthSecret(code)
+
+	granted, err := user.Security.UseOAuthCode(code, clientId, redirectUri, verifier)
+	if err != nil {
+		// save the removal of the code, which can't be tried again
+		saveErr := saveOAuthRemoval(user, func(sec *security.SecurityInfo) {
+			sec.UseOAuthCode(code, clientId, redirectUri, verifier)
+		}, persister)
+		if saveErr != nil {
+			return "", saveErr.Prepend("commands.ExchangeOAuthCode: error saving removal of code: ")
+		}
+		return "", err.Prepend("commands.ExchangeOAuthCode: error using code: ")
+	}
+
+	response, err := issueOAuthTokens(user, client, granted.Permissions, accessHours, refreshFor, persister)
+	if err != nil {
+		return "", err.Prepend("commands.ExchangeOAuthCode: ")
+	}
+	return response, nil
+}
+
+/*
+ * replaces the access token for a refresh token, and the refresh token
+ * itself, returning them as an OAuth2 token response
+ */
+func RefreshOAuthToken(clientId, refreshToken string, accessHours int, refreshFor time.Duration, persister persistence.Store) (string, *errors.PreflightError) {
+	client, err := persister.GetOAuthClient(clientId)
+	if err != nil {
+		return "", err.Prepend("commands.RefreshOAuthToken: error getting client: ")
+	}
+	user, err := getOAuthUser(refreshToken, persister)
+	if err != nil {
+		return "", err.Prepend("commands.RefreshOAuthToken: ")
+	}
+	_, refreshToken = splitOAuthSecret(refreshToken)
+
+	refresh, err := user.Security.UseRefreshToken(refreshToken, clientId)
+	if err != nil {
+		// save the removal of a token used by the wrong client or expired
+		saveErr := saveOAuthRemoval(user, func(sec *security.SecurityInfo) {
+			sec.UseRefreshToken(refreshToken, clientId)
+		}, persister)
+		if saveErr != nil {
+			return "", saveErr.Prepend("commands.RefreshOAuthToken: error saving removal of refresh token: ")
+		}
+		return "", err.Prepend("commands.RefreshOAuthToken: error using refresh token: ")
+	}
+	// the old access token may already be gone, deleted or expired
+	user.Security.DeleteToken(refresh.AccessTokenId)
+
+	response, err := issueOAuthTokens(user, client, refresh.Permissions, accessHours, refreshFor, persister)
+	if err != nil {
+		return "", err.Prepend("commands.RefreshOAuthToken: ")
+	}
+	return response, nil
+}
+
+func issueOAuthTokens(user *persistence.User, client *persistence.OAuthClient, permissions security.PermissionFlags, accessHours int, refreshFor time.Duration, persister persistence.Store) (string, *errors.PreflightError) {
+	id := user.GetId()
+	swept, _ := user.Security.SweepTokens(time.Now())
+	token, pErr := user.Security.AddClientToken(client.Id, permissions, accessHours,
+		"OAuth client " + client.Name)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.issueOAuthTokens: error adding access token: ")
+	}
+	refreshToken, pErr := user.Security.IssueRefreshToken(client.Id, permissions, token.Id, refreshFor)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.issueOAuthTokens: error issuing refresh token: ")
+	}
+
+	responseBytes, err := json.Marshal(oauthTokenResponse{
+		AccessToken: token.Secret,
+		TokenType: "Bearer",
+		ExpiresIn: int(time.Until(token.Expiry).Seconds()),
+		RefreshToken: id + "." + refreshToken,
+		Scope: permissions.Scope(),
+	})
+	if err != nil {
+		return "", &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "commands.issueOAuthTokens: error marshalling response: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error issuing the token.",
+		}
+	}
+
+	pErr = persister.UpdateUser(user)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.issueOAuthTokens: error updating user in db: ")
+	}
+	actor := persistence.Actor{Type: persistence.ACTOR_OAUTH_CLIENT, Id: client.Id}
+	pErr = auditSweep(id, swept, actor, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.issueOAuthTokens: ")
+	}
+
+	summary := fmt.Sprintf("issued token %s to client %s (%s) for scopes %s, %s",
+		token.Id, client.Name, client.Id, permissions.Scope(), describeExpiry(token))
+	pErr = audit(id, actor, "issueOAuthToken", summary, persister)
+	if pErr != nil {
+		return "", pErr.Prepend("commands.issueOAuthTokens: ")
+	}
+
+	return string(responseBytes), nil
+}
+
+/*
+ * saves a user from which a code or refresh token presented wrongly has been
+ * removed; if the user has been written since it was read, remove is made
+ * again on a fresh copy, so that the code or token is never left to be tried
+ * again
+ */
+func saveOAuthRemoval(user *persistence.User, remove func(*security.SecurityInfo), persister persistence.Store) *errors.PreflightError {
+	id := user.GetId()
+	for attempt := 1; ; attempt++ {
+		err := persister.UpdateUser(user)
+		if err == nil {
+			return nil
+		} else if ! errors.Is(err, errors.ErrConflict) || attempt == OAUTH_SAVE_ATTEMPTS {
+			return &errors.PreflightError{
+				Status: 500,
+				Cause: err,
+				InternalMessage: "commands.saveOAuthRemoval: error updating user in db: " +
+					"\n\t" + err.Error(),
+				ExternalMessage: "There was an error issuing the token.",
+			}
+		}
+
+		user, err = persister.GetUser(id)
+		if err != nil {
+			return err.Prepend("commands.saveOAuthRemoval: error getting user: ")
+		}
+		remove(user.Security)
+	}
+}
+
+/*
+ * codes and refresh tokens are presented as the user id, a dot, and the
+ * code or token proper, so that the user can be found without an index
+ */
+func splitOAuthSecret(presented string) (string, string) {
+	dot := strings.Index(presented, ".")
+	if dot < 0 {
+		return "", presented
+	}
+	return presented[:dot], presented[dot+1:]
+}
+
+func getOAuthUser(presented string, persister persistence.Store) (*persistence.User, *errors.PreflightError) {
+	userId, _ := splitOAuthSecret(presented)
+	invalid := &errors.PreflightError{
+		Status: 400,
+		Code: errors.CODE_INVALID_GRANT,
+		InternalMessage: "commands.getOAuthUser: no user \"" + userId + "\"",
+		ExternalMessage: "The grant is invalid.",
+	}
+	if userId == "" {
+		return nil, invalid
+	}
+	user, err := persister.GetUser(userId)
+	if errors.Is(err, errors.ErrNotFound) {
+		invalid.Cause = err
+		return nil, invalid
+	} else if err != nil {
+		return nil, err.Prepend("commands.getOAuthUser: error getting user: ")
+	}
+	return user, nil
+}
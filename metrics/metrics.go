@@ -0,0 +1,112 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const NAMESPACE = "preflight"
+
+const (
+	SERVICE_TODOIST = "todoist"
+	SERVICE_TRELLO = "trello"
+)
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name: "http_requests_total",
+		Help: "API requests handled, by route, method and status.",
+	}, []string{"route", "method", "status"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name: "http_request_duration_seconds",
+		Help: "Time taken to handle API requests, by route, method and status.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	clientCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name: "client_calls_total",
+		Help: "Calls made to Todoist and Trello, by service.",
+	}, []string{"service"})
+	clientErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name: "client_errors_total",
+		Help: "Calls to Todoist and Trello which failed or returned an error status, by service.",
+	}, []string{"service"})
+	schedulerLag = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: NAMESPACE,
+		Name: "scheduler_lag_seconds",
+		Help: "Time between when a user's update came due and when it started.",
+		Buckets: []float64{0.1, 0.5, 1, 5, 15, 30, 60, 120, 300, 600},
+	})
+	checklistsPosted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name: "checklists_posted_total",
+		Help: "Checklists whose tasks were posted, by schedule or invocation.",
+	})
+	checklistsRemoved = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: NAMESPACE,
+		Name: "checklists_removed_total",
+		Help: "Checklists whose unfinished tasks were removed at the end of their schedule.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(requests, requestDuration, clientCalls, clientErrors,
+		schedulerLag, checklistsPosted, checklistsRemoved)
+}
+
+/*
+ * serves the metrics in the Prometheus text format
+ */
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+/*
+ * method is labelled as one of GET, POST, PUT, DELETE or other, since it comes
+ * from the client and each label value is a new series
+ */
+func ObserveRequest(route, method string, status int, duration time.Duration) {
+	method = methodLabel(method)
+	statusString := strconv.Itoa(status)
+	requests.WithLabelValues(route, method, statusString).Inc()
+	requestDuration.WithLabelValues(route, method, statusString).Observe(duration.Seconds())
+}
+
+func methodLabel(method string) string {
+	method = strings.ToUpper(method)
+	switch method {
+	case "GET", "POST", "PUT", "DELETE":
+		return method
+	}
+	return "other"
+}
+
+/*
+ * counts a call to service, and an error if the call failed or the service
+ * returned an error status, signalled by a status of 0 or at least 400
+ */
+func ObserveClientCall(service string, status int) {
+	clientCalls.WithLabelValues(service).Inc()
+	if status == 0 || status >= 400 {
+		clientErrors.WithLabelValues(service).Inc()
+	}
+}
+
+func ObserveSchedulerLag(lag time.Duration) {
+	schedulerLag.Observe(lag.Seconds())
+}
+
+func ChecklistPosted() {
+	checklistsPosted.Inc()
+}
+
+func ChecklistRemoved() {
+	checklistsRemoved.Inc()
+}
@@ -0,0 +1,43 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+)
+
+func TestObserveClientCall(t *testing.T) {
+	calls := testutil.ToFloat64(clientCalls.WithLabelValues(SERVICE_TRELLO))
+	errs := testutil.ToFloat64(clientErrors.WithLabelValues(SERVICE_TRELLO))
+
+	ObserveClientCall(SERVICE_TRELLO, 200)
+	ObserveClientCall(SERVICE_TRELLO, 0)
+	ObserveClientCall(SERVICE_TRELLO, 503)
+
+	if n := testutil.ToFloat64(clientCalls.WithLabelValues(SERVICE_TRELLO)) - calls; n != 3 {
+		t.Logf("calls counted wrong: expected 3, got %v", n)
+		t.Fail()
+	}
+	if n := testutil.ToFloat64(clientErrors.WithLabelValues(SERVICE_TRELLO)) - errs; n != 2 {
+		t.Logf("errors counted wrong: expected 2, got %v", n)
+		t.Fail()
+	}
+}
+
+func TestObserveRequest(t *testing.T) {
+	ObserveRequest("test", "get", 200, 0)
+	ObserveRequest("test", "BREW", 200, 0)
+	ObserveRequest("test", "PROPFIND", 200, 0)
+
+	if n := testutil.ToFloat64(requests.WithLabelValues("test", "GET", "200")); n != 1 {
+		t.Logf("GET requests counted wrong: expected 1, got %v", n)
+		t.Fail()
+	}
+	if n := testutil.ToFloat64(requests.WithLabelValues("test", "other", "200")); n != 2 {
+		t.Logf("other requests counted wrong: expected 2, got %v", n)
+		t.Fail()
+	}
+	if n := testutil.CollectAndCount(requests); n != 2 {
+		t.Logf("series wrong: expected 2, got %d", n)
+		t.Fail()
+	}
+}
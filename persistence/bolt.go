@@ -0,0 +1,133 @@
+package persistence
+
+import (
+	"bytes"
+	"github.com/jsutton9/preflight/api/errors"
+	bolt "go.etcd.io/bbolt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type boltKV struct {
+	db *bolt.DB
+}
+
+type boltTx struct {
+	*bolt.Tx
+}
+
+type boltBucket struct {
+	*bolt.Bucket
+}
+
+/*
+ * returns a Store backed by a BoltDB file, for deployments without MongoDB
+ */
+func NewBoltStore(path string) (Store, *errors.PreflightError) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModeDir | 0774)
+	if err != nil {
+		return nil, &errors.PreflightError{
+			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.NewBoltStore: " +
+				"error making directory: \n\t" + err.Error(),
+			ExternalMessage: "There was an error connecting to the database.",
+		}
+	}
+
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5*time.Second})
+	if err == bolt.ErrTimeout {
+		return nil, &errors.PreflightError{
+			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.NewBoltStore: \"" + path + "\" is in use by another process; " +
+				"a bolt database can be open in only one process at a time, and preflight-api " +
+				"runs the scheduler itself when databaseType is bolt",
+			ExternalMessage: "There was an error connecting to the database.",
+		}
+	} else if err != nil {
+		return nil, &errors.PreflightError{
+			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.NewBoltStore: " +
+				"error opening \"" + path + "\": \n\t" + err.Error(),
+			ExternalMessage: "There was an error connecting to the database.",
+		}
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range kvBuckets {
+			_, err := tx.CreateBucketIfNotExists([]byte(name))
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, &errors.PreflightError{
+			Status: 500,
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.NewBoltStore: " +
+				"error creating buckets: \n\t" + err.Error(),
+			ExternalMessage: "There was an error connecting to the database.",
+		}
+	}
+
+	return &kvStore{db: &boltKV{db}, name: "bolt", owner: true}, nil
+}
+
+func (b *boltKV) View(fn func(tx kvTx) error) error {
+	return b.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltKV) Update(fn func(tx kvTx) error) error {
+	return b.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (b *boltKV) Close() error {
+	return b.db.Close()
+}
+
+func (t boltTx) Bucket(name string) bucket {
+	return boltBucket{t.Tx.Bucket([]byte(name))}
+}
+
+func (b boltBucket) Get(key string) []byte {
+	return b.Bucket.Get([]byte(key))
+}
+
+func (b boltBucket) Put(key string, value []byte) error {
+	return b.Bucket.Put([]byte(key), value)
+}
+
+func (b boltBucket) Delete(key string) error {
+	return b.Bucket.Delete([]byte(key))
+}
+
+func (b boltBucket) ForEach(fn func(key string, value []byte) error) error {
+	return b.Bucket.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+func (b boltBucket) ForEachPrefix(prefix string, fn func(key string, value []byte) error) error {
+	c := b.Bucket.Cursor()
+	for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+		err := fn(string(k), v)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
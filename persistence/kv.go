@@ -0,0 +1,527 @@
+package persistence
+
+import (
+	"fmt"
+	"time"
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/checklist"
+	"github.com/jsutton9/preflight/security"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const (
+	usersBucket = "users"
+	nodesBucket = "nodes"
+	auditBucket = "audit"
+	oauthClientsBucket = "oauthClients"
+)
+
+var kvBuckets = []string{usersBucket, nodesBucket, auditBucket, oauthClientsBucket}
+
+/*
+ * A kv is an embedded key-value database, holding users by id, nodes by
+ * secret, audit entries by user and time and OAuth2 clients by id as bson
+ * documents.
+ */
+type kv interface {
+	View(fn func(tx kvTx) error) error
+	Update(fn func(tx kvTx) error) error
+	Close() error
+}
+
+type kvTx interface {
+	Bucket(name string) bucket
+}
+
+type bucket interface {
+	Get(key string) []byte
+	Put(key string, value []byte) error
+	Delete(key string) error
+	ForEach(fn func(key string, value []byte) error) error
+	ForEachPrefix(prefix string, fn func(key string, value []byte) error) error
+}
+
+/*
+ * kvStore implements Store on top of a kv, scanning all users for lookups
+ * by email or token; it is intended for small deployments and tests.
+ */
+type kvStore struct {
+	db kv
+	name string
+	owner bool
+}
+
+func (p *kvStore) Copy() Store {
+	return &kvStore{db: p.db, name: p.name, owner: false}
+}
+
+func (p *kvStore) Close() {
+	if p.owner {
+		p.db.Close()
+	}
+}
+
+func (p *kvStore) dbError(function string, err error) *errors.PreflightError {
+	var pErr *errors.PreflightError
+	if errors.As(err, &pErr) {
+		return pErr.Prepend(function + ": ")
+	}
+	return &errors.PreflightError{
+		Status: 500,
+		Kind: errors.ErrUpstream,
+		Cause: err,
+		InternalMessage: function + ": " + p.name + " error: \n\t" + err.Error(),
+		ExternalMessage: "There was an error querying the database.",
+	}
+}
+
+func (p *kvStore) Ping() *errors.PreflightError {
+	err := p.db.View(func(tx kvTx) error {
+		return nil
+	})
+	if err != nil {
+		return &errors.PreflightError{
+			Status: 503,
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.kvStore.Ping: " + p.name + " error: \n\t" + err.Error(),
+			ExternalMessage: "The database is unavailable.",
+		}
+	}
+
+	return nil
+}
+
+func (p *kvStore) RegisterNode(secretFile string, capabilities NodeCapabilities) (*Node, *errors.PreflightError) {
+	node, pErr := newNode(secretFile, capabilities)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.kvStore.RegisterNode: error creating node: ")
+	}
+	nodeBytes, err := bson.Marshal(node)
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.RegisterNode", err)
+	}
+
+	err = p.db.Update(func(tx kvTx) error {
+		return tx.Bucket(nodesBucket).Put(node.Secret, nodeBytes)
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.RegisterNode", err)
+	}
+
+	return node, nil
+}
+
+func (p *kvStore) GetNode(secret string) (*Node, *errors.PreflightError) {
+	var node *Node
+	err := p.db.View(func(tx kvTx) error {
+		nodeBytes := tx.Bucket(nodesBucket).Get(secret)
+		if nodeBytes == nil {
+			return nil
+		}
+		node = new(Node)
+		return bson.Unmarshal(nodeBytes, node)
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.GetNode", err)
+	} else if node == nil {
+		return nil, nodeNotFound("persistence.kvStore.GetNode")
+	}
+
+	node.upgrade()
+	return node, nil
+}
+
+func (p *kvStore) AddOAuthClient(name string, redirectUris []string) (*OAuthClient, *errors.PreflightError) {
+	client, pErr := newOAuthClient(name, redirectUris)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.kvStore.AddOAuthClient: ")
+	}
+	clientBytes, err := bson.Marshal(client)
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.AddOAuthClient", err)
+	}
+
+	err = p.db.Update(func(tx kvTx) error {
+		return tx.Bucket(oauthClientsBucket).Put(client.Id, clientBytes)
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.AddOAuthClient", err)
+	}
+
+	return client, nil
+}
+
+func (p *kvStore) GetOAuthClient(id string) (*OAuthClient, *errors.PreflightError) {
+	var client *OAuthClient
+	err := p.db.View(func(tx kvTx) error {
+		clientBytes := tx.Bucket(oauthClientsBucket).Get(id)
+		if clientBytes == nil {
+			return nil
+		}
+		client = new(OAuthClient)
+		return bson.Unmarshal(clientBytes, client)
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.GetOAuthClient", err)
+	} else if client == nil {
+		return nil, oauthClientNotFound("persistence.kvStore.GetOAuthClient", id)
+	}
+
+	return client, nil
+}
+
+func (p *kvStore) AddUser(email, password string) (*User, *errors.PreflightError) {
+	user, pErr := newUser(email, password)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.kvStore.AddUser: error creating user: ")
+	}
+	userBytes, err := bson.Marshal(user)
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.AddUser", err)
+	}
+
+	err = p.db.Update(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		existing, err := findUser(users, func(u *User) bool {
+			return u.Email == email
+		})
+		if err != nil {
+			return err
+		} else if existing != nil {
+			return &errors.PreflightError{
+				Status: 409,
+				Code: errors.CODE_EMAIL_TAKEN,
+				InternalMessage: "user with email " + email + " already exists",
+				ExternalMessage: "There is already a user with email " + email,
+			}
+		}
+		return users.Put(user.GetId(), userBytes)
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.AddUser", err)
+	}
+
+	return user, nil
+}
+
+func (p *kvStore) UpdateUser(user *User) *errors.PreflightError {
+	id := user.GetId()
+	err := p.db.Update(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		existing, err := getUser(users, id)
+		if err != nil {
+			return err
+		} else if existing == nil {
+			return userNotFound("persistence.kvStore.UpdateUser", id)
+		} else if existing.Version != user.Version {
+			return userConflict("persistence.kvStore.UpdateUser", id)
+		}
+
+		updated := *user
+		updated.Version++
+		userBytes, err := bson.Marshal(&updated)
+		if err != nil {
+			return err
+		}
+		return users.Put(id, userBytes)
+	})
+	if err != nil {
+		return p.dbError("persistence.kvStore.UpdateUser", err)
+	}
+
+	user.Version++
+	return nil
+}
+
+func (p *kvStore) UpdateChecklistRecords(id string, records map[string]*checklist.UpdateRecord) *errors.PreflightError {
+	err := p.db.Update(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		user, err := getUser(users, id)
+		if err != nil {
+			return err
+		} else if user == nil {
+			return userNotFound("persistence.kvStore.UpdateChecklistRecords", id)
+		}
+
+		for name, record := range records {
+			cl, found := user.Checklists[name]
+			if found {
+				cl.Record = record
+			}
+		}
+		user.Version++
+
+		userBytes, err := bson.Marshal(user)
+		if err != nil {
+			return err
+		}
+		return users.Put(id, userBytes)
+	})
+	if err != nil {
+		return p.dbError("persistence.kvStore.UpdateChecklistRecords", err)
+	}
+
+	return nil
+}
+
+func (p *kvStore) RecordTokenUse(userId, tokenId string, count int, last time.Time, address string) *errors.PreflightError {
+	err := p.db.Update(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		user, err := getUser(users, userId)
+		if err != nil || user == nil {
+			return err
+		}
+
+		for i, _ := range user.Security.Tokens {
+			token := &user.Security.Tokens[i]
+			if token.Id == tokenId {
+				token.RecordUse(count, last, address)
+				userBytes, err := bson.Marshal(user)
+				if err != nil {
+					return err
+				}
+				return users.Put(userId, userBytes)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return p.dbError("persistence.kvStore.RecordTokenUse", err)
+	}
+
+	return nil
+}
+
+func (p *kvStore) DeleteUser(user *User) *errors.PreflightError {
+	id := user.GetId()
+	err := p.db.Update(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		if users.Get(id) == nil {
+			return userNotFound("persistence.kvStore.DeleteUser", id)
+		}
+		return users.Delete(id)
+	})
+	if err != nil {
+		return p.dbError("persistence.kvStore.DeleteUser", err)
+	}
+
+	return nil
+}
+
+func (p *kvStore) GetUser(id string) (*User, *errors.PreflightError) {
+	var user *User
+	err := p.db.View(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		var err error
+		user, err = getUser(users, id)
+		if err == nil && user == nil {
+			return userNotFound("persistence.kvStore.GetUser", id)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.GetUser", err)
+	}
+
+	return user, nil
+}
+
+func (p *kvStore) GetUserByEmail(email string) (*User, *errors.PreflightError) {
+	var user *User
+	err := p.db.View(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		var err error
+		user, err = findUser(users, func(u *User) bool {
+			return u.Email == email
+		})
+		return err
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.GetUserByEmail", err)
+	} else if user == nil {
+		return nil, &errors.PreflightError{
+			Status: 404,
+			Code: errors.CODE_USER_NOT_FOUND,
+			InternalMessage: "persistence.kvStore.GetUserByEmail: " +
+				"user email=" + email + " not found",
+			ExternalMessage: "User with email " + email + " not found",
+		}
+	}
+
+	return user, nil
+}
+
+func (p *kvStore) GetUserByTokenId(id string) (*User, *errors.PreflightError) {
+	user, pErr := p.getUserByToken(func(token security.Token) bool {
+		return token.Id == id
+	})
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.kvStore.GetUserByTokenId: ")
+	}
+	return user, nil
+}
+
+func (p *kvStore) GetUserByTokenHash(hash string) (*User, *errors.PreflightError) {
+	user, pErr := p.getUserByToken(func(token security.Token) bool {
+		return token.Hash == hash
+	})
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.kvStore.GetUserByTokenHash: ")
+	}
+	return user, nil
+}
+
+func (p *kvStore) getUserByToken(match func(security.Token) bool) (*User, *errors.PreflightError) {
+	var user *User
+	err := p.db.View(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		var err error
+		user, err = findUser(users, func(u *User) bool {
+			if u.Security == nil {
+				return false
+			}
+			for _, token := range u.Security.Tokens {
+				if match(token) {
+					return true
+				}
+			}
+			return false
+		})
+		return err
+	})
+	if err != nil {
+		return nil, p.dbError("error finding user by token", err)
+	} else if user == nil {
+		return nil, &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_TOKEN_INVALID,
+			InternalMessage: "no user found with token",
+			ExternalMessage: "No user with that token was found",
+		}
+	}
+
+	return user, nil
+}
+
+func (p *kvStore) GetUserIds() ([]string, *errors.PreflightError) {
+	ids := make([]string, 0)
+	err := p.db.View(func(tx kvTx) error {
+		users := tx.Bucket(usersBucket)
+		return users.ForEach(func(key string, value []byte) error {
+			ids = append(ids, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.GetUserIds", err)
+	}
+
+	return ids, nil
+}
+
+func (p *kvStore) AddAuditEntry(entry *AuditEntry) *errors.PreflightError {
+	pErr := entry.init()
+	if pErr != nil {
+		return pErr.Prepend("persistence.kvStore.AddAuditEntry: ")
+	}
+	entryBytes, err := bson.Marshal(entry)
+	if err != nil {
+		return p.dbError("persistence.kvStore.AddAuditEntry", err)
+	}
+
+	err = p.db.Update(func(tx kvTx) error {
+		return tx.Bucket(auditBucket).Put(auditKey(entry), entryBytes)
+	})
+	if err != nil {
+		return p.dbError("persistence.kvStore.AddAuditEntry", err)
+	}
+
+	return nil
+}
+
+/*
+ * returns up to limit of the user's entries from before the given time, or
+ * from any time if before is zero, newest first; entries at the same time
+ * are ordered by id, and if beforeId is given, those at the given time with
+ * lesser ids are also returned
+ */
+func (p *kvStore) GetAuditEntries(userId string, before time.Time, beforeId string, limit int) ([]AuditEntry, *errors.PreflightError) {
+	prefix := userId + "/"
+	end := prefix + "~"
+	if ! before.IsZero() {
+		end = fmt.Sprintf("%s%020d", prefix, before.UnixNano())
+		if beforeId != "" {
+			end += "/" + beforeId
+		}
+	}
+
+	entries := make([]AuditEntry, 0)
+	err := p.db.View(func(tx kvTx) error {
+		return tx.Bucket(auditBucket).ForEachPrefix(prefix, func(key string, value []byte) error {
+			if key >= end {
+				return nil
+			}
+			entry := AuditEntry{}
+			err := bson.Unmarshal(value, &entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, p.dbError("persistence.kvStore.GetAuditEntries", err)
+	}
+
+	if len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+
+	return entries, nil
+}
+
+/*
+ * keys audit entries by user, then time, so that a user's entries are
+ * adjacent and in order
+ */
+func auditKey(entry *AuditEntry) string {
+	return fmt.Sprintf("%s/%020d/%s", entry.UserId, entry.Time.UnixNano(), entry.Id)
+}
+
+func getUser(users bucket, id string) (*User, error) {
+	userBytes := users.Get(id)
+	if userBytes == nil {
+		return nil, nil
+	}
+	user := new(User)
+	err := bson.Unmarshal(userBytes, user)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func findUser(users bucket, match func(*User) bool) (*User, error) {
+	var found *User
+	err := users.ForEach(func(key string, value []byte) error {
+		if found != nil {
+			return nil
+		}
+		user := new(User)
+		err := bson.Unmarshal(value, user)
+		if err != nil {
+			return err
+		}
+		if match(user) {
+			found = user
+		}
+		return nil
+	})
+
+	return found, err
+}
@@ -0,0 +1,189 @@
+package persistence
+
+import (
+	"github.com/jsutton9/preflight/api/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const ROTATED_TIME_FORMAT = "20060102T150405.000000000"
+
+/*
+ * a log file, always written in append mode, which is rotated once it reaches
+ * maxSize bytes or has been open for maxAge, keeping at most backups rotated
+ * files; a maxSize, maxAge or backups of 0 disables that limit
+ */
+type logFile struct {
+	path string
+	maxSize int64
+	maxAge time.Duration
+	backups int
+
+	lock sync.Mutex
+	file *os.File
+	size int64
+	opened time.Time
+}
+
+func openLogFile(path string, maxSize int64, maxAge time.Duration, backups int) (*logFile, *errors.PreflightError) {
+	l := &logFile{
+		path: path,
+		maxSize: maxSize,
+		maxAge: maxAge,
+		backups: backups,
+	}
+	err := l.open()
+	if err != nil {
+		return nil, err.Prepend("persistence.openLogFile: ")
+	}
+	return l, nil
+}
+
+/*
+ * opens the file at l.path, creating it and its directory if missing; the
+ * caller must hold l.lock, or have sole use of l
+ */
+func (l *logFile) open() *errors.PreflightError {
+	f, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if os.IsNotExist(err) {
+		var pErr *errors.PreflightError
+		f, pErr = createFile(l.path)
+		if pErr != nil {
+			return pErr.Prepend("persistence.logFile.open: error creating file: ")
+		}
+	} else if err != nil {
+		return &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "persistence.logFile.open: " +
+				"error opening log file \"" + l.path + "\": \n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
+		}
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "persistence.logFile.open: " +
+				"error reading size of log file \"" + l.path + "\": \n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
+		}
+	}
+	l.file = f
+	l.size = info.Size()
+	l.opened = time.Now()
+	return nil
+}
+
+func (l *logFile) Write(p []byte) (int, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size > 0 && l.due(len(p)) {
+		err := l.rotate()
+		if err != nil {
+			// keep logging to the old file rather than losing lines
+			os.Stderr.WriteString(err.Error() + "\n")
+		}
+	}
+	n, err := l.file.Write(p)
+	l.size += int64(n)
+	return n, err
+}
+
+func (l *logFile) due(writeSize int) bool {
+	if l.maxSize > 0 && l.size + int64(writeSize) > l.maxSize {
+		return true
+	}
+	return l.maxAge > 0 && time.Since(l.opened) >= l.maxAge
+}
+
+/*
+ * moves the file aside under a name ending in the time of rotation, opens a
+ * new one, and removes the oldest rotated files beyond l.backups
+ */
+func (l *logFile) rotate() *errors.PreflightError {
+	rotatedPath := l.path + "." + time.Now().UTC().Format(ROTATED_TIME_FORMAT)
+	err := os.Rename(l.path, rotatedPath)
+	if err != nil {
+		return &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "persistence.logFile.rotate: " +
+				"error renaming log file \"" + l.path + "\": \n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
+		}
+	}
+	old := l.file
+	pErr := l.open()
+	if pErr != nil {
+		return pErr.Prepend("persistence.logFile.rotate: error opening new file: ")
+	}
+	old.Close()
+
+	if l.backups > 0 {
+		pErr = l.removeOldBackups()
+		if pErr != nil {
+			return pErr.Prepend("persistence.logFile.rotate: ")
+		}
+	}
+	return nil
+}
+
+func (l *logFile) removeOldBackups() *errors.PreflightError {
+	rotated, err := filepath.Glob(l.path + ".*")
+	if err != nil {
+		return &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "persistence.logFile.removeOldBackups: " +
+				"error listing rotated files: \n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
+		}
+	}
+	// the time format sorts chronologically
+	sort.Strings(rotated)
+	for len(rotated) > l.backups {
+		err = os.Remove(rotated[0])
+		if err != nil && ! os.IsNotExist(err) {
+			return &errors.PreflightError{
+				Status: 500,
+				Cause: err,
+				InternalMessage: "persistence.logFile.removeOldBackups: " +
+					"error removing \"" + rotated[0] + "\": \n\t" + err.Error(),
+				ExternalMessage: "There was an error.",
+			}
+		}
+		rotated = rotated[1:]
+	}
+	return nil
+}
+
+/*
+ * closes the file and opens l.path again, for when another program such as
+ * logrotate has moved it
+ */
+func (l *logFile) Reopen() *errors.PreflightError {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	old := l.file
+	err := l.open()
+	if err != nil {
+		return err.Prepend("persistence.logFile.Reopen: ")
+	}
+	old.Close()
+	return nil
+}
+
+func (l *logFile) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.file.Close()
+}
@@ -0,0 +1,83 @@
+package persistence
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+type memoryKV struct {
+	mutex sync.RWMutex
+	buckets map[string]memoryBucket
+}
+
+type memoryBucket map[string][]byte
+
+/*
+ * returns a Store which keeps everything in memory, for tests
+ */
+func NewMemoryStore() Store {
+	db := &memoryKV{buckets: make(map[string]memoryBucket)}
+	for _, name := range kvBuckets {
+		db.buckets[name] = make(memoryBucket)
+	}
+	return &kvStore{db: db, name: "memory", owner: true}
+}
+
+func (m *memoryKV) View(fn func(tx kvTx) error) error {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+	return fn(m)
+}
+
+func (m *memoryKV) Update(fn func(tx kvTx) error) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return fn(m)
+}
+
+func (m *memoryKV) Bucket(name string) bucket {
+	return m.buckets[name]
+}
+
+func (m *memoryKV) Close() error {
+	return nil
+}
+
+func (b memoryBucket) Get(key string) []byte {
+	return b[key]
+}
+
+func (b memoryBucket) Put(key string, value []byte) error {
+	b[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (b memoryBucket) Delete(key string) error {
+	delete(b, key)
+	return nil
+}
+
+func (b memoryBucket) ForEach(fn func(key string, value []byte) error) error {
+	return b.ForEachPrefix("", fn)
+}
+
+/*
+ * visits keys in sorted order, as BoltDB does
+ */
+func (b memoryBucket) ForEachPrefix(prefix string, fn func(key string, value []byte) error) error {
+	keys := make([]string, 0, len(b))
+	for key, _ := range b {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		err := fn(key, b[key])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,741 @@
+package persistence
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/checklist"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/mongo"
+	"go.mongodb.org/mongo-driver/mongo/options"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DB_TIMEOUT = 10*time.Second
+	RECORD_ATTEMPTS = 3
+)
+
+type MongoStore struct {
+	Client *mongo.Client
+	UserCollection *mongo.Collection
+	NodeCollection *mongo.Collection
+	AuditCollection *mongo.Collection
+	OAuthClientCollection *mongo.Collection
+	owner bool
+}
+
+/*
+ * connects to url, which is either a hostname or a mongodb:// connection
+ * string, and uses the named database
+ */
+func NewMongoStore(url, database string) (*MongoStore, *errors.PreflightError) {
+	p, pErr := dialMongo(options.Client().ApplyURI(mongoUri(url)), database)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.NewMongoStore: ")
+	}
+	return p, nil
+}
+
+/*
+ * connects to MongoDB using the connection string, auth source and TLS
+ * settings from s
+ */
+func (s ServerSettings) GetMongoStore() (*MongoStore, *errors.PreflightError) {
+	url := s.DatabaseUri
+	if url == "" {
+		url = s.DatabaseServer
+	}
+	opts := options.Client().ApplyURI(mongoUri(url))
+
+	if s.DatabaseAuthSource != "" {
+		if opts.Auth == nil {
+			opts.Auth = &options.Credential{}
+		}
+		opts.Auth.AuthSource = s.DatabaseAuthSource
+	}
+
+	if s.DatabaseTLS {
+		tlsConfig := &tls.Config{}
+		if s.DatabaseTLSCAFile != "" {
+			caBytes, err := ioutil.ReadFile(s.DatabaseTLSCAFile)
+			if err != nil {
+				return nil, &errors.PreflightError{
+					Status: 500,
+					Kind: errors.ErrUpstream,
+					Cause: err,
+					InternalMessage: "persistence.ServerSettings.GetMongoStore: " +
+						"error reading CA file: \n\t" + err.Error(),
+					ExternalMessage: "There was an error connecting to the database.",
+				}
+			}
+			tlsConfig.RootCAs = x509.NewCertPool()
+			if ! tlsConfig.RootCAs.AppendCertsFromPEM(caBytes) {
+				return nil, &errors.PreflightError{
+					Status: 500,
+					Kind: errors.ErrUpstream,
+					InternalMessage: "persistence.ServerSettings.GetMongoStore: " +
+						"no certificates found in CA file \"" + s.DatabaseTLSCAFile + "\"",
+					ExternalMessage: "There was an error connecting to the database.",
+				}
+			}
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	p, pErr := dialMongo(opts, s.DatabaseUsersCollection)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.ServerSettings.GetMongoStore: ")
+	}
+	return p, nil
+}
+
+func mongoUri(url string) string {
+	if strings.HasPrefix(url, "mongodb://") || strings.HasPrefix(url, "mongodb+srv://") {
+		return url
+	}
+	return "mongodb://" + url
+}
+
+func dialMongo(opts *options.ClientOptions, database string) (*MongoStore, *errors.PreflightError) {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+
+	client, err := mongo.Connect(ctx, opts)
+	if err == nil {
+		err = client.Ping(ctx, nil)
+		if err != nil {
+			client.Disconnect(context.Background())
+		}
+	}
+	if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "error connecting to database: \n\t" + err.Error(),
+			ExternalMessage: "There was an error connecting to the database.",
+		}
+	}
+
+	return &MongoStore{
+		Client: client,
+		UserCollection: client.Database(database).Collection("users"),
+		NodeCollection: client.Database(database).Collection("nodes"),
+		AuditCollection: client.Database(database).Collection("audit"),
+		OAuthClientCollection: client.Database(database).Collection("oauthClients"),
+		owner: true,
+	}, nil
+}
+
+/*
+ * returns 503 for errors reaching the database, which should pass once it is
+ * back, and 500 for others
+ */
+func mongoStatus(err error) int {
+	if mongo.IsTimeout(err) || mongo.IsNetworkError(err) {
+		return 503
+	}
+	return 500
+}
+
+/*
+ * the driver pools connections itself, so copies share the client and only
+ * the original disconnects it
+ */
+func (p MongoStore) Copy() Store {
+	return &MongoStore{
+		Client: p.Client,
+		UserCollection: p.UserCollection,
+		NodeCollection: p.NodeCollection,
+		AuditCollection: p.AuditCollection,
+		OAuthClientCollection: p.OAuthClientCollection,
+		owner: false,
+	}
+}
+
+func (p MongoStore) Close() {
+	if p.owner {
+		ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+		defer cancel()
+		p.Client.Disconnect(ctx)
+	}
+}
+
+func (p MongoStore) RegisterNode(secretFile string, capabilities NodeCapabilities) (*Node, *errors.PreflightError) {
+	node, pErr := newNode(secretFile, capabilities)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.MongoStore.RegisterNode: error creating node: ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	_, err := p.NodeCollection.InsertOne(ctx, node)
+	if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.RegisterNode: " +
+				"error adding node to db: \n\t" + err.Error(),
+			ExternalMessage: "There was an error adding the node to the database.",
+		}
+	}
+
+	return node, nil
+}
+
+func (p MongoStore) GetNode(secret string) (*Node, *errors.PreflightError) {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	node := &Node{}
+	err := p.NodeCollection.FindOne(ctx, bson.M{"secret": secret}).Decode(node)
+	if err == mongo.ErrNoDocuments {
+		return nil, nodeNotFound("persistence.MongoStore.GetNode")
+	} else if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.GetNode: error querying db: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	node.upgrade()
+	return node, nil
+}
+
+func (p MongoStore) AddOAuthClient(name string, redirectUris []string) (*OAuthClient, *errors.PreflightError) {
+	client, pErr := newOAuthClient(name, redirectUris)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.MongoStore.AddOAuthClient: ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	_, err := p.OAuthClientCollection.InsertOne(ctx, client)
+	if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.AddOAuthClient: " +
+				"error adding client to db: \n\t" + err.Error(),
+			ExternalMessage: "There was an error adding the client to the database.",
+		}
+	}
+
+	return client, nil
+}
+
+func (p MongoStore) GetOAuthClient(id string) (*OAuthClient, *errors.PreflightError) {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	client := &OAuthClient{}
+	err := p.OAuthClientCollection.FindOne(ctx, bson.M{"_id": id}).Decode(client)
+	if err == mongo.ErrNoDocuments {
+		return nil, oauthClientNotFound("persistence.MongoStore.GetOAuthClient", id)
+	} else if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.GetOAuthClient: error querying db: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	return client, nil
+}
+
+func (p MongoStore) AddUser(email, password string) (*User, *errors.PreflightError) {
+	existing_user, _ := p.GetUserByEmail(email)
+	if existing_user != nil {
+		return nil, &errors.PreflightError{
+			Status: 409,
+			Code: errors.CODE_EMAIL_TAKEN,
+			InternalMessage: "persistence.MongoStore.AddUser: " +
+				"\n\tuser with email " + email + " already exists",
+			ExternalMessage: "There is already a user with email " + email,
+		}
+	}
+
+	user, pErr := newUser(email, password)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.MongoStore.AddUser: error creating user: ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	_, err := p.UserCollection.InsertOne(ctx, user)
+	if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.AddUser: " +
+				"error inserting user:\n\t" + err.Error(),
+			ExternalMessage: "There was an error adding the user to the database.",
+		}
+	}
+
+	return user, nil
+}
+
+func (p MongoStore) UpdateUser(user *User) *errors.PreflightError {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+
+	/* users written before versioning have no version field */
+	filter := bson.M{"_id": user.Id, "version": user.Version}
+	if user.Version == 0 {
+		filter["version"] = bson.M{"$in": bson.A{0, nil}}
+	}
+	updated := *user
+	updated.Version++
+	result, err := p.UserCollection.ReplaceOne(ctx, filter, &updated)
+	if err != nil {
+		return &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.UpdateUser: " +
+				"error updating user:\n\t" + err.Error(),
+			ExternalMessage: "There was an error updating the user in the database.",
+		}
+	} else if result.MatchedCount == 0 {
+		n, err := p.UserCollection.CountDocuments(ctx, bson.M{"_id": user.Id})
+		if err != nil {
+			return &errors.PreflightError{
+				Status: mongoStatus(err),
+				Kind: errors.ErrUpstream,
+				Cause: err,
+				InternalMessage: "persistence.MongoStore.UpdateUser: " +
+					"error finding user:\n\t" + err.Error(),
+				ExternalMessage: "There was an error updating the user in the database.",
+			}
+		} else if n == 0 {
+			return userNotFound("persistence.MongoStore.UpdateUser", user.GetId())
+		}
+		return userConflict("persistence.MongoStore.UpdateUser", user.GetId())
+	}
+
+	user.Version++
+	return nil
+}
+
+/*
+ * sets all the records in one write, which matches only if every named
+ * checklist still exists; if one has been deleted since, the write is retried
+ * without it
+ */
+func (p MongoStore) UpdateChecklistRecords(id string, records map[string]*checklist.UpdateRecord) *errors.PreflightError {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return userNotFound("persistence.MongoStore.UpdateChecklistRecords", id)
+	}
+
+	for attempt := 0; attempt < RECORD_ATTEMPTS; attempt++ {
+		if len(records) == 0 {
+			return nil
+		}
+		filter := bson.M{"_id": objectId}
+		set := bson.M{}
+		for name, record := range records {
+			field := "checklists." + name
+			filter[field] = bson.M{"$exists": true}
+			set[field + ".record"] = record
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+		result, err := p.UserCollection.UpdateOne(ctx, filter,
+			bson.M{"$set": set, "$inc": bson.M{"version": 1}})
+		cancel()
+		if err != nil {
+			return &errors.PreflightError{
+				Status: mongoStatus(err),
+				Kind: errors.ErrUpstream,
+				Cause: err,
+				InternalMessage: "persistence.MongoStore.UpdateChecklistRecords: " +
+					"error updating records:\n\t" + err.Error(),
+				ExternalMessage: "There was an error updating the user in the database.",
+			}
+		} else if result.MatchedCount > 0 {
+			return nil
+		}
+
+		user, pErr := p.GetUser(id)
+		if pErr != nil {
+			return pErr.Prepend("persistence.MongoStore.UpdateChecklistRecords: ")
+		}
+		remaining := make(map[string]*checklist.UpdateRecord)
+		for name, record := range records {
+			if _, found := user.Checklists[name]; found {
+				remaining[name] = record
+			}
+		}
+		records = remaining
+	}
+
+	return userConflict("persistence.MongoStore.UpdateChecklistRecords", id)
+}
+
+/*
+ * only the usage fields of the matching token are set, and the version is
+ * left alone; lastUsed may go back if another server wrote a later use
+ * between flushes
+ */
+func (p MongoStore) RecordTokenUse(userId, tokenId string, count int, last time.Time, address string) *errors.PreflightError {
+	objectId, err := primitive.ObjectIDFromHex(userId)
+	if err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	filter := bson.M{"_id": objectId, "security.tokens.id": tokenId}
+	update := bson.M{
+		"$inc": bson.M{"security.tokens.$.usecount": count},
+		"$set": bson.M{
+			"security.tokens.$.lastUsed": last,
+			"security.tokens.$.lastAddress": address,
+		},
+	}
+	_, err = p.UserCollection.UpdateOne(ctx, filter, update)
+	if err != nil {
+		return &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.RecordTokenUse: " +
+				"error updating token " + tokenId + ":\n\t" + err.Error(),
+			ExternalMessage: "There was an error updating the user in the database.",
+		}
+	}
+
+	return nil
+}
+
+func (p MongoStore) DeleteUser(user *User) *errors.PreflightError {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	result, err := p.UserCollection.DeleteOne(ctx, bson.M{"_id": user.Id})
+	if err != nil {
+		return &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.DeleteUser: " +
+				"error removing user:\n\t" + err.Error(),
+			ExternalMessage: "There was an error removing the user from the database.",
+		}
+	} else if result.DeletedCount == 0 {
+		return userNotFound("persistence.MongoStore.DeleteUser", user.GetId())
+	}
+
+	return nil
+}
+
+func (p MongoStore) GetUser(id string) (*User, *errors.PreflightError) {
+	objectId, err := primitive.ObjectIDFromHex(id)
+	if err != nil {
+		return nil, userNotFound("persistence.MongoStore.GetUser", id)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	user := &User{}
+	err = p.UserCollection.FindOne(ctx, bson.M{"_id": objectId}).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return nil, userNotFound("persistence.MongoStore.GetUser", id)
+	} else if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.GetUser: " +
+				"error finding user id=" + id + ": \n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	return user, nil
+}
+
+func (p MongoStore) GetUserByEmail(email string) (*User, *errors.PreflightError) {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	user := &User{}
+	err := p.UserCollection.FindOne(ctx, bson.M{"email": email}).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return nil, &errors.PreflightError{
+			Status: 404,
+			Code: errors.CODE_USER_NOT_FOUND,
+			InternalMessage: "persistence.MongoStore.GetUserByEmail: " +
+				"user email=" + email + " not found",
+			ExternalMessage: "User with email " + email + " not found",
+		}
+	} else if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.GetUserByEmail: " +
+				"error finding user email=" + email + ": \n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	return user, nil
+}
+
+func (p MongoStore) GetUserByTokenId(id string) (*User, *errors.PreflightError) {
+	user, pErr := p.getUserByToken("id", id)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.MongoStore.GetUserByTokenId: ")
+	}
+	return user, nil
+}
+
+func (p MongoStore) GetUserByTokenHash(hash string) (*User, *errors.PreflightError) {
+	user, pErr := p.getUserByToken("hash", hash)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.MongoStore.GetUserByTokenHash: ")
+	}
+	return user, nil
+}
+
+func (p MongoStore) getUserByToken(field, value string) (*User, *errors.PreflightError) {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	user := &User{}
+	err := p.UserCollection.FindOne(ctx, bson.M{"security.tokens." + field: value}).Decode(user)
+	if err == mongo.ErrNoDocuments {
+		return nil, &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_TOKEN_INVALID,
+			InternalMessage: "no user found with token",
+			ExternalMessage: "No user with that token was found",
+		}
+	} else if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "error finding user by token: \n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	return user, nil
+}
+
+func (p MongoStore) Ping() *errors.PreflightError {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	err := p.Client.Ping(ctx, nil)
+	if err != nil {
+		return &errors.PreflightError{
+			Status: 503,
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.Ping: " +
+				"error pinging database: \n\t" + err.Error(),
+			ExternalMessage: "The database is unavailable.",
+		}
+	}
+
+	return nil
+}
+
+func (p MongoStore) GetUserIds() ([]string, *errors.PreflightError) {
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	users := make([]User, 0)
+	cursor, err := p.UserCollection.Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"_id": 1}))
+	if err == nil {
+		err = cursor.All(ctx, &users)
+	}
+	if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.GetUserIds: " +
+				"error listing users: \n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	ids := make([]string, 0, len(users))
+	for _, user := range users {
+		ids = append(ids, user.GetId())
+	}
+
+	return ids, nil
+}
+
+func (p MongoStore) AddAuditEntry(entry *AuditEntry) *errors.PreflightError {
+	pErr := entry.init()
+	if pErr != nil {
+		return pErr.Prepend("persistence.MongoStore.AddAuditEntry: ")
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	_, err := p.AuditCollection.InsertOne(ctx, entry)
+	if err != nil {
+		return &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.AddAuditEntry: " +
+				"error inserting entry:\n\t" + err.Error(),
+			ExternalMessage: "There was an error adding to the audit log.",
+		}
+	}
+
+	return nil
+}
+
+func (p MongoStore) GetAuditEntries(userId string, before time.Time, beforeId string, limit int) ([]AuditEntry, *errors.PreflightError) {
+	filter := bson.M{"userid": userId}
+	if ! before.IsZero() && beforeId == "" {
+		filter["time"] = bson.M{"$lt": before}
+	} else if ! before.IsZero() {
+		filter["$or"] = bson.A{
+			bson.M{"time": bson.M{"$lt": before}},
+			bson.M{"time": before, "_id": bson.M{"$lt": beforeId}},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), DB_TIMEOUT)
+	defer cancel()
+	entries := make([]AuditEntry, 0)
+	cursor, err := p.AuditCollection.Find(ctx, filter,
+		options.Find().SetSort(bson.D{{Key: "time", Value: -1}, {Key: "_id", Value: -1}}).
+			SetLimit(int64(limit)))
+	if err == nil {
+		err = cursor.All(ctx, &entries)
+	}
+	if err != nil {
+		return nil, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.GetAuditEntries: " +
+				"error listing entries: \n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	return entries, nil
+}
+
+/*
+ * converts task ids stored as ints by the old Todoist API into strings,
+ * returning the number of users updated
+ */
+func (p MongoStore) MigrateTaskIds() (int, *errors.PreflightError) {
+	ctx := context.Background()
+	updated := 0
+	cursor, err := p.UserCollection.Find(ctx, bson.M{},
+		options.Find().SetProjection(bson.M{"checklists": 1}))
+	if err != nil {
+		return updated, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.MigrateTaskIds: " +
+				"error listing users:\n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+	defer cursor.Close(ctx)
+
+	for cursor.Next(ctx) {
+		doc := bson.M{}
+		err = cursor.Decode(&doc)
+		if err != nil {
+			break
+		}
+
+		changes := bson.M{}
+		checklists, _ := doc["checklists"].(bson.M)
+		for name, clValue := range checklists {
+			cl, _ := clValue.(bson.M)
+			record, _ := cl["record"].(bson.M)
+			ids, _ := record["ids"].(bson.A)
+			stringIds, changed := stringifyIds(ids)
+			if changed {
+				changes["checklists." + name + ".record.ids"] = stringIds
+			}
+		}
+
+		if len(changes) > 0 {
+			_, err := p.UserCollection.UpdateOne(ctx,
+				bson.M{"_id": doc["_id"]}, bson.M{"$set": changes})
+			if err != nil {
+				return updated, &errors.PreflightError{
+					Status: mongoStatus(err),
+					Kind: errors.ErrUpstream,
+					Cause: err,
+					InternalMessage: "persistence.MongoStore.MigrateTaskIds: " +
+						"error updating user:\n\t" + err.Error(),
+					ExternalMessage: "There was an error updating the user in the database.",
+				}
+			}
+			updated++
+		}
+	}
+
+	if err == nil {
+		err = cursor.Err()
+	}
+	if err != nil {
+		return updated, &errors.PreflightError{
+			Status: mongoStatus(err),
+			Kind: errors.ErrUpstream,
+			Cause: err,
+			InternalMessage: "persistence.MongoStore.MigrateTaskIds: " +
+				"error listing users:\n\t" + err.Error(),
+			ExternalMessage: "There was an error querying the database.",
+		}
+	}
+
+	return updated, nil
+}
+
+func stringifyIds(ids []interface{}) ([]string, bool) {
+	stringIds := make([]string, 0, len(ids))
+	changed := false
+	for _, id := range ids {
+		switch typedId := id.(type) {
+		case string:
+			stringIds = append(stringIds, typedId)
+		case int:
+			stringIds = append(stringIds, strconv.Itoa(typedId))
+			changed = true
+		case int32:
+			stringIds = append(stringIds, strconv.FormatInt(int64(typedId), 10))
+			changed = true
+		case int64:
+			stringIds = append(stringIds, strconv.FormatInt(typedId, 10))
+			changed = true
+		case float64:
+			stringIds = append(stringIds, strconv.FormatFloat(typedId, 'f', -1, 64))
+			changed = true
+		}
+	}
+
+	return stringIds, changed
+}
@@ -1,23 +1,28 @@
 package persistence
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"github.com/jsutton9/preflight/api/errors"
 	"github.com/jsutton9/preflight/checklist"
 	"github.com/jsutton9/preflight/security"
-	"gopkg.in/mgo.v2"
-	"gopkg.in/mgo.v2/bson"
-	"log"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"io"
 	"io/ioutil"
+	"log/slog"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 type User struct {
-	Id bson.ObjectId                           `json:"id" bson:"_id,omitempty"`
+	Id primitive.ObjectID                      `json:"id" bson:"_id,omitempty"`
 	Email string                               `json:"email"`
 	Settings GeneralSettings                   `json:"generalSettings"`
 	Security *security.SecurityInfo            `json:"security"`
 	Checklists map[string]*checklist.Checklist `json:"checklists"`
+	Version int                                `json:"-"`
 }
 
 type GeneralSettings struct {
@@ -25,11 +30,39 @@ type GeneralSettings struct {
 	TrelloBoard string `json:"trelloBoard"`
 }
 
-type Persister struct {
-	Session *mgo.Session
-	databaseName string
-	UserCollection *mgo.Collection
-	NodeCollection *mgo.Collection
+/*
+ * UpdateUser replaces the whole user and fails with a 409 if the user has
+ * been written since it was read; UpdateChecklistRecords sets, all at once,
+ * only the records of the named checklists which still exist, so that tasks
+ * already posted are never forgotten, and fails with a 404 if the user is
+ * gone. RecordTokenUse adds to only the usage fields of the token, without
+ * changing the user's version, so that using a token does not conflict with
+ * other updates, and does nothing if the user or token is gone; uses written
+ * while a stale copy of the user is being updated may be lost. Lookups fail
+ * with a 404 or 401 only if nothing
+ * matches, and with a 503 if the database can't be reached; Ping fails with a
+ * 503 if the database can't be reached.
+ */
+type Store interface {
+	Copy() Store
+	Close()
+	Ping() *errors.PreflightError
+	RegisterNode(secretFile string, capabilities NodeCapabilities) (*Node, *errors.PreflightError)
+	GetNode(secret string) (*Node, *errors.PreflightError)
+	AddOAuthClient(name string, redirectUris []string) (*OAuthClient, *errors.PreflightError)
+	GetOAuthClient(id string) (*OAuthClient, *errors.PreflightError)
+	AddUser(email, password string) (*User, *errors.PreflightError)
+	UpdateUser(user *User) *errors.PreflightError
+	UpdateChecklistRecords(id string, records map[string]*checklist.UpdateRecord) *errors.PreflightError
+	RecordTokenUse(userId, tokenId string, count int, last time.Time, address string) *errors.PreflightError
+	DeleteUser(user *User) *errors.PreflightError
+	GetUser(id string) (*User, *errors.PreflightError)
+	GetUserByEmail(email string) (*User, *errors.PreflightError)
+	GetUserByTokenId(id string) (*User, *errors.PreflightError)
+	GetUserByTokenHash(hash string) (*User, *errors.PreflightError)
+	GetUserIds() ([]string, *errors.PreflightError)
+	AddAuditEntry(entry *AuditEntry) *errors.PreflightError
+	GetAuditEntries(userId string, before time.Time, beforeId string, limit int) ([]AuditEntry, *errors.PreflightError)
 }
 
 type ServerSettings struct {
@@ -37,116 +70,258 @@ type ServerSettings struct {
 	CertFile string                `json:"certFile"`
 	KeyFile string                 `json:"keyFile"`
 	ErrLog string                  `json:"errLog"`
+	LogFormat string               `json:"logFormat"`
+	LogLevel string                `json:"logLevel"`
+	LogMaxSize int                 `json:"logMaxSize"`
+	LogMaxAge int                  `json:"logMaxAge"`
+	LogBackups int                 `json:"logBackups"`
+	DatabaseType string            `json:"databaseType"`
 	DatabaseServer string          `json:"databaseServer"`
+	DatabaseUri string             `json:"databaseUri"`
+	DatabaseAuthSource string      `json:"databaseAuthSource"`
+	DatabaseTLS bool               `json:"databaseTls"`
+	DatabaseTLSCAFile string       `json:"databaseTlsCaFile"`
 	DatabaseUsersCollection string `json:"databaseUsersCollection"`
+	DatabaseFile string            `json:"databaseFile"`
 	TrelloAppKey string            `json:"trelloAppKey"`
 	SecretFile string              `json:"secretFile"`
+	TokenKeyFile string            `json:"tokenKeyFile"`
+	AllowQueryCredentials bool     `json:"allowQueryCredentials"`
+	SchedulerWorkers int           `json:"schedulerWorkers"`
+	SchedulerJitter int            `json:"schedulerJitter"`
+	SchedulerInterval int          `json:"schedulerInterval"`
+	SchedulerMetricsAddress string `json:"schedulerMetricsAddress"`
+	ServerReadTimeout int          `json:"serverReadTimeout"`
+	ServerWriteTimeout int         `json:"serverWriteTimeout"`
+	ServerIdleTimeout int          `json:"serverIdleTimeout"`
+	ServerShutdownTimeout int      `json:"serverShutdownTimeout"`
+	LoginRateLimit int             `json:"loginRateLimit"`
+	LoginAccountRateLimit int      `json:"loginAccountRateLimit"`
+	LoginLockoutFailures int       `json:"loginLockoutFailures"`
+	LoginLockoutMinutes int        `json:"loginLockoutMinutes"`
+	PasswordResetMinutes int       `json:"passwordResetMinutes"`
+	TokenGraceMinutes int          `json:"tokenGraceMinutes"`
+	TokenUsageInterval int         `json:"tokenUsageInterval"`
+	OAuthAccessTokenHours int      `json:"oauthAccessTokenHours"`
+	OAuthRefreshTokenDays int      `json:"oauthRefreshTokenDays"`
 }
 
+/*
+ * Nodes registered before nodes had ids and capabilities have neither, and
+ * are treated as having every capability.
+ */
 type Node struct {
-	Secret string
+	Id string                      `json:"id"`
+	Secret string                  `json:"-"`
+	Capabilities NodeCapabilities  `json:"capabilities"`
 }
 
+/*
+ * UserAdmin allows adding and deleting users; Permissions are those the node
+ * has when acting as a user.
+ */
+type NodeCapabilities struct {
+	UserAdmin bool                       `json:"userAdmin"`
+	Permissions security.PermissionFlags `json:"permissions"`
+}
+
+/*
+ * a third-party application which may ask users for tokens through OAuth2;
+ * clients are public, proving themselves with PKCE rather than a secret, and
+ * codes are only sent to one of their RedirectUris
+ */
+type OAuthClient struct {
+	Id string             `json:"id" bson:"_id"`
+	Name string           `json:"name"`
+	RedirectUris []string `json:"redirectUris"`
+}
+
+const (
+	ACTOR_TOKEN = "token"
+	ACTOR_NODE = "node"
+	ACTOR_PASSWORD = "password"
+	ACTOR_CLI = "cli"
+	ACTOR_RESET = "resetToken"
+	ACTOR_SCHEDULER = "scheduler"
+	ACTOR_OAUTH_CLIENT = "oauthClient"
+)
+
+/*
+ * Actor identifies who made a change: a token or node by id, a user
+ * authenticated by password, or an administrator using the command line.
+ */
+type Actor struct {
+	Type string `json:"type"`
+	Id string   `json:"id,omitempty"`
+}
+
+type AuditEntry struct {
+	Id string      `json:"id" bson:"_id"`
+	Time time.Time `json:"time"`
+	UserId string  `json:"userId"`
+	Actor Actor    `json:"actor"`
+	Action string  `json:"action"`
+	Summary string `json:"summary,omitempty"`
+}
+
+/*
+ * file is nil when logging to stderr
+ */
 type LoggerCloser struct {
-	*log.Logger
-	file *os.File
-	isStderr bool
+	*slog.Logger
+	file *logFile
 }
 
 func (u *User) GetId() string {
 	return u.Id.Hex()
 }
 
-func New(url, database string) (*Persister, *errors.PreflightError) {
-	session, err := mgo.Dial(url)
-	if err != nil {
-		return nil, &errors.PreflightError{
-			Status: 500,
-			InternalMessage: "persistence.New: " +
-				"error dialing \""+url+"\": \n\t" + err.Error(),
-			ExternalMessage: "There was an error connecting to the database.",
+func newUser(email, password string) (*User, *errors.PreflightError) {
+	security, pErr := security.New(password)
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.newUser: error creating security: ")
+	}
+
+	return &User{
+		Id: primitive.NewObjectID(),
+		Email: email,
+		Settings: GeneralSettings{},
+		Security: security,
+		Checklists: make(map[string]*checklist.Checklist),
+	}, nil
+}
+
+/*
+ * gives nodes registered before capabilities existed every capability
+ */
+func (n *Node) upgrade() {
+	if n.Id == "" {
+		n.Id = "legacy"
+		n.Capabilities = NodeCapabilities{
+			UserAdmin: true,
+			Permissions: security.PermissionFlags{
+				ChecklistRead: true,
+				ChecklistWrite: true,
+				ChecklistInvoke: true,
+				GeneralRead: true,
+				GeneralWrite: true,
+			},
 		}
 	}
+}
+
+func nodeNotFound(function string) *errors.PreflightError {
+	return &errors.PreflightError{
+		Status: 401,
+		Code: errors.CODE_NODE_SECRET_INVALID,
+		InternalMessage: function + ": node secret not found",
+		ExternalMessage: "Node secret invalid",
+	}
+}
 
-	userCollection := session.DB(database).C("users")
-	nodeCollection := session.DB(database).C("nodes")
+/*
+ * fills in the id and time of a new audit entry
+ */
+func (e *AuditEntry) init() *errors.PreflightError {
+	if e.Id == "" {
+		id, pErr := security.GenerateId()
+		if pErr != nil {
+			return pErr.Prepend("persistence.AuditEntry.init: error generating id: ")
+		}
+		e.Id = id
+	}
+	if e.Time.IsZero() {
+		/* BSON times have millisecond precision */
+		e.Time = time.Now().Truncate(time.Millisecond)
+	}
+	return nil
+}
 
-	p := Persister{
-		Session: session,
-		databaseName: database,
-		UserCollection: userCollection,
-		NodeCollection: nodeCollection,
+func userNotFound(function, id string) *errors.PreflightError {
+	return &errors.PreflightError{
+		Status: 404,
+		Code: errors.CODE_USER_NOT_FOUND,
+		InternalMessage: function + ": user id=" + id + " not found",
+		ExternalMessage: "User with id " + id + " not found",
 	}
+}
 
-	return &p, nil
+func userConflict(function, id string) *errors.PreflightError {
+	return &errors.PreflightError{
+		Status: 409,
+		Code: errors.CODE_USER_CONFLICT,
+		InternalMessage: function + ": user id=" + id + " was modified concurrently",
+		ExternalMessage: "The user was changed by another request; please try again.",
+	}
 }
 
-func (p Persister) Close() {
-	p.Session.Close()
+func newOAuthClient(name string, redirectUris []string) (*OAuthClient, *errors.PreflightError) {
+	id, pErr := security.GenerateId()
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.newOAuthClient: error generating id: ")
+	}
+	return &OAuthClient{Id: id, Name: name, RedirectUris: redirectUris}, nil
 }
 
-func (p Persister) Copy() *Persister {
-	session := p.Session.Copy()
-	userCollection := session.DB(p.databaseName).C("users")
-	nodeCollection := session.DB(p.databaseName).C("nodes")
-	return &Persister{
-		Session: session,
-		databaseName: p.databaseName,
-		UserCollection: userCollection,
-		NodeCollection: nodeCollection,
+func oauthClientNotFound(function, id string) *errors.PreflightError {
+	return &errors.PreflightError{
+		Status: 401,
+		Code: errors.CODE_INVALID_CLIENT,
+		Kind: errors.ErrNotFound,
+		InternalMessage: function + ": oauth client \"" + id + "\" not found",
+		ExternalMessage: "The client is not registered.",
 	}
 }
 
-func (p Persister) RegisterNode(secretFile string) *errors.PreflightError {
+/*
+ * generates a node id and secret and writes the secret to secretFile
+ */
+func newNode(secretFile string, capabilities NodeCapabilities) (*Node, *errors.PreflightError) {
+	id, pErr := security.GenerateId()
+	if pErr != nil {
+		return nil, pErr.Prepend("persistence.newNode: error generating id: ")
+	}
 	secret, pErr := security.GenerateNodeSecret()
 	if pErr != nil {
-		return pErr.Prepend("persistence.Persister.RegisterNode: error generating secret: ")
+		return nil, pErr.Prepend("persistence.newNode: error generating secret: ")
 	}
 
 	err := ioutil.WriteFile(secretFile, []byte(secret), 0600)
 	if os.IsNotExist(err) {
 		_, pErr := createFile(secretFile)
 		if pErr != nil {
-			pErr.Prepend("persistence.Persister.RegisterNode: error making file: ")
-			return pErr
+			pErr.Prepend("persistence.newNode: error making file: ")
+			return nil, pErr
 		}
 		err = ioutil.WriteFile(secretFile, []byte(secret), 0600)
 		if err != nil {
-			return &errors.PreflightError{
+			return nil, &errors.PreflightError{
 				Status: 500,
-				InternalMessage: "persistence.Persister.RegisterNode: " +
+				Cause: err,
+				InternalMessage: "persistence.newNode: " +
 					"error writing secret file: \n\t" + err.Error(),
 				ExternalMessage: "There was an error registering the node.",
 			}
 		}
 	} else if err != nil {
-		return &errors.PreflightError{
+		return nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "persistence.Persister.RegisterNode: " +
+			Cause: err,
+			InternalMessage: "persistence.newNode: " +
 				"error writing secret file: \n\t" + err.Error(),
 			ExternalMessage: "There was an error registering the node.",
 		}
 	}
 
-	node := Node{Secret:secret}
-	err = p.NodeCollection.Insert(&node)
-	if err != nil {
-		return &errors.PreflightError{
-			Status: 500,
-			InternalMessage: "persistence.Persister.RegisterNode: " +
-				"error adding node to db: \n\t" + err.Error(),
-			ExternalMessage: "There was an error adding the node to the database.",
-		}
-	}
-
-	return nil
+	return &Node{Id: id, Secret: secret, Capabilities: capabilities}, nil
 }
 
-func (p Persister) GetNodeSecret(filename string) (string, *errors.PreflightError) {
+func GetNodeSecret(filename string) (string, *errors.PreflightError) {
 	data, err := ioutil.ReadFile(filename)
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "persistence.GetNodeSecret: error reading secret file: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was a server authentication error.",
@@ -156,201 +331,241 @@ func (p Persister) GetNodeSecret(filename string) (string, *errors.PreflightErro
 	return string(data[:]), nil
 }
 
-func (p Persister) ValidateNodeSecret(secret string) (bool, *errors.PreflightError) {
-	n, err := p.NodeCollection.Find(bson.M{"secret": secret}).Count()
+func GetServerSettings(filename string) (*ServerSettings, *errors.PreflightError) {
+	contents, err := ioutil.ReadFile(filename)
 	if err != nil {
-		return false, &errors.PreflightError{
+		return nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "persistence.Persister.ValidateNodeSecret: error querying db: " +
+			Cause: err,
+			InternalMessage: "persistence.GetServerSettings: error reading file: " +
 				"\n\t" + err.Error(),
-			ExternalMessage: "There was an error querying the database.",
-		}
-	}
-
-	return n>0, nil
-}
-
-func (p Persister) AddUser(email, password string) (*User, *errors.PreflightError) {
-	existing_user, _ := p.GetUserByEmail(email)
-	if existing_user != nil {
-		return nil, &errors.PreflightError{
-			Status: 409,
-			InternalMessage: "persistence.Persister.AddUser: " +
-				"\n\tuser with email " + email + " already exists",
-			ExternalMessage: "There is already a user with email " + email,
+			ExternalMessage: "There was an error.",
 		}
 	}
 
-	security, pErr := security.New(password)
-	if pErr != nil {
-		return nil, pErr.Prepend("persistence.Persister.AddUser: error creating security: ")
-	}
-	user := User{
-		Id: bson.NewObjectId(),
-		Email: email,
-		Settings: GeneralSettings{},
-		Security: security,
-		Checklists: make(map[string]*checklist.Checklist),
+	settings := &ServerSettings{
+		Port: 443,
+		ErrLog: "",
+		LogFormat: "logfmt",
+		LogLevel: "info",
+		LogMaxSize: 100,
+		LogMaxAge: 0,
+		LogBackups: 7,
+		DatabaseType: "mongodb",
+		DatabaseServer: "localhost",
+		DatabaseUsersCollection: "users",
+		DatabaseFile: "/var/lib/preflight/preflight.db",
+		SecretFile: "/etc/preflight/secret",
+		TokenKeyFile: "/etc/preflight/token-key",
+		AllowQueryCredentials: true,
+		SchedulerWorkers: 4,
+		SchedulerJitter: 30,
+		SchedulerInterval: 300,
+		ServerReadTimeout: 10,
+		ServerWriteTimeout: 120,
+		ServerIdleTimeout: 120,
+		ServerShutdownTimeout: 120,
+		LoginRateLimit: 20,
+		LoginAccountRateLimit: 10,
+		LoginLockoutFailures: 10,
+		LoginLockoutMinutes: 15,
+		PasswordResetMinutes: 60,
+		TokenGraceMinutes: 60,
+		TokenUsageInterval: 60,
+		OAuthAccessTokenHours: 1,
+		OAuthRefreshTokenDays: 30,
 	}
-	err := p.UserCollection.Insert(&user)
+	err = json.Unmarshal(contents, settings)
 	if err != nil {
 		return nil, &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "persistence.Persister.AddUser: " +
-				"error inserting user:\n\t" + err.Error(),
-			ExternalMessage: "There was an error adding the user to the database.",
+			Cause: err,
+			InternalMessage: "persistence.GetServerSettings: error parsing json: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
 		}
 	}
 
-	return &user, nil
+	return settings, nil
 }
 
-func (p Persister) UpdateUser(user *User) *errors.PreflightError {
-	err := p.UserCollection.Update(bson.M{"_id": user.Id}, user)
+/*
+ * reads the key with which token secrets are hashed, generating it if it
+ * doesn't exist yet, and passes it to the security package
+ */
+func (s ServerSettings) LoadTokenKey() *errors.PreflightError {
+	data, err := ioutil.ReadFile(s.TokenKeyFile)
+	if os.IsNotExist(err) {
+		pErr := writeTokenKey(s.TokenKeyFile)
+		if pErr != nil {
+			return pErr.Prepend("persistence.ServerSettings.LoadTokenKey: ")
+		}
+		data, err = ioutil.ReadFile(s.TokenKeyFile)
+	}
 	if err != nil {
 		return &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "persistence.Persister.UpdateUser: " +
-				"error updating user:\n\t" + err.Error(),
-			ExternalMessage: "There was an error updating the user in the database.",
+			Cause: err,
+			InternalMessage: "persistence.ServerSettings.LoadTokenKey: " +
+				"error accessing key file: \n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
 		}
 	}
 
-	return nil
-}
-
-func (p Persister) DeleteUser(user *User) *errors.PreflightError {
-	err := p.UserCollection.Remove(bson.M{"_id": user.Id})
-	if err != nil {
+	key := bytes.TrimSpace(data)
+	if len(key) < security.TOKEN_KEY_BYTES {
 		return &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "persistence.Persister.DeleteUser: " +
-				"error removing user:\n\t" + err.Error(),
-			ExternalMessage: "There was an error removing the user from the database.",
+			InternalMessage: fmt.Sprintf("persistence.ServerSettings.LoadTokenKey: " +
+				"key in \"%s\" is %d bytes, shorter than %d", s.TokenKeyFile, len(key),
+				security.TOKEN_KEY_BYTES),
+			ExternalMessage: "There was an error.",
 		}
 	}
-
+	security.SetTokenKey(key)
 	return nil
 }
 
-func (p Persister) GetUser(id string) (*User, *errors.PreflightError) {
-	user := &User{}
-	err := p.UserCollection.FindId(bson.ObjectIdHex(id)).One(user)
-	if err != nil {
-		return nil, &errors.PreflightError{
-			Status: 404,
-			InternalMessage: "persistence.Persister.GetUser: " +
-				"error finding user id=" + id + ": \n\t" + err.Error(),
-			ExternalMessage: "User with id " + id + " not found",
-		}
+/*
+ * generates a key and writes it to path, by way of a temporary file so that a
+ * failed write leaves no key file behind; if another process writes one
+ * first, its key is kept
+ */
+func writeTokenKey(path string) *errors.PreflightError {
+	key, pErr := security.GenerateTokenKey()
+	if pErr != nil {
+		return pErr.Prepend("persistence.writeTokenKey: error generating key: ")
 	}
 
-	return user, nil
-}
-
-func (p Persister) GetUserByEmail(email string) (*User, *errors.PreflightError) {
-	user := &User{}
-	err := p.UserCollection.Find(bson.M{"email": email}).One(user)
-	if err != nil {
-		return nil, &errors.PreflightError{
-			Status: 404,
-			InternalMessage: "persistence.Persister.GetUserByEmail: " +
-				"error finding user email=" + email + ": \n\t" + err.Error(),
-			ExternalMessage: "User with email " + email + " not found",
+	fail := func(message string, err error) *errors.PreflightError {
+		return &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "persistence.writeTokenKey: " + message +
+				" \"" + path + "\": \n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
 		}
 	}
-
-	return user, nil
-}
-
-func (p Persister) GetUserByToken(secret string) (*User, *errors.PreflightError) {
-	user := &User{}
-	err := p.UserCollection.Find(bson.M{"security.tokens.secret": secret}).One(user)
+	err := os.MkdirAll(filepath.Dir(path), os.ModeDir | 0774)
 	if err != nil {
-		return nil, &errors.PreflightError{
-			Status: 401,
-			InternalMessage: "persistence.Persister.GetUserByToken: " +
-				"error finding user by token: \n\t" + err.Error(),
-			ExternalMessage: "No user with that token was found",
-		}
+		return fail("error making directory for", err)
 	}
-
-	return user, nil
-}
-
-func GetServerSettings(filename string) (*ServerSettings, *errors.PreflightError) {
-	contents, err := ioutil.ReadFile(filename)
+	f, err := os.CreateTemp(filepath.Dir(path), "." + filepath.Base(path) + ".*")
 	if err != nil {
-		return nil, &errors.PreflightError{
-			Status: 500,
-			InternalMessage: "persistence.GetServerSettings: error reading file: " +
-				"\n\t" + err.Error(),
-			ExternalMessage: "There was an error.",
-		}
+		return fail("error creating temporary file for", err)
 	}
-
-	settings := &ServerSettings{
-		Port: 443,
-		ErrLog: "",
-		DatabaseServer: "localhost",
-		DatabaseUsersCollection: "users",
-		SecretFile: "/etc/preflight/secret",
+	defer os.Remove(f.Name())
+	err = f.Chmod(0600)
+	if err == nil {
+		_, err = f.WriteString(key)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
 	}
-	err = json.Unmarshal(contents, settings)
 	if err != nil {
-		return nil, &errors.PreflightError{
-			Status: 500,
-			InternalMessage: "persistence.GetServerSettings: error parsing json: " +
-				"\n\t" + err.Error(),
-			ExternalMessage: "There was an error.",
-		}
+		return fail("error writing key for", err)
 	}
 
-	return settings, nil
+	// unlike a rename, a link fails rather than replacing a key written
+	// meanwhile by another process
+	err = os.Link(f.Name(), path)
+	if err != nil && ! os.IsExist(err) {
+		return fail("error moving key into", err)
+	}
+	return nil
 }
 
 func (s ServerSettings) GetLogger() (*LoggerCloser, *errors.PreflightError) {
 	logger := new(LoggerCloser)
-	logger.file = os.Stderr
-	logger.isStderr = true
+	var out io.Writer = os.Stderr
 
 	if s.ErrLog != "" {
-		logger.isStderr = false
-		var err error
-		logger.file, err = os.OpenFile(s.ErrLog, 1, 0660)
-		if os.IsNotExist(err) {
-			var pErr *errors.PreflightError
-			logger.file, pErr = createFile(s.ErrLog)
-			if pErr != nil {
-				pErr.Prepend("persistence.ServerSettings.GetLogger: " +
-					"error creating file: ")
-				return nil, pErr
-			}
-		} else if err != nil {
+		var pErr *errors.PreflightError
+		logger.file, pErr = openLogFile(s.ErrLog, int64(s.LogMaxSize) << 20,
+			time.Duration(s.LogMaxAge) * time.Hour, s.LogBackups)
+		if pErr != nil {
+			return nil, pErr.Prepend("persistence.ServerSettings.GetLogger: ")
+		}
+		out = logger.file
+	}
+
+	level := slog.LevelInfo
+	if s.LogLevel != "" {
+		err := level.UnmarshalText([]byte(s.LogLevel))
+		if err != nil {
+			logger.Close()
 			return nil, &errors.PreflightError{
 				Status: 500,
+				Cause: err,
 				InternalMessage: "persistence.ServerSettings.GetLogger: " +
-					"error opening log file \"" + s.ErrLog +
-					"\": \n\t" + err.Error(),
+					"error parsing log level \"" + s.LogLevel + "\": \n\t" + err.Error(),
 				ExternalMessage: "There was an error.",
 			}
 		}
 	}
-
-	logger.Logger = log.New(logger.file, "", log.Ldate | log.Ltime)
+	options := &slog.HandlerOptions{Level: level}
+	switch s.LogFormat {
+	case "json":
+		logger.Logger = slog.New(slog.NewJSONHandler(out, options))
+	case "logfmt", "":
+		logger.Logger = slog.New(slog.NewTextHandler(out, options))
+	default:
+		logger.Close()
+		return nil, &errors.PreflightError{
+			Status: 500,
+			InternalMessage: "persistence.ServerSettings.GetLogger: " +
+				"log format \"" + s.LogFormat + "\" not recognized",
+			ExternalMessage: "There was an error.",
+		}
+	}
 	return logger, nil
 }
 
-func (s ServerSettings) GetPersister() (*Persister, *errors.PreflightError) {
-	persister, err := New(s.DatabaseServer, s.DatabaseUsersCollection)
+func (s ServerSettings) GetPersister() (Store, *errors.PreflightError) {
+	var persister Store
+	var err *errors.PreflightError
+	switch s.DatabaseType {
+	case "mongodb":
+		persister, err = s.GetMongoStore()
+	case "bolt":
+		persister, err = NewBoltStore(s.DatabaseFile)
+	case "memory":
+		persister = NewMemoryStore()
+	default:
+		err = &errors.PreflightError{
+			Status: 500,
+			InternalMessage: "persistence.ServerSettings.GetPersister: " +
+				"database type \"" + s.DatabaseType + "\" not recognized",
+			ExternalMessage: "There was an error.",
+		}
+	}
 	if err != nil {
-		err.Prepend("persistence.ServerSettings.GetPersister: error making Persister: ")
+		return nil, err.Prepend("persistence.ServerSettings.GetPersister: error making Store: ")
 	}
-	return persister, err
+	return persister, nil
+}
+
+/*
+ * reopens the log file, so that logging continues in a new file after
+ * logrotate moves the old one; it does nothing when logging to stderr
+ */
+func (l LoggerCloser) Reopen() *errors.PreflightError {
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Reopen()
+	if err != nil {
+		return err.Prepend("persistence.LoggerCloser.Reopen: ")
+	}
+	return nil
 }
 
 func (l LoggerCloser) Close() error {
-	if ! l.isStderr {
+	if l.file != nil {
 		return l.file.Close()
 	}
 	return nil
@@ -369,6 +584,7 @@ func createFile(path string) (*os.File, *errors.PreflightError) {
 		if err != nil {
 			return nil, &errors.PreflightError{
 				Status: 500,
+				Cause: err,
 				InternalMessage: "persistence.createFile: " +
 					"error making directory: \n\t" + err.Error(),
 				ExternalMessage: "There was an error.",
@@ -379,6 +595,7 @@ func createFile(path string) (*os.File, *errors.PreflightError) {
 	if err != nil {
 		return nil, &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "persistence.createFile: error creating file \"" +
 				path + "\": \n\t" + err.Error(),
 			ExternalMessage: "There was an error.",
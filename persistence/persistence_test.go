@@ -3,36 +3,67 @@ package persistence
 import (
 	"testing"
 	"fmt"
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/checklist"
 	"github.com/jsutton9/preflight/security"
 	"io/ioutil"
 	"math/rand"
 	"os"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
-func TestGetUser(t *testing.T) {
-	rand.Seed(time.Now().UnixNano())
-	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
-	password := "password"
+/*
+ * returns a store of each type to test; MongoDB is tested only if
+ * TEST_MONGODB is set to the server to use
+ */
+func testStores(t *testing.T) map[string]Store {
+	stores := map[string]Store{"memory": NewMemoryStore()}
 
-	p, err := New("localhost", "preflight-test")
+	dir, err := ioutil.TempDir("", "preflight-test")
 	if err != nil {
 		t.Fatal(err)
 	}
-	user, err := p.AddUser(email, password)
-	if err != nil {
-		t.Fatal(err)
+	boltStore, pErr := NewBoltStore(filepath.Join(dir, "test.db"))
+	if pErr != nil {
+		t.Fatal(pErr)
 	}
-	id := user.GetId()
-	user, err = p.GetUser(id)
-	if err != nil {
-		t.Fatal(err)
+	stores["bolt"] = boltStore
+
+	server := os.Getenv("TEST_MONGODB")
+	if server != "" {
+		mongoStore, pErr := NewMongoStore(server, "preflight-test")
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+		stores["mongodb"] = mongoStore
 	}
 
-	if user.Email != email {
-		t.Logf("email wrong: expected \"%s\", got \"%s\"", email, user.Email)
-		t.Fail()
+	return stores
+}
+
+func TestGetUser(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	password := "password"
+
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		user, err := p.AddUser(email, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		id := user.GetId()
+		user, err = p.GetUser(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.Email != email {
+			t.Logf("email wrong: expected \"%s\", got \"%s\"", email, user.Email)
+			t.Fail()
+		}
 	}
 }
 
@@ -41,209 +72,696 @@ func TestGetUserByEmail(t *testing.T) {
 	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
 	password := "password"
 
-	p, err := New("localhost", "preflight-test")
-	if err != nil {
-		t.Fatal(err)
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		_, err := p.AddUser(email, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err := p.GetUserByEmail(email)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.Email != email {
+			t.Logf("email wrong: expected \"%s\", got \"%s\"", email, user.Email)
+			t.Fail()
+		}
 	}
-	_, err = p.AddUser(email, password)
-	if err != nil {
-		t.Fatal(err)
+}
+
+func TestGetUserByToken(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	password := "password"
+
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		user, pErr := p.AddUser(email, password)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+
+		permissions := security.PermissionFlags{ChecklistRead:true}
+		token, err := user.Security.AddToken(permissions, 24, "persistence test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pErr = p.UpdateUser(user)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+
+		user, pErr = p.GetUserByTokenId(token.Id)
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+		if user.Email != email {
+			t.Logf("email wrong: expected \"%s\", got \"%s\"", email, user.Email)
+			t.Fail()
+		}
+
+		_, secret := security.ParseToken(token.Secret)
+		user, pErr = p.GetUserByTokenHash(security.HashTokenSecret(secret))
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+		if user.Email != email {
+			t.Logf("email wrong: expected \"%s\", got \"%s\"", email, user.Email)
+			t.Fail()
+		}
+
+		_, pErr = p.GetUserByTokenHash(security.HashTokenSecret("wrong"))
+		if pErr == nil {
+			t.Log("test failure: expected error for wrong token hash, got nil")
+			t.Fail()
+		}
 	}
-	user, err := p.GetUserByEmail(email)
-	if err != nil {
-		t.Fatal(err)
+}
+
+func TestUpdateUser(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	emailBefore := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	emailAfter := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	password := "password"
+
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		user, err := p.AddUser(emailBefore, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Email = emailAfter
+		err = p.UpdateUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user, err = p.GetUser(user.GetId())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if user.Email != emailAfter {
+			t.Logf("email wrong: expected \"%s\", got \"%s\"", emailAfter, user.Email)
+			t.Fail()
+		}
 	}
+}
 
-	if user.Email != email {
-		t.Logf("email wrong: expected \"%s\", got \"%s\"", email, user.Email)
-		t.Fail()
+func TestDeleteUser(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	password := "password"
+
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		user, err := p.AddUser(email, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = p.DeleteUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = p.GetUser(user.GetId())
+		if err == nil {
+			t.Logf("user not deleted: expected error on GetUser, got nil")
+			t.Fail()
+		}
 	}
 }
 
-func TestGetUserByToken(t *testing.T) {
+func TestNoDuplicateEmails(t *testing.T) {
 	rand.Seed(time.Now().UnixNano())
 	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
 	password := "password"
 
-	p, pErr := New("localhost", "preflight-test")
-	if pErr != nil {
-		t.Fatal(pErr)
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		_, err := p.AddUser(email, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = p.AddUser(email, password)
+		if err == nil {
+			t.Log("test failure: expected error adding duplicate user, got nil")
+			t.Fail()
+		}
 	}
-	user, pErr := p.AddUser(email, password)
-	if pErr != nil {
-		t.Fatal(pErr)
+}
+
+func TestNode(t *testing.T) {
+	wrongSecret := "wrong"
+	capabilities := NodeCapabilities{
+		Permissions: security.PermissionFlags{ChecklistInvoke: true},
+	}
+	dir, goErr := ioutil.TempDir("", "preflight-test")
+	if goErr != nil {
+		t.Fatal(goErr)
 	}
+	secretFile := filepath.Join(dir, "secret")
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
 
-	permissions := security.PermissionFlags{ChecklistRead:true}
-	token, err := user.Security.AddToken(permissions, 24, "persistence test")
+		registered, err := p.RegisterNode(secretFile, capabilities)
+		if err != nil {
+			t.Fatal(err)
+		}
+		secret, err := GetNodeSecret(secretFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := p.GetNode(secret)
+		if err != nil {
+			t.Log("error getting node: " +
+				"\n\t" + err.Error())
+			t.Fail()
+		} else if node.Id != registered.Id || node.Capabilities != capabilities {
+			t.Logf("node wrong: expected %v, got %v", *registered, *node)
+			t.Fail()
+		}
+		_, err = p.GetNode(wrongSecret)
+		if err == nil {
+			t.Log("secret incorrectly validated: expected error, got nil")
+			t.Fail()
+		}
+
+		if len(secret) != security.SECRET_BITS/4 {
+			t.Logf("secret has wrong length: expected length %d, got %s",
+				security.SECRET_BITS/4, secret)
+			t.Fail()
+		}
+	}
+}
+
+func TestOAuthClient(t *testing.T) {
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		client, err := p.AddOAuthClient("test client", []string{"https://example.com/callback"})
+		if err != nil {
+			t.Fatal(err.Prepend("error adding client: "))
+		}
+		got, err := p.GetOAuthClient(client.Id)
+		if err != nil {
+			t.Fatal(err.Prepend("error getting client: "))
+		}
+		if got.Name != client.Name || len(got.RedirectUris) != 1 ||
+			got.RedirectUris[0] != client.RedirectUris[0] {
+			t.Logf("client wrong: expected %+v, got %+v", client, got)
+			t.Fail()
+		}
+		_, err = p.GetOAuthClient("missing")
+		if ! errors.Is(err, errors.ErrNotFound) {
+			t.Logf("test failure: expected not found getting missing client, got %v", err)
+			t.Fail()
+		}
+	}
+}
+
+func TestAuditEntry(t *testing.T) {
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		entry := &AuditEntry{
+			UserId: "user",
+			Actor: Actor{Type: ACTOR_NODE, Id: "node"},
+			Action: "POST /checklists/foo/invoke",
+		}
+		err := p.AddAuditEntry(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Id == "" || entry.Time.IsZero() {
+			t.Logf("entry not initialized: got %v", *entry)
+			t.Fail()
+		}
+	}
+}
+
+func TestLogging(t *testing.T) {
+	testDir := "/var/log/preflight/test/"
+	testFile := testDir + "foo/test.log"
+	testString := "test string"
+	err := os.RemoveAll(testDir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	pErr = p.UpdateUser(user)
+	s := ServerSettings{ErrLog: testFile, LogFormat: "json", LogLevel: "info"}
+
+	logger, pErr := s.GetLogger()
 	if pErr != nil {
+		pErr.Prepend("error getting logger: ")
 		t.Fatal(pErr)
 	}
+	defer logger.Close()
+	logger.Debug("hidden")
+	logger.Info(testString, "userId", "foo")
 
-	user, pErr = p.GetUserByToken(token.Secret)
-	if pErr != nil {
-		t.Fatal(pErr)
+	readBytes, err := ioutil.ReadFile(testFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	readString := string(readBytes)
+
+	if ! strings.Contains(readString, `"msg":"` + testString + `"`) ||
+		! strings.Contains(readString, `"userId":"foo"`) {
+		t.Logf("logged message incorrect: expected \"%s\" with user id, got \"%s\"",
+			testString, readString)
+		t.Fail()
+	}
+	if strings.Contains(readString, "hidden") {
+		t.Logf("test failure: message below log level was logged: \"%s\"", readString)
+		t.Fail()
 	}
 
-	if user.Email != email {
-		t.Logf("email wrong: expected \"%s\", got \"%s\"", email, user.Email)
+	s.LogFormat = "xml"
+	_, pErr = s.GetLogger()
+	if pErr == nil {
+		t.Log("test failure: expected error for unknown log format, got nil")
 		t.Fail()
 	}
 }
 
-func TestUpdateUser(t *testing.T) {
-	rand.Seed(time.Now().UnixNano())
-	emailBefore := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
-	emailAfter := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
-	password := "password"
-
-	p, err := New("localhost", "preflight-test")
+func TestLogRotation(t *testing.T) {
+	testDir := "/var/log/preflight/rotation-test/"
+	testFile := testDir + "test.log"
+	err := os.RemoveAll(testDir)
 	if err != nil {
 		t.Fatal(err)
 	}
-	user, err := p.AddUser(emailBefore, password)
+	err = os.MkdirAll(testDir, 0774)
 	if err != nil {
 		t.Fatal(err)
 	}
-	user.Email = emailAfter
-	err = p.UpdateUser(user)
+	err = ioutil.WriteFile(testFile, []byte("existing\n"), 0660)
 	if err != nil {
 		t.Fatal(err)
 	}
-	user, err = p.GetUser(user.GetId())
+
+	l, pErr := openLogFile(testFile, 20, 0, 2)
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error opening log file: "))
+	}
+	defer l.Close()
+	for _, line := range []string{"first\n", "second line\n", "third line\n", "fourth line\n"} {
+		_, err = l.Write([]byte(line))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	readBytes, err := ioutil.ReadFile(testFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	if user.Email != emailAfter {
-		t.Logf("email wrong: expected \"%s\", got \"%s\"", emailAfter, user.Email)
+	if string(readBytes) != "fourth line\n" {
+		t.Logf("test failure: expected current file \"fourth line\\n\", got \"%s\"", string(readBytes))
 		t.Fail()
 	}
-}
-
-func TestDeleteUser(t *testing.T) {
-	rand.Seed(time.Now().UnixNano())
-	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
-	password := "password"
-
-	p, err := New("localhost", "preflight-test")
+	rotated, err := filepath.Glob(testFile + ".*")
 	if err != nil {
 		t.Fatal(err)
 	}
-	user, err := p.AddUser(email, password)
+	if len(rotated) != 2 {
+		t.Fatalf("test failure: expected 2 rotated files, got %v", rotated)
+	}
+	readBytes, err = ioutil.ReadFile(rotated[0])
 	if err != nil {
 		t.Fatal(err)
 	}
+	if string(readBytes) != "second line\n" {
+		t.Logf("test failure: expected oldest kept file \"second line\\n\", got \"%s\"", string(readBytes))
+		t.Fail()
+	}
 
-	err = p.DeleteUser(user)
+	moved := testDir + "moved.log"
+	err = os.Rename(testFile, moved)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	_, err = p.GetUser(user.GetId())
-	if err == nil {
-		t.Logf("user not deleted: expected error on GetUser, got nil")
-		t.Fail()
+	pErr = l.Reopen()
+	if pErr != nil {
+		t.Fatal(pErr.Prepend("error reopening log file: "))
 	}
-}
-
-func TestNoDuplicateEmails(t *testing.T) {
-	rand.Seed(time.Now().UnixNano())
-	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
-	password := "password"
-
-	p, err := New("localhost", "preflight-test")
+	_, err = l.Write([]byte("fifth\n"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	_, err = p.AddUser(email, password)
+	readBytes, err = ioutil.ReadFile(testFile)
 	if err != nil {
 		t.Fatal(err)
 	}
-
-	_, err = p.AddUser(email, password)
-	if err == nil {
-		t.Log("test failure: expected error adding duplicate user, got nil")
+	if string(readBytes) != "fifth\n" {
+		t.Logf("test failure: expected reopened file \"fifth\\n\", got \"%s\"", string(readBytes))
 		t.Fail()
 	}
 }
 
-func TestNode(t *testing.T) {
-	wrongSecret := "wrong"
-	secretFile := "/etc/preflight/test/secret"
-	p, err := New("localhost", "preflight-test")
-	if err != nil {
-		t.Fatal(err)
+func TestLoadTokenKey(t *testing.T) {
+	dir, goErr := ioutil.TempDir("", "preflight-test")
+	if goErr != nil {
+		t.Fatal(goErr)
 	}
+	defer os.RemoveAll(dir)
+	settings := ServerSettings{TokenKeyFile: filepath.Join(dir, "keys", "token-key")}
 
-	err = p.RegisterNode(secretFile)
+	err := settings.LoadTokenKey()
 	if err != nil {
-		t.Fatal(err)
+		t.Fatal(err.Prepend("error generating key: "))
 	}
-	secret, err := p.GetNodeSecret(secretFile)
-	if err != nil {
-		t.Fatal(err)
+	first, goErr := ioutil.ReadFile(settings.TokenKeyFile)
+	if goErr != nil {
+		t.Fatal(goErr)
 	}
-
-	secretValid, err := p.ValidateNodeSecret(secret)
+	err = settings.LoadTokenKey()
 	if err != nil {
-		t.Log("error validating secret: " +
-			"\n\t" + err.Error())
+		t.Fatal(err.Prepend("error loading key: "))
+	}
+	second, goErr := ioutil.ReadFile(settings.TokenKeyFile)
+	if goErr != nil {
+		t.Fatal(goErr)
+	}
+	if len(first) != 2*security.TOKEN_KEY_BYTES || string(first) != string(second) {
+		t.Logf("key wrong: generated \"%s\", then \"%s\"", first, second)
 		t.Fail()
 	}
-	wrongSecretValid, err := p.ValidateNodeSecret(wrongSecret)
-	if err != nil {
-		t.Log("error validating secret: " +
-			"\n\t" + err.Error())
+	entries, goErr := ioutil.ReadDir(filepath.Dir(settings.TokenKeyFile))
+	if goErr != nil {
+		t.Fatal(goErr)
+	}
+	if len(entries) != 1 {
+		t.Logf("test failure: temporary files left beside key: %d entries", len(entries))
 		t.Fail()
 	}
 
-	if len(secret) != security.SECRET_BITS/4 {
-		t.Log("secret has wrong length: expected length %d, got %s",
-			security.SECRET_BITS/4, secret)
+	goErr = ioutil.WriteFile(settings.TokenKeyFile, []byte("\n"), 0600)
+	if goErr != nil {
+		t.Fatal(goErr)
+	}
+	if settings.LoadTokenKey() == nil {
+		t.Log("test failure: loaded empty key")
 		t.Fail()
 	}
-	if ! secretValid {
-		t.Log("secret incorrectly validated: expected true, got false")
+}
+
+func TestStringifyIds(t *testing.T) {
+	ids := []interface{}{123, int64(4567890123), float64(89), "abc"}
+	correctIds := []string{"123", "4567890123", "89", "abc"}
+
+	stringIds, changed := stringifyIds(ids)
+	if ! changed {
+		t.Log("test failure: expected changed, got unchanged")
 		t.Fail()
 	}
-	if wrongSecretValid {
-		t.Log("secret incorrectly validated: expected false, got true")
+	if len(stringIds) != len(correctIds) {
+		t.Fatalf("ids wrong: expected %v, got %v", correctIds, stringIds)
+	}
+	for i, id := range correctIds {
+		if stringIds[i] != id {
+			t.Logf("ids wrong: expected %v, got %v", correctIds, stringIds)
+			t.Fail()
+			break
+		}
+	}
+
+	_, changed = stringifyIds([]interface{}{"abc"})
+	if changed {
+		t.Log("test failure: expected unchanged, got changed")
 		t.Fail()
 	}
 }
 
-func TestLogging(t *testing.T) {
-	testDir := "/var/log/preflight/test/"
-	testFile := testDir + "foo/test.log"
-	testString := "test string"
-	err := os.RemoveAll(testDir)
-	if err != nil {
-		t.Fatal(err)
+func TestUpdateConflict(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	password := "password"
+
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		user, err := p.AddUser(email, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stale, err := p.GetUser(user.GetId())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		user.Settings.Timezone = "UTC"
+		err = p.UpdateUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.UpdateUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stale.Settings.TrelloBoard = "board"
+		err = p.UpdateUser(stale)
+		if err == nil || err.Status != 409 {
+			t.Logf("stale update: expected 409, got %v", err)
+			t.Fail()
+		}
+
+		user, err = p.GetUser(user.GetId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if user.Settings.Timezone != "UTC" || user.Settings.TrelloBoard != "" {
+			t.Logf("settings wrong: expected {UTC }, got %v", user.Settings)
+			t.Fail()
+		}
 	}
-	s := ServerSettings{ErrLog: testFile}
+}
 
-	logger, pErr := s.GetLogger()
-	if pErr != nil {
-		pErr.Prepend("error getting logger: ")
-		t.Fatal(pErr)
+func TestUpdateChecklistRecords(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+	password := "password"
+
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		user, err := p.AddUser(email, password)
+		if err != nil {
+			t.Fatal(err)
+		}
+		user.Checklists["foo"] = &checklist.Checklist{Tasks: []string{"a"}}
+		err = p.UpdateUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		records := map[string]*checklist.UpdateRecord{
+			"foo": &checklist.UpdateRecord{Ids: []string{"1"}},
+			"deleted": &checklist.UpdateRecord{Ids: []string{"2"}},
+		}
+		err = p.UpdateChecklistRecords(user.GetId(), records)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = p.UpdateUser(user)
+		if err == nil || err.Status != 409 {
+			t.Logf("stale update after record update: expected 409, got %v", err)
+			t.Fail()
+		}
+
+		user, err = p.GetUser(user.GetId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		record := user.Checklists["foo"].Record
+		if record == nil || len(record.Ids) != 1 || record.Ids[0] != "1" {
+			t.Logf("record wrong: expected ids [1], got %v", record)
+			t.Fail()
+		}
+		if _, found := user.Checklists["deleted"]; found {
+			t.Log("test failure: record created checklist \"deleted\"")
+			t.Fail()
+		}
+		if len(user.Checklists["foo"].Tasks) != 1 {
+			t.Logf("tasks wrong: expected [a], got %v", user.Checklists["foo"].Tasks)
+			t.Fail()
+		}
 	}
-	defer logger.Close()
-	logger.Println(testString)
+}
 
-	readBytes, err := ioutil.ReadFile(testFile)
+func TestRecordTokenUse(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		user, err := p.AddUser(email, "password")
+		if err != nil {
+			t.Fatal(err)
+		}
+		token, err := user.Security.AddToken(security.PermissionFlags{}, 1, "test", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.UpdateUser(user)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		last := time.Now().Truncate(time.Millisecond)
+		err = p.RecordTokenUse(user.GetId(), token.Id, 3, last, "10.0.0.1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.RecordTokenUse(user.GetId(), "missing", 1, last, "10.0.0.1")
+		if err != nil {
+			t.Logf("error recording use of missing token: %s", err.Error())
+			t.Fail()
+		}
+
+		stored, err := p.GetUser(user.GetId())
+		if err != nil {
+			t.Fatal(err)
+		}
+		used := stored.Security.Tokens[0]
+		if used.UseCount != 3 || ! used.LastUsed.Equal(last) || used.LastAddress != "10.0.0.1" {
+			t.Logf("usage wrong: expected 3 uses at %v from 10.0.0.1, got %+v", last, used)
+			t.Fail()
+		}
+
+		// recording a use does not make a concurrent update conflict
+		user.Settings.Timezone = "UTC"
+		err = p.UpdateUser(user)
+		if err != nil {
+			t.Logf("error updating user after recording token use: %s", err.Error())
+			t.Fail()
+		}
+	}
+}
+
+func TestGetAuditEntries(t *testing.T) {
+	start := time.Now().Truncate(time.Millisecond)
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		userId := fmt.Sprintf("user-%d", rand.Int())
+		for i := 0; i < 5; i++ {
+			err := p.AddAuditEntry(&AuditEntry{
+				Time: start.Add(time.Duration(i)*time.Second),
+				UserId: userId,
+				Actor: Actor{Type: ACTOR_PASSWORD},
+				Action: fmt.Sprintf("action %d", i),
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := p.AddAuditEntry(&AuditEntry{UserId: userId + "-other", Action: "other"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := p.GetAuditEntries(userId, time.Time{}, "", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 3 || entries[0].Action != "action 4" || entries[2].Action != "action 2" {
+			t.Logf("first page wrong: expected actions 4 to 2, got %v", entries)
+			t.Fail()
+			continue
+		}
+
+		entries, err = p.GetAuditEntries(userId, entries[2].Time, "", 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != 2 || entries[0].Action != "action 1" || entries[1].Action != "action 0" {
+			t.Logf("second page wrong: expected actions 1 to 0, got %v", entries)
+			t.Fail()
+		}
+
+		sameTimeId := userId + "-same-time"
+		for i := 0; i < 3; i++ {
+			err = p.AddAuditEntry(&AuditEntry{Time: start, UserId: sameTimeId, Action: "same"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		seen := make(map[string]bool)
+		before, beforeId := time.Time{}, ""
+		for page := 0; page < 3; page++ {
+			entries, err = p.GetAuditEntries(sameTimeId, before, beforeId, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 1 || seen[entries[0].Id] {
+				t.Logf("page %d wrong for entries at the same time: got %v", page, entries)
+				t.Fail()
+				break
+			}
+			seen[entries[0].Id] = true
+			before, beforeId = entries[0].Time, entries[0].Id
+		}
+	}
+}
+
+func TestErrorKinds(t *testing.T) {
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		_, err := p.GetUser("0123456789abcdef01234567")
+		if ! errors.Is(err, errors.ErrNotFound) || errors.Is(err, errors.ErrUpstream) {
+			t.Logf("test failure: expected not found getting missing user, got %v", err)
+			t.Fail()
+		}
+	}
+
+	dir, goErr := ioutil.TempDir("", "preflight-test")
+	if goErr != nil {
+		t.Fatal(goErr)
+	}
+	blocker := filepath.Join(dir, "file")
+	goErr = ioutil.WriteFile(blocker, []byte{}, 0600)
+	if goErr != nil {
+		t.Fatal(goErr)
+	}
+	_, err := NewBoltStore(filepath.Join(blocker, "sub", "test.db"))
+	if ! errors.Is(err, errors.ErrUpstream) || errors.Is(err, errors.ErrNotFound) {
+		t.Logf("test failure: expected upstream failure opening store, got %v", err)
+		t.Fail()
+	}
+	var pathErr *os.PathError
+	if ! errors.As(err, &pathErr) {
+		t.Logf("test failure: expected cause *os.PathError, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestPing(t *testing.T) {
+	for name, p := range testStores(t) {
+		t.Log("testing " + name)
+		err := p.Ping()
+		if err != nil {
+			t.Logf("error pinging %s: \n\t%s", name, err.Error())
+			t.Fail()
+		}
+	}
+
+	dir, goErr := ioutil.TempDir("", "preflight-test")
+	if goErr != nil {
+		t.Fatal(goErr)
+	}
+	p, err := NewBoltStore(filepath.Join(dir, "test.db"))
 	if err != nil {
 		t.Fatal(err)
 	}
-	readString := string(readBytes)
-
-	if ! strings.Contains(readString, testString) {
-		t.Logf("logged message incorrect: expected \"%s\", got \"%s\"",
-			testString, readString)
+	p.Close()
+	err = p.Ping()
+	if err == nil || err.Status != 503 {
+		t.Logf("test failure: expected 503 pinging closed store, got %v", err)
+		t.Fail()
+	}
+	if _, err = p.GetUser("0123456789abcdef01234567"); errors.Is(err, errors.ErrNotFound) {
+		t.Logf("test failure: expected failure other than not found on closed store, got %v", err)
 		t.Fail()
 	}
 }
@@ -0,0 +1,183 @@
+package ratelimit
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+/*
+ * entries untouched for this long are forgotten, so that the maps of keys do
+ * not grow without bound
+ */
+const FORGET_AFTER = time.Hour
+
+/*
+ * a token bucket per key, holding up to burst tokens and refilling at rate
+ * tokens per second; a rate of 0 allows everything
+ */
+type Limiter struct {
+	rate float64
+	burst float64
+
+	lock sync.Mutex
+	buckets map[string]*bucket
+	lastSweep time.Time
+	now func() time.Time
+}
+
+type bucket struct {
+	tokens float64
+	updated time.Time
+}
+
+func NewLimiter(rate float64, burst int) *Limiter {
+	return &Limiter{
+		rate: rate,
+		burst: float64(burst),
+		buckets: make(map[string]*bucket),
+		now: time.Now,
+	}
+}
+
+/*
+ * takes a token from key's bucket, or if it is empty, returns false and how
+ * long until it has one
+ */
+func (l *Limiter) Allow(key string) (bool, time.Duration) {
+	if l.rate <= 0 {
+		return true, 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	b, found := l.buckets[key]
+	if ! found {
+		b = &bucket{tokens: l.burst, updated: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens + now.Sub(b.updated).Seconds() * l.rate)
+	b.updated = now
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+		return false, wait
+	}
+	b.tokens--
+	return true, 0
+}
+
+func (l *Limiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < FORGET_AFTER {
+		return
+	}
+	for key, b := range l.buckets {
+		if now.Sub(b.updated) >= FORGET_AFTER {
+			delete(l.buckets, key)
+		}
+	}
+	l.lastSweep = now
+}
+
+/*
+ * locks a key out for duration once it has failed maxFailures times in a row,
+ * with no more than window between failures; a maxFailures of 0 never locks
+ */
+type Lockout struct {
+	maxFailures int
+	window time.Duration
+	duration time.Duration
+
+	lock sync.Mutex
+	records map[string]*failureRecord
+	lastSweep time.Time
+	now func() time.Time
+}
+
+type failureRecord struct {
+	failures int
+	last time.Time
+	lockedUntil time.Time
+}
+
+func NewLockout(maxFailures int, window, duration time.Duration) *Lockout {
+	return &Lockout{
+		maxFailures: maxFailures,
+		window: window,
+		duration: duration,
+		records: make(map[string]*failureRecord),
+		now: time.Now,
+	}
+}
+
+/*
+ * returns how much longer key is locked out, or 0 if it is not
+ */
+func (l *Lockout) Locked(key string) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	record, found := l.records[key]
+	if ! found {
+		return 0
+	}
+	remaining := record.lockedUntil.Sub(l.now())
+	if remaining < 0 {
+		return 0
+	}
+	return remaining
+}
+
+/*
+ * records a failure for key, and returns the length of the lockout if this
+ * failure started one, or 0 otherwise
+ */
+func (l *Lockout) Fail(key string) time.Duration {
+	if l.maxFailures <= 0 {
+		return 0
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := l.now()
+	l.sweep(now)
+	record, found := l.records[key]
+	if ! found || now.Sub(record.last) > l.window {
+		record = &failureRecord{}
+		l.records[key] = record
+	}
+	record.failures++
+	record.last = now
+	if record.failures < l.maxFailures {
+		return 0
+	}
+	record.failures = 0
+	record.lockedUntil = now.Add(l.duration)
+	return l.duration
+}
+
+/*
+ * clears key's failures, unless it is locked out
+ */
+func (l *Lockout) Succeed(key string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	record, found := l.records[key]
+	if found && ! record.lockedUntil.After(l.now()) {
+		delete(l.records, key)
+	}
+}
+
+func (l *Lockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < FORGET_AFTER {
+		return
+	}
+	for key, record := range l.records {
+		if now.Sub(record.last) >= FORGET_AFTER && ! record.lockedUntil.After(now) {
+			delete(l.records, key)
+		}
+	}
+	l.lastSweep = now
+}
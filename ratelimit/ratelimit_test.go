@@ -0,0 +1,92 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+type testClock struct {
+	t time.Time
+}
+
+func (c *testClock) now() time.Time {
+	return c.t
+}
+
+func TestLimiter(t *testing.T) {
+	clock := &testClock{t: time.Unix(1000000, 0)}
+	l := NewLimiter(0.5, 2)
+	l.now = clock.now
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); ! ok {
+			t.Fatalf("test failure: request %d within burst refused", i)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("test failure: request beyond burst allowed")
+	}
+	if wait != 2 * time.Second {
+		t.Logf("wait wrong: expected 2s, got %v", wait)
+		t.Fail()
+	}
+	if ok, _ := l.Allow("b"); ! ok {
+		t.Log("test failure: other key refused")
+		t.Fail()
+	}
+
+	clock.t = clock.t.Add(2 * time.Second)
+	if ok, _ := l.Allow("a"); ! ok {
+		t.Log("test failure: request refused after refill")
+		t.Fail()
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Log("test failure: request allowed beyond refill")
+		t.Fail()
+	}
+}
+
+func TestLockout(t *testing.T) {
+	clock := &testClock{t: time.Unix(1000000, 0)}
+	l := NewLockout(3, time.Minute, 10 * time.Minute)
+	l.now = clock.now
+
+	l.Fail("a")
+	l.Fail("a")
+	l.Succeed("a")
+	l.Fail("a")
+	if d := l.Fail("a"); d != 0 {
+		t.Fatalf("test failure: locked out after failures were cleared, for %v", d)
+	}
+
+	clock.t = clock.t.Add(2 * time.Minute)
+	if d := l.Fail("a"); d != 0 {
+		t.Fatalf("test failure: locked out counting failures outside window, for %v", d)
+	}
+	l.Fail("a")
+	if d := l.Fail("a"); d != 10 * time.Minute {
+		t.Fatalf("lockout wrong: expected 10m, got %v", d)
+	}
+
+	clock.t = clock.t.Add(time.Minute)
+	if d := l.Locked("a"); d != 9 * time.Minute {
+		t.Logf("remaining lockout wrong: expected 9m, got %v", d)
+		t.Fail()
+	}
+	if d := l.Locked("b"); d != 0 {
+		t.Logf("test failure: other key locked out for %v", d)
+		t.Fail()
+	}
+	l.Succeed("a")
+	if d := l.Locked("a"); d == 0 {
+		t.Log("test failure: success ended lockout")
+		t.Fail()
+	}
+
+	clock.t = clock.t.Add(9 * time.Minute)
+	if d := l.Locked("a"); d != 0 {
+		t.Logf("test failure: still locked out after lockout ended, for %v", d)
+		t.Fail()
+	}
+}
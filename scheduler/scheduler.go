@@ -0,0 +1,244 @@
+package scheduler
+
+import (
+	"github.com/jsutton9/preflight/api/errors"
+	"github.com/jsutton9/preflight/commands"
+	"github.com/jsutton9/preflight/metrics"
+	"github.com/jsutton9/preflight/persistence"
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	RETRY_DELAY = time.Second
+	DEFAULT_INTERVAL = 5*time.Minute
+)
+
+type Scheduler struct {
+	persister persistence.Store
+	logger *slog.Logger
+	trelloKey string
+	jitter time.Duration
+	interval time.Duration
+
+	mutex sync.Mutex
+	due map[string]time.Time
+	running map[string]bool
+	lastScan time.Time
+	started bool
+	stopped bool
+
+	slots chan struct{}
+	wake chan struct{}
+	stop chan struct{}
+	done chan struct{}
+	workers sync.WaitGroup
+}
+
+func New(settings *persistence.ServerSettings, persister persistence.Store, logger *slog.Logger) *Scheduler {
+	workers := settings.SchedulerWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	interval := time.Duration(settings.SchedulerInterval)*time.Second
+	if interval <= 0 {
+		interval = DEFAULT_INTERVAL
+	}
+
+	return &Scheduler{
+		persister: persister,
+		logger: logger,
+		trelloKey: settings.TrelloAppKey,
+		jitter: time.Duration(settings.SchedulerJitter)*time.Second,
+		interval: interval,
+		due: make(map[string]time.Time),
+		running: make(map[string]bool),
+		slots: make(chan struct{}, workers),
+		wake: make(chan struct{}, 1),
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+}
+
+/*
+ * runs updates as they come due until Stop is called; if Stop has already
+ * been called, returns at once
+ */
+func (s *Scheduler) Run() {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return
+	}
+	s.started = true
+	s.mutex.Unlock()
+
+	rand.Seed(time.Now().UnixNano())
+	wait := time.Duration(0)
+	for {
+		timer := time.NewTimer(wait)
+		select {
+		case <-s.stop:
+			timer.Stop()
+			s.workers.Wait()
+			close(s.done)
+			return
+		case <-timer.C:
+		case <-s.wake:
+			timer.Stop()
+		}
+
+		wait = s.dispatch()
+	}
+}
+
+/*
+ * stops scheduling new updates and waits for running updates to finish; it
+ * may be called before Run, e.g. on a signal during startup
+ */
+func (s *Scheduler) Stop() {
+	s.mutex.Lock()
+	if s.stopped {
+		s.mutex.Unlock()
+		return
+	}
+	s.stopped = true
+	started := s.started
+	s.mutex.Unlock()
+
+	close(s.stop)
+	if started {
+		<-s.done
+	}
+}
+
+func (s *Scheduler) dispatch() time.Duration {
+	now := time.Now()
+	if now.Sub(s.lastScan) >= s.interval {
+		s.scan()
+		s.lastScan = now
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	wait := s.lastScan.Add(s.interval).Sub(now)
+	for id, t := range s.due {
+		if t.After(now) {
+			if t.Sub(now) < wait {
+				wait = t.Sub(now)
+			}
+			continue
+		}
+
+		select {
+		case s.slots <- struct{}{}:
+			metrics.ObserveSchedulerLag(now.Sub(t))
+			delete(s.due, id)
+			s.running[id] = true
+			s.workers.Add(1)
+			go s.update(id)
+		default:
+			if RETRY_DELAY < wait {
+				wait = RETRY_DELAY
+			}
+		}
+	}
+
+	return wait
+}
+
+func (s *Scheduler) scan() {
+	ids, err := s.persister.GetUserIds()
+	if err != nil {
+		s.logger.Error("error getting user ids", "error", err.Prepend("scheduler.Scheduler.scan: "))
+		return
+	}
+
+	due := make(map[string]time.Time)
+	listed := make(map[string]bool)
+	scanned := make(map[string]bool)
+	for _, id := range ids {
+		listed[id] = true
+		s.mutex.Lock()
+		running := s.running[id]
+		s.mutex.Unlock()
+		if running {
+			continue
+		}
+
+		scanned[id] = true
+		err := commands.SweepTokens(id, persistence.Actor{Type: persistence.ACTOR_SCHEDULER}, s.persister)
+		if err != nil && ! errors.Is(err, errors.ErrNotFound) {
+			// retried at the next scan
+			s.logger.Warn("error sweeping tokens", "userId", id,
+				"error", err.Prepend("scheduler.Scheduler.scan: "))
+		}
+		next, err := s.next(id, s.persister)
+		if errors.Is(err, errors.ErrNotFound) {
+			// deleted since the ids were listed
+			continue
+		} else if err != nil {
+			s.logger.Error("error scheduling user", "userId", id,
+				"error", err.Prepend("scheduler.Scheduler.scan: "))
+		} else if ! next.IsZero() {
+			due[id] = next
+		}
+	}
+
+	// keep times set by updates which finished during the scan
+	s.mutex.Lock()
+	for id, t := range s.due {
+		if listed[id] && ! scanned[id] {
+			due[id] = t
+		}
+	}
+	s.due = due
+	s.mutex.Unlock()
+}
+
+func (s *Scheduler) update(id string) {
+	defer s.workers.Done()
+	persister := s.persister.Copy()
+	defer persister.Close()
+
+	// on failure, the user is retried at the next scan
+	var next time.Time
+	logger := s.logger.With("userId", id)
+	err := commands.Update(id, s.trelloKey, logger, persister)
+	if err != nil {
+		logger.Error("error updating user", "error", err.Prepend("scheduler.Scheduler.update: "))
+	} else {
+		next, err = s.next(id, persister)
+		if err != nil {
+			logger.Error("error scheduling user", "error", err.Prepend("scheduler.Scheduler.update: "))
+		}
+	}
+
+	s.mutex.Lock()
+	delete(s.running, id)
+	if ! next.IsZero() {
+		s.due[id] = next
+	}
+	s.mutex.Unlock()
+	<-s.slots
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Scheduler) next(id string, persister persistence.Store) (time.Time, *errors.PreflightError) {
+	next, err := commands.NextUpdate(id, persister)
+	if err != nil || next.IsZero() {
+		return next, err
+	}
+	if s.jitter > 0 {
+		next = next.Add(time.Duration(rand.Int63n(int64(s.jitter))))
+	}
+
+	return next, nil
+}
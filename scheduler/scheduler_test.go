@@ -0,0 +1,91 @@
+package scheduler
+
+import (
+	"fmt"
+	"github.com/jsutton9/preflight/checklist"
+	"github.com/jsutton9/preflight/persistence"
+	"log/slog"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestScheduler(t *testing.T) {
+	rand.Seed(time.Now().UnixNano())
+	email := fmt.Sprintf("testuser-%d@preflight.com", rand.Int())
+
+	p := persistence.NewMemoryStore()
+	defer p.Close()
+	user, pErr := p.AddUser(email, "password")
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+	defer p.DeleteUser(user)
+
+	user.Settings.Timezone = "UTC"
+	user.Checklists["foo"] = &checklist.Checklist{
+		TasksSource: "preflight",
+		TasksTarget: "todoist",
+		IsScheduled: true,
+		Tasks: []string{},
+		Schedule: &checklist.Schedule{Start: "00:00"},
+	}
+	pErr = p.UpdateUser(user)
+	if pErr != nil {
+		t.Fatal(pErr)
+	}
+
+	settings := &persistence.ServerSettings{
+		SchedulerWorkers: 2,
+		SchedulerJitter: 0,
+		SchedulerInterval: 60,
+	}
+	s := New(settings, p, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+	go s.Run()
+
+	updated := false
+	for i := 0; i < 50 && ! updated; i++ {
+		time.Sleep(100*time.Millisecond)
+		user, pErr = p.GetUser(user.GetId())
+		if pErr != nil {
+			t.Fatal(pErr)
+		}
+		record := user.Checklists["foo"].Record
+		updated = record != nil && ! record.Time.IsZero()
+	}
+	s.Stop()
+
+	if ! updated {
+		t.Log("test failure: scheduled checklist was not updated")
+		t.Fail()
+	}
+}
+
+func TestStopBeforeRun(t *testing.T) {
+	p := persistence.NewMemoryStore()
+	defer p.Close()
+	s := New(&persistence.ServerSettings{}, p, slog.New(slog.NewTextHandler(os.Stderr, nil)))
+
+	stopped := make(chan struct{})
+	go func() {
+		s.Stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(5*time.Second):
+		t.Fatal("test failure: Stop blocked when Run was never called")
+	}
+
+	ran := make(chan struct{})
+	go func() {
+		s.Run()
+		close(ran)
+	}()
+	select {
+	case <-ran:
+	case <-time.After(5*time.Second):
+		t.Fatal("test failure: Run did not return after Stop")
+	}
+}
@@ -0,0 +1,297 @@
+package security
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"github.com/jsutton9/preflight/api/errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+/*
+ * the OAuth2 scopes a client may request, and the permission each grants
+ */
+const (
+	SCOPE_CHECKLIST_READ = "checklist:read"
+	SCOPE_CHECKLIST_WRITE = "checklist:write"
+	SCOPE_CHECKLIST_INVOKE = "checklist:invoke"
+	SCOPE_GENERAL_READ = "general:read"
+	SCOPE_GENERAL_WRITE = "general:write"
+)
+
+/*
+ * an authorization code, issued when the user consents and exchanged by the
+ * client for tokens; Challenge is the PKCE code challenge, which the
+ * client's verifier must hash to
+ */
+type OAuthCode struct {
+	Id string
+	Hash string
+	ClientId string
+	RedirectUri string
+	Challenge string
+	Permissions PermissionFlags
+	Expiry time.Time
+}
+
+/*
+ * a refresh token, with which a client replaces its access token, named by
+ * AccessTokenId, without the user; each is used once and replaced
+ */
+type RefreshToken struct {
+	Id string
+	Hash string
+	ClientId string
+	Permissions PermissionFlags
+	AccessTokenId string
+	Expiry time.Time
+}
+
+/*
+ * returns the permissions granted by a space-separated list of scopes
+ */
+func ParseScopes(scope string) (PermissionFlags, *errors.PreflightError) {
+	permissions := PermissionFlags{}
+	for _, s := range strings.Fields(scope) {
+		switch s {
+		case SCOPE_CHECKLIST_READ:
+			permissions.ChecklistRead = true
+		case SCOPE_CHECKLIST_WRITE:
+			permissions.ChecklistWrite = true
+		case SCOPE_CHECKLIST_INVOKE:
+			permissions.ChecklistInvoke = true
+		case SCOPE_GENERAL_READ:
+			permissions.GeneralRead = true
+		case SCOPE_GENERAL_WRITE:
+			permissions.GeneralWrite = true
+		default:
+			return PermissionFlags{}, &errors.PreflightError{
+				Status: 400,
+				Code: errors.CODE_INVALID_SCOPE,
+				InternalMessage: "security.ParseScopes: unknown scope \"" + s + "\"",
+				ExternalMessage: "Scope \"" + s + "\" is not recognized.",
+			}
+		}
+	}
+	if permissions == (PermissionFlags{}) {
+		return PermissionFlags{}, &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_SCOPE,
+			InternalMessage: "security.ParseScopes: no scope requested",
+			ExternalMessage: "At least one scope is required.",
+		}
+	}
+	return permissions, nil
+}
+
+/*
+ * returns the space-separated list of scopes granting p
+ */
+func (p PermissionFlags) Scope() string {
+	scopes := make([]string, 0)
+	if p.ChecklistRead {
+		scopes = append(scopes, SCOPE_CHECKLIST_READ)
+	}
+	if p.ChecklistWrite {
+		scopes = append(scopes, SCOPE_CHECKLIST_WRITE)
+	}
+	if p.ChecklistInvoke {
+		scopes = append(scopes, SCOPE_CHECKLIST_INVOKE)
+	}
+	if p.GeneralRead {
+		scopes = append(scopes, SCOPE_GENERAL_READ)
+	}
+	if p.GeneralWrite {
+		scopes = append(scopes, SCOPE_GENERAL_WRITE)
+	}
+	sort.Strings(scopes)
+	return strings.Join(scopes, " ")
+}
+
+/*
+ * returns the PKCE S256 challenge for a code verifier
+ */
+func PKCEChallenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+/*
+ * issues an authorization code for the client, valid for validFor, and
+ * returns it as presented to the client
+ */
+func (s *SecurityInfo) IssueOAuthCode(clientId, redirectUri, challenge string, permissions PermissionFlags, validFor time.Duration) (string, *errors.PreflightError) {
+	id, err := GenerateId()
+	if err != nil {
+		return "", err.Prepend("security.IssueOAuthCode: error generating id: ")
+	}
+	secret, err := generateSecret()
+	if err != nil {
+		return "", err.Prepend("security.IssueOAuthCode: error generating secret: ")
+	}
+
+	s.sweepOAuth(time.Now())
+	s.OAuthCodes = append(s.OAuthCodes, OAuthCode{
+		Id: id,
+		Hash: HashTokenSecret(secret),
+		ClientId: clientId,
+		RedirectUri: redirectUri,
+		Challenge: challenge,
+		Permissions: permissions,
+		Expiry: time.Now().Add(validFor),
+	})
+	return id + secret, nil
+}
+
+/*
+ * checks an authorization code presented by a client, with the redirect URI
+ * it was issued for and the PKCE verifier, and uses it up; a code presented
+ * wrongly is also used up, since it may have been intercepted
+ */
+func (s *SecurityInfo) UseOAuthCode(presented, clientId, redirectUri, verifier string) (*OAuthCode, *errors.PreflightError) {
+	id, secret := ParseToken(presented)
+	hash := []byte(HashTokenSecret(secret))
+	var code *OAuthCode
+	for i, c := range s.OAuthCodes {
+		if id != "" && c.Id == id && hmac.Equal(hash, []byte(c.Hash)) {
+			code = &c
+			s.OAuthCodes = append(s.OAuthCodes[:i], s.OAuthCodes[i+1:]...)
+			break
+		}
+	}
+
+	invalid := func(message string) *errors.PreflightError {
+		return &errors.PreflightError{
+			Status: 400,
+			Code: errors.CODE_INVALID_GRANT,
+			InternalMessage: "security.UseOAuthCode: " + message,
+			ExternalMessage: "The authorization code is invalid.",
+		}
+	}
+	if code == nil {
+		return nil, invalid("code not found")
+	} else if time.Now().After(code.Expiry) {
+		return nil, invalid("code expired")
+	} else if code.ClientId != clientId {
+		return nil, invalid("code issued to client \"" + code.ClientId + "\", presented by \"" + clientId + "\"")
+	} else if code.RedirectUri != redirectUri {
+		return nil, invalid("redirect uri \"" + redirectUri + "\" does not match")
+	} else if ! hmac.Equal([]byte(PKCEChallenge(verifier)), []byte(code.Challenge)) {
+		return nil, invalid("code verifier does not match challenge")
+	}
+	return code, nil
+}
+
+/*
+ * issues a refresh token for the client's access token, valid for validFor,
+ * and returns it as presented to the client
+ */
+func (s *SecurityInfo) IssueRefreshToken(clientId string, permissions PermissionFlags, accessTokenId string, validFor time.Duration) (string, *errors.PreflightError) {
+	id, err := GenerateId()
+	if err != nil {
+		return "", err.Prepend("security.IssueRefreshToken: error generating id: ")
+	}
+	secret, err := generateSecret()
+	if err != nil {
+		return "", err.Prepend("security.IssueRefreshToken: error generating secret: ")
+	}
+
+	s.RefreshTokens = append(s.RefreshTokens, RefreshToken{
+		Id: id,
+		Hash: HashTokenSecret(secret),
+		ClientId: clientId,
+		Permissions: permissions,
+		AccessTokenId: accessTokenId,
+		Expiry: time.Now().Add(validFor),
+	})
+	return id + secret, nil
+}
+
+/*
+ * checks a refresh token presented by a client and uses it up
+ */
+func (s *SecurityInfo) UseRefreshToken(presented, clientId string) (*RefreshToken, *errors.PreflightError) {
+	id, secret := ParseToken(presented)
+	hash := []byte(HashTokenSecret(secret))
+	for i, r := range s.RefreshTokens {
+		if id == "" || r.Id != id || ! hmac.Equal(hash, []byte(r.Hash)) {
+			continue
+		}
+		s.RefreshTokens = append(s.RefreshTokens[:i], s.RefreshTokens[i+1:]...)
+		if time.Now().After(r.Expiry) || r.ClientId != clientId {
+			break
+		}
+		return &r, nil
+	}
+
+	return nil, &errors.PreflightError{
+		Status: 400,
+		Code: errors.CODE_INVALID_GRANT,
+		InternalMessage: "security.UseRefreshToken: refresh token not found, expired or issued to another client",
+		ExternalMessage: "The refresh token is invalid.",
+	}
+}
+
+/*
+ * adds an access token for an OAuth2 client
+ */
+func (s *SecurityInfo) AddClientToken(clientId string, permissions PermissionFlags, expiryHours int, description string) (*Token, *errors.PreflightError) {
+	token, err := s.AddToken(permissions, expiryHours, description, nil)
+	if err != nil {
+		return nil, err.Prepend("security.AddClientToken: ")
+	}
+	s.Tokens[len(s.Tokens)-1].ClientId = clientId
+	token.ClientId = clientId
+	return token, nil
+}
+
+/*
+ * removes the refresh tokens for the given access tokens, so that a revoked
+ * access token can't be replaced
+ */
+func (s *SecurityInfo) DropRefreshTokens(accessTokenIds []string) {
+	if len(s.RefreshTokens) == 0 {
+		return
+	}
+	dropped := make(map[string]bool)
+	for _, id := range accessTokenIds {
+		dropped[id] = true
+	}
+	kept := make([]RefreshToken, 0, len(s.RefreshTokens))
+	for _, r := range s.RefreshTokens {
+		if ! dropped[r.AccessTokenId] {
+			kept = append(kept, r)
+		}
+	}
+	s.RefreshTokens = kept
+}
+
+/*
+ * removes expired codes and refresh tokens, returning whether any were
+ */
+func (s *SecurityInfo) sweepOAuth(now time.Time) bool {
+	changed := false
+	codes := make([]OAuthCode, 0, len(s.OAuthCodes))
+	for _, code := range s.OAuthCodes {
+		if now.After(code.Expiry) {
+			changed = true
+		} else {
+			codes = append(codes, code)
+		}
+	}
+	refreshTokens := make([]RefreshToken, 0, len(s.RefreshTokens))
+	for _, r := range s.RefreshTokens {
+		if now.After(r.Expiry) {
+			changed = true
+		} else {
+			refreshTokens = append(refreshTokens, r)
+		}
+	}
+	if changed {
+		s.OAuthCodes = codes
+		s.RefreshTokens = refreshTokens
+	}
+	return changed
+}
@@ -1,34 +1,75 @@
 package security
 
 import (
+	"crypto/hmac"
 	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/jsutton9/preflight/api/errors"
 	"github.com/jsutton9/preflight/clients/todoist"
 	"github.com/jsutton9/preflight/clients/trello"
 	"golang.org/x/crypto/bcrypt"
 	"math/big"
+	"path"
+	"strings"
 	"time"
 )
 
 const (
 	ID_BITS = 64
 	SECRET_BITS = 64
+	TOKEN_KEY_BYTES = 32
 )
 
+/*
+ * passed to AddToken as expiryHours for a token which never expires
+ */
+const NO_EXPIRY = -1
+
 type SecurityInfo struct {
 	PasswordHash []byte      `json:"-"`
+	PasswordReset *ResetToken `json:"-" bson:"passwordReset,omitempty"`
+	OAuthCodes []OAuthCode   `json:"-" bson:"oauthCodes,omitempty"`
+	RefreshTokens []RefreshToken `json:"-" bson:"refreshTokens,omitempty"`
 	Tokens []Token           `json:"tokens"`
 	Todoist todoist.Security `json:"todoistSecurity"`
 	Trello trello.Security   `json:"trelloSecurity"`
 }
 
+/*
+ * Only Hash, a keyed hash of the secret, is stored. Secret is set only on the
+ * token returned by AddToken or RotateToken, and is the token id followed by
+ * the secret proper, so that the token can be found by its id. After
+ * rotation, the old secret's hash is kept as PreviousHash, and is accepted
+ * until PreviousExpiry. Expiry is ignored if NoExpiry is set.
+ */
 type Token struct {
 	Id string                   `json:"id"`
-	Secret string               `json:"secret,omitempty"`
+	Secret string               `json:"secret,omitempty" bson:"secret,omitempty"`
+	Hash string                 `json:"-"`
+	PreviousHash string         `json:"-" bson:"previousHash,omitempty"`
+	PreviousExpiry time.Time    `json:"-" bson:"previousExpiry,omitempty"`
 	Permissions PermissionFlags `json:"permissions"`
 	Expiry time.Time            `json:"expiry"`
+	NoExpiry bool               `json:"noExpiry,omitempty" bson:"noExpiry,omitempty"`
 	Description string          `json:"description"`
+	Checklists []string         `json:"checklists,omitempty"`
+	ClientId string             `json:"clientId,omitempty" bson:"clientId,omitempty"`
+	LastUsed time.Time          `json:"lastUsed,omitzero" bson:"lastUsed,omitempty"`
+	LastAddress string          `json:"lastAddress,omitempty" bson:"lastAddress,omitempty"`
+	UseCount int                `json:"useCount"`
+}
+
+/*
+ * a single-use token with which the user may set a new password without the
+ * old one; as with Token, only a keyed hash of the secret is stored, and the
+ * token is presented as its id followed by its secret
+ */
+type ResetToken struct {
+	Id string
+	Hash string
+	Expiry time.Time
 }
 
 type PermissionFlags struct {
@@ -39,6 +80,44 @@ type PermissionFlags struct {
 	GeneralWrite bool    `json:"generalWrite"`
 }
 
+var tokenKey []byte
+
+/*
+ * sets the key with which token secrets are hashed, which must be the same
+ * on every node
+ */
+func SetTokenKey(key []byte) {
+	tokenKey = key
+}
+
+func HashTokenSecret(secret string) string {
+	mac := hmac.New(sha256.New, tokenKey)
+	mac.Write([]byte(secret))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/*
+ * splits a token presented by a client into its id and secret; tokens
+ * issued before secrets were hashed have no id, and id is returned empty
+ */
+func ParseToken(presented string) (string, string) {
+	if len(presented) == (ID_BITS+SECRET_BITS)/4 {
+		return presented[:ID_BITS/4], presented[ID_BITS/4:]
+	}
+	return "", presented
+}
+
+/*
+ * returns whether p includes every permission in required
+ */
+func (p PermissionFlags) Allows(required PermissionFlags) bool {
+	return ! (required.ChecklistRead && (! p.ChecklistRead) ||
+		required.ChecklistWrite && (! p.ChecklistWrite) ||
+		required.ChecklistInvoke && (! p.ChecklistInvoke) ||
+		required.GeneralRead && (! p.GeneralRead) ||
+		required.GeneralWrite && (! p.GeneralWrite))
+}
+
 func New(password string) (*SecurityInfo, *errors.PreflightError) {
 	sec := SecurityInfo{}
 	err := sec.SetPassword(password)
@@ -53,6 +132,8 @@ func (s *SecurityInfo) ValidatePassword(password string) *errors.PreflightError
 	if err != nil {
 		return &errors.PreflightError{
 			Status: 401,
+			Code: errors.CODE_PASSWORD_INVALID,
+			Cause: err,
 			InternalMessage: "security.ValidatePassword: error validating password: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "Invalid password",
@@ -67,6 +148,7 @@ func (s *SecurityInfo) SetPassword(newPassword string) *errors.PreflightError {
 	if err != nil {
 		return &errors.PreflightError{
 			Status: 500,
+			Cause: err,
 			InternalMessage: "security.SetPassword: error hashing password: " +
 				"\n\t" + err.Error(),
 			ExternalMessage: "There was an error setting the password.",
@@ -77,84 +159,214 @@ func (s *SecurityInfo) SetPassword(newPassword string) *errors.PreflightError {
 	return nil
 }
 
-func (s *SecurityInfo) ValidateToken(secret string, permissions PermissionFlags) *errors.PreflightError {
-	for _, token := range s.Tokens {
-		if token.Secret == secret {
-			now := time.Now()
-			if now.After(token.Expiry) {
-				return &errors.PreflightError{
-					Status: 401,
-					InternalMessage: "security.ValidateToken: token expired",
-					ExternalMessage: "The user token is expired.",
-				}
-			}
-			if permissions.ChecklistRead && (! token.Permissions.ChecklistRead) ||
-				permissions.ChecklistWrite && (! token.Permissions.ChecklistWrite) ||
-				permissions.ChecklistInvoke && (! token.Permissions.ChecklistInvoke) ||
-				permissions.GeneralRead && (! token.Permissions.GeneralRead) ||
-				permissions.GeneralWrite && (! token.Permissions.GeneralWrite) {
-					return &errors.PreflightError{
-						Status: 401,
-						InternalMessage: "security.ValidateToken: " +
-							"insufficient permissions",
-						ExternalMessage: "The user token does not have sufficient permissions.",
-					}
-				}
-			return nil
+/*
+ * checks that the token has permissions; checklist names the checklist the
+ * request acts on, which must be in the token's scope if the token is limited
+ * to certain checklists and any checklist permission is required
+ */
+func (s *SecurityInfo) ValidateToken(presented string, permissions PermissionFlags, checklist string) *errors.PreflightError {
+	token := s.FindToken(presented)
+	if token == nil {
+		return &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_TOKEN_INVALID,
+			InternalMessage: "security.ValidateToken: token not found",
+			ExternalMessage: "The user token was absent or not recognized.",
 		}
 	}
 
-	return &errors.PreflightError{
-		Status: 401,
-		InternalMessage: "security.ValidateToken: token not found",
-		ExternalMessage: "The user token was absent or not recognized.",
+	if token.Expired(time.Now()) {
+		return &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_TOKEN_EXPIRED,
+			InternalMessage: "security.ValidateToken: token expired",
+			ExternalMessage: "The user token is expired.",
+		}
+	}
+	if ! token.Permissions.Allows(permissions) {
+		return &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_INSUFFICIENT_PERMISSIONS,
+			InternalMessage: "security.ValidateToken: " +
+				"insufficient permissions",
+			ExternalMessage: "The user token does not have sufficient permissions.",
+		}
 	}
+	if (permissions.ChecklistRead || permissions.ChecklistWrite || permissions.ChecklistInvoke) &&
+		! token.InScope(checklist) {
+		return &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_TOKEN_SCOPE,
+			InternalMessage: "security.ValidateToken: " +
+				"checklist \"" + checklist + "\" not in token scope",
+			ExternalMessage: "The user token is not permitted to access this checklist.",
+		}
+	}
+
+	return nil
 }
 
-func (s *SecurityInfo) AddToken(permissions PermissionFlags, expiryHours int, description string) (*Token, *errors.PreflightError) {
+/*
+ * returns the token matching a token presented by a client, comparing
+ * hashes in constant time, or nil if there is none; a secret replaced by
+ * rotation matches until its grace period ends
+ */
+func (s *SecurityInfo) FindToken(presented string) *Token {
+	id, secret := ParseToken(presented)
+	hash := []byte(HashTokenSecret(secret))
 	now := time.Now()
-	dur := time.Duration(expiryHours)*time.Hour
-	expiry := now.Add(dur)
+	for i, token := range s.Tokens {
+		if id != "" && token.Id != id {
+			continue
+		}
+		if hmac.Equal(hash, []byte(token.Hash)) {
+			return &s.Tokens[i]
+		}
+		if token.PreviousHash != "" && now.Before(token.PreviousExpiry) &&
+			hmac.Equal(hash, []byte(token.PreviousHash)) {
+			return &s.Tokens[i]
+		}
+	}
+	return nil
+}
 
-	idMax := big.NewInt(0).Exp(big.NewInt(2), big.NewInt(ID_BITS), nil)
-	intId, err := rand.Int(rand.Reader, idMax)
-	if err != nil {
-		return nil, &errors.PreflightError{
-			Status: 500,
-			InternalMessage: "security.AddToken: error generating id: " +
-				"\n\t" + err.Error(),
-			ExternalMessage: "There was an error creating the token.",
+/*
+ * adds uses of the token, the last at time last from address
+ */
+func (t *Token) RecordUse(count int, last time.Time, address string) {
+	t.UseCount += count
+	if last.After(t.LastUsed) {
+		t.LastUsed = last
+		t.LastAddress = address
+	}
+}
+
+func (t Token) Expired(now time.Time) bool {
+	return ! t.NoExpiry && now.After(t.Expiry)
+}
+
+/*
+ * returns whether the token may act on the named checklist; a token with no
+ * checklists may act on any, but a token limited to certain checklists may not
+ * act on all checklists at once, which is requested with an empty name
+ */
+func (t Token) InScope(checklist string) bool {
+	if len(t.Checklists) == 0 {
+		return true
+	} else if checklist == "" {
+		return false
+	}
+	for _, pattern := range t.Checklists {
+		matched, err := path.Match(pattern, checklist)
+		if err == nil && matched {
+			return true
 		}
 	}
-	idPattern := fmt.Sprintf("%%0%dx", ID_BITS/4)
-	id := fmt.Sprintf(idPattern, intId)
+	return false
+}
 
-	secretMax := big.NewInt(0).Exp(big.NewInt(2), big.NewInt(SECRET_BITS), nil)
-	intSecret, err := rand.Int(rand.Reader, secretMax)
-	if err != nil {
+/*
+ * returns whether the token has every permission and checklist of the other,
+ * so that acting on the other grants it nothing it lacks; a pattern of the
+ * other is covered only by the same pattern, or by a pattern matching it if
+ * it names a single checklist
+ */
+func (t Token) Covers(other Token) bool {
+	if ! t.Permissions.Allows(other.Permissions) {
+		return false
+	} else if len(t.Checklists) == 0 {
+		return true
+	} else if len(other.Checklists) == 0 {
+		return false
+	}
+	for _, pattern := range other.Checklists {
+		covered := false
+		for _, own := range t.Checklists {
+			if own == pattern {
+				covered = true
+			} else if ! strings.ContainsAny(pattern, "*?[\\") {
+				matched, err := path.Match(own, pattern)
+				covered = err == nil && matched
+			}
+			if covered {
+				break
+			}
+		}
+		if ! covered {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *SecurityInfo) AddToken(permissions PermissionFlags, expiryHours int, description string, checklists []string) (*Token, *errors.PreflightError) {
+	for _, pattern := range checklists {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return nil, &errors.PreflightError{
+				Status: 400,
+				Cause: err,
+				InternalMessage: "security.AddToken: bad checklist pattern \"" +
+					pattern + "\": \n\t" + err.Error(),
+				ExternalMessage: "Checklist pattern \"" + pattern + "\" is invalid.",
+			}
+		}
+	}
+
+	if expiryHours <= 0 && expiryHours != NO_EXPIRY {
 		return nil, &errors.PreflightError{
-			Status: 500,
-			InternalMessage: "security.AddToken: error generating secret: " +
-				"\n\t" + err.Error(),
-			ExternalMessage: "There was an error creating the token.",
+			Status: 400,
+			Code: errors.CODE_INVALID_PARAMETER,
+			InternalMessage: fmt.Sprintf("security.AddToken: bad expiry hours %d", expiryHours),
+			ExternalMessage: "Token expiry hours must be positive, unless the token is set not to expire.",
 		}
 	}
-	secretPattern := fmt.Sprintf("%%0%dx", SECRET_BITS/4)
-	secret := fmt.Sprintf(secretPattern, intSecret)
+
+	id, pErr := GenerateId()
+	if pErr != nil {
+		return nil, pErr.Prepend("security.AddToken: error generating id: ")
+	}
+
+	secret, pErr := generateSecret()
+	if pErr != nil {
+		return nil, pErr.Prepend("security.AddToken: error generating secret: ")
+	}
 
 	token := Token{
 		Id: id,
-		Secret: secret,
+		Hash: HashTokenSecret(secret),
 		Permissions: permissions,
-		Expiry: expiry,
 		Description: description,
+		Checklists: checklists,
+	}
+	if expiryHours == NO_EXPIRY {
+		token.NoExpiry = true
+	} else {
+		token.Expiry = time.Now().Add(time.Duration(expiryHours)*time.Hour)
 	}
 
 	s.Tokens = append(s.Tokens, token)
 
+	token.Secret = id + secret
 	return &token, nil
 }
 
+/*
+ * replaces the plaintext secrets of tokens issued before secrets were hashed
+ * with their hashes, returning whether any were changed
+ */
+func (s *SecurityInfo) HashTokenSecrets() bool {
+	changed := false
+	for i, token := range s.Tokens {
+		if token.Secret != "" {
+			s.Tokens[i].Hash = HashTokenSecret(token.Secret)
+			s.Tokens[i].Secret = ""
+			changed = true
+		}
+	}
+	return changed
+}
+
 func (s *SecurityInfo) DeleteToken(id string) *errors.PreflightError {
 	for i, token := range s.Tokens {
 		if token.Id == id {
@@ -167,22 +379,233 @@ func (s *SecurityInfo) DeleteToken(id string) *errors.PreflightError {
 
 	return &errors.PreflightError{
 		Status: 404,
+		Code: errors.CODE_TOKEN_NOT_FOUND,
 		InternalMessage: "security.DeleteToken: token \""+id+"\" not found",
 		ExternalMessage: "Token not found",
 	}
 }
 
-func GenerateNodeSecret() (string, *errors.PreflightError) {
+/*
+ * gives the token a new secret, accepting the old one for grace, and returns
+ * the token with its new secret; if expiryHours is positive, the token is
+ * also renewed to expire that many hours from now
+ */
+func (s *SecurityInfo) RotateToken(id string, grace time.Duration, expiryHours int) (*Token, *errors.PreflightError) {
+	var token *Token
+	for i, _ := range s.Tokens {
+		if s.Tokens[i].Id == id {
+			token = &s.Tokens[i]
+			break
+		}
+	}
+	if token == nil {
+		return nil, &errors.PreflightError{
+			Status: 404,
+			Code: errors.CODE_TOKEN_NOT_FOUND,
+			InternalMessage: "security.RotateToken: token \"" + id + "\" not found",
+			ExternalMessage: "Token not found",
+		}
+	}
+
+	now := time.Now()
+	if token.Expired(now) {
+		return nil, &errors.PreflightError{
+			Status: 422,
+			Code: errors.CODE_TOKEN_EXPIRED,
+			InternalMessage: "security.RotateToken: token \"" + id + "\" is expired",
+			ExternalMessage: "The token is expired.",
+		}
+	}
+
+	secret, err := generateSecret()
+	if err != nil {
+		return nil, err.Prepend("security.RotateToken: error generating secret: ")
+	}
+	if grace > 0 {
+		token.PreviousHash = token.Hash
+		token.PreviousExpiry = now.Add(grace)
+	} else {
+		token.PreviousHash = ""
+		token.PreviousExpiry = time.Time{}
+	}
+	token.Hash = HashTokenSecret(secret)
+	if expiryHours > 0 && ! token.NoExpiry {
+		token.Expiry = now.Add(time.Duration(expiryHours)*time.Hour)
+	}
+
+	rotated := *token
+	rotated.Secret = id + secret
+	return &rotated, nil
+}
+
+/*
+ * removes expired tokens, with their refresh tokens, expired authorization
+ * codes, refresh tokens and reset tokens, and forgets secrets whose grace
+ * period after rotation has ended, returning the ids of the removed tokens and
+ * whether anything changed
+ */
+func (s *SecurityInfo) SweepTokens(now time.Time) ([]string, bool) {
+	removed := make([]string, 0)
+	changed := false
+	kept := make([]Token, 0, len(s.Tokens))
+	for _, token := range s.Tokens {
+		if token.Expired(now) {
+			removed = append(removed, token.Id)
+			changed = true
+			continue
+		}
+		if token.PreviousHash != "" && ! now.Before(token.PreviousExpiry) {
+			token.PreviousHash = ""
+			token.PreviousExpiry = time.Time{}
+			changed = true
+		}
+		kept = append(kept, token)
+	}
+	if changed {
+		s.Tokens = kept
+		s.DropRefreshTokens(removed)
+	}
+	if s.sweepOAuth(now) {
+		changed = true
+	}
+	if s.PasswordReset != nil && now.After(s.PasswordReset.Expiry) {
+		s.PasswordReset = nil
+		changed = true
+	}
+	return removed, changed
+}
+
+/*
+ * deletes every token but keepId, which may be empty to delete them all, any
+ * outstanding authorization codes, and every refresh token but keepId's,
+ * including those whose access tokens have already been removed, and returns
+ * the ids of the tokens deleted
+ */
+func (s *SecurityInfo) RevokeTokens(keepId string) []string {
+	revoked := make([]string, 0)
+	kept := make([]Token, 0, 1)
+	for _, token := range s.Tokens {
+		if token.Id == keepId {
+			kept = append(kept, token)
+		} else {
+			revoked = append(revoked, token.Id)
+		}
+	}
+	s.Tokens = kept
+	s.OAuthCodes = nil
+
+	refreshTokens := make([]RefreshToken, 0, 1)
+	for _, r := range s.RefreshTokens {
+		if keepId != "" && r.AccessTokenId == keepId {
+			refreshTokens = append(refreshTokens, r)
+		}
+	}
+	s.RefreshTokens = refreshTokens
+	return revoked
+}
+
+/*
+ * replaces any outstanding reset token with a new one, valid for validFor, and
+ * returns it as presented to the user
+ */
+func (s *SecurityInfo) IssueResetToken(validFor time.Duration) (string, time.Time, *errors.PreflightError) {
+	id, err := GenerateId()
+	if err != nil {
+		return "", time.Time{}, err.Prepend("security.IssueResetToken: error generating id: ")
+	}
+	secret, err := generateSecret()
+	if err != nil {
+		return "", time.Time{}, err.Prepend("security.IssueResetToken: error generating secret: ")
+	}
+
+	s.PasswordReset = &ResetToken{
+		Id: id,
+		Hash: HashTokenSecret(secret),
+		Expiry: time.Now().Add(validFor),
+	}
+	return id + secret, s.PasswordReset.Expiry, nil
+}
+
+/*
+ * checks a presented reset token and, if it is valid, uses it up; an expired
+ * token is also removed
+ */
+func (s *SecurityInfo) UseResetToken(presented string) *errors.PreflightError {
+	id, secret := ParseToken(presented)
+	reset := s.PasswordReset
+	if reset == nil || id != reset.Id ||
+		! hmac.Equal([]byte(HashTokenSecret(secret)), []byte(reset.Hash)) {
+		return &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_RESET_TOKEN_INVALID,
+			InternalMessage: "security.UseResetToken: reset token not found",
+			ExternalMessage: "The password reset token was not recognized.",
+		}
+	}
+
+	s.PasswordReset = nil
+	if time.Now().After(reset.Expiry) {
+		return &errors.PreflightError{
+			Status: 401,
+			Code: errors.CODE_RESET_TOKEN_EXPIRED,
+			InternalMessage: "security.UseResetToken: reset token expired",
+			ExternalMessage: "The password reset token is expired.",
+		}
+	}
+	return nil
+}
+
+func generateSecret() (string, *errors.PreflightError) {
 	secretMax := big.NewInt(0).Exp(big.NewInt(2), big.NewInt(SECRET_BITS), nil)
 	intSecret, err := rand.Int(rand.Reader, secretMax)
 	if err != nil {
 		return "", &errors.PreflightError{
 			Status: 500,
-			InternalMessage: "security.GenerateNodeSecret: error generating secret: " +
+			Cause: err,
+			InternalMessage: "security.generateSecret: error generating secret: " +
 				"\n\t" + err.Error(),
-			ExternalMessage: "There was an error registering the node.",
+			ExternalMessage: "There was an error.",
 		}
 	}
 	secretPattern := fmt.Sprintf("%%0%dx", SECRET_BITS/4)
 	return fmt.Sprintf(secretPattern, intSecret), nil
 }
+
+func GenerateId() (string, *errors.PreflightError) {
+	idMax := big.NewInt(0).Exp(big.NewInt(2), big.NewInt(ID_BITS), nil)
+	intId, err := rand.Int(rand.Reader, idMax)
+	if err != nil {
+		return "", &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "security.GenerateId: error generating id: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
+		}
+	}
+	idPattern := fmt.Sprintf("%%0%dx", ID_BITS/4)
+	return fmt.Sprintf(idPattern, intId), nil
+}
+
+func GenerateNodeSecret() (string, *errors.PreflightError) {
+	secret, err := generateSecret()
+	if err != nil {
+		return "", err.Prepend("security.GenerateNodeSecret: error generating secret: ")
+	}
+	return secret, nil
+}
+
+func GenerateTokenKey() (string, *errors.PreflightError) {
+	key := make([]byte, TOKEN_KEY_BYTES)
+	_, err := rand.Read(key)
+	if err != nil {
+		return "", &errors.PreflightError{
+			Status: 500,
+			Cause: err,
+			InternalMessage: "security.GenerateTokenKey: error generating key: " +
+				"\n\t" + err.Error(),
+			ExternalMessage: "There was an error.",
+		}
+	}
+	return hex.EncodeToString(key), nil
+}
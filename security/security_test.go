@@ -1,7 +1,9 @@
 package security
 
 import (
+	"github.com/jsutton9/preflight/api/errors"
 	"testing"
+	"time"
 )
 
 func TestPassword(t *testing.T) {
@@ -30,7 +32,7 @@ func TestValidateToken(t *testing.T) {
 	noPermissions := PermissionFlags{}
 	wrongPermissions := PermissionFlags{ChecklistWrite:true}
 
-	token, err := sec.AddToken(permissions, 24, "foo")
+	token, err := sec.AddToken(permissions, 24, "foo", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -40,25 +42,31 @@ func TestValidateToken(t *testing.T) {
 		t.Logf("\texpected %d char id, got %s", ID_BITS/4, token.Id)
 		t.Fail()
 	}
-	if len(token.Secret) != SECRET_BITS/4 {
+	if len(token.Secret) != (ID_BITS+SECRET_BITS)/4 || token.Secret[:ID_BITS/4] != token.Id {
 		t.Log("test failure, AddToken: ")
-		t.Logf("\texpected %d char secret, got %s", SECRET_BITS/4, token.Secret)
+		t.Logf("\texpected id followed by %d char secret, got %s", SECRET_BITS/4, token.Secret)
 		t.Fail()
 	}
+	for _, stored := range sec.Tokens {
+		if stored.Secret != "" || stored.Hash == "" {
+			t.Log("test failure, AddToken: expected only hash stored, got secret")
+			t.Fail()
+		}
+	}
 
-	if sec.ValidateToken(token.Secret, permissions) != nil {
+	if sec.ValidateToken(token.Secret, permissions, "") != nil {
 		t.Log("test failure, ValidateToken: expected nil, got error")
 		t.Fail()
 	}
-	if sec.ValidateToken(token.Secret, noPermissions) != nil {
+	if sec.ValidateToken(token.Secret, noPermissions, "") != nil {
 		t.Log("test failure, ValidateToken: expected nil, got error")
 		t.Fail()
 	}
-	if sec.ValidateToken(token.Secret, wrongPermissions) == nil {
+	if sec.ValidateToken(token.Secret, wrongPermissions, "") == nil {
 		t.Log("test failure, ValidateToken: expected error, got nil")
 		t.Fail()
 	}
-	if sec.ValidateToken("wrong secret", permissions) == nil {
+	if sec.ValidateToken("wrong secret", permissions, "") == nil {
 		t.Log("test failure, ValidateToken: expected error, got nil")
 		t.Fail()
 	}
@@ -72,7 +80,7 @@ func TestDeleteToken(t *testing.T) {
 
 	permissions := PermissionFlags{ChecklistRead:true}
 
-	token, err := sec.AddToken(permissions, 24, "foo")
+	token, err := sec.AddToken(permissions, 24, "foo", nil)
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -81,8 +89,505 @@ func TestDeleteToken(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if sec.ValidateToken(token.Secret, permissions) == nil {
+	if sec.ValidateToken(token.Secret, permissions, "") == nil {
 		t.Log("test failure, ValidateToken: expected error, got nil")
 		t.Fail()
 	}
 }
+
+func TestRevokeTokens(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions := PermissionFlags{ChecklistRead:true}
+	kept, err := sec.AddToken(permissions, 24, "kept", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	revoked, err := sec.AddToken(permissions, 24, "revoked", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sec.IssueOAuthCode("client", "https://example.com/callback",
+		PKCEChallenge("a-verifier-of-at-least-forty-three-characters-long"), permissions, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ids := sec.RevokeTokens(kept.Id)
+	if len(ids) != 1 || ids[0] != revoked.Id {
+		t.Logf("revoked ids wrong: expected [%s], got %v", revoked.Id, ids)
+		t.Fail()
+	}
+	if sec.ValidateToken(kept.Secret, permissions, "") != nil {
+		t.Log("test failure: kept token invalid")
+		t.Fail()
+	}
+	if sec.ValidateToken(revoked.Secret, permissions, "") == nil {
+		t.Log("test failure: revoked token still valid")
+		t.Fail()
+	}
+	if len(sec.OAuthCodes) != 0 {
+		t.Logf("test failure: authorization codes outstanding after revocation: %+v", sec.OAuthCodes)
+		t.Fail()
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions := PermissionFlags{ChecklistRead:true}
+	_, err = sec.AddToken(permissions, 0, "no expiry given", nil)
+	if err == nil {
+		t.Log("test failure: added token with no expiry and no flag")
+		t.Fail()
+	}
+	token, err := sec.AddToken(permissions, NO_EXPIRY, "never expires", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ! token.NoExpiry || token.Expired(time.Now().Add(100000 * time.Hour)) {
+		t.Log("test failure: token added with NO_EXPIRY expires")
+		t.Fail()
+	}
+}
+
+func TestRotateToken(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions := PermissionFlags{ChecklistRead:true}
+	old, err := sec.AddToken(permissions, 24, "foo", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rotated, err := sec.RotateToken(old.Id, time.Hour, 48)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rotated.Id != old.Id || rotated.Secret == old.Secret {
+		t.Logf("test failure: expected same id and new secret, got %s and %s", rotated.Id, rotated.Secret)
+		t.Fail()
+	}
+	if ! rotated.Expiry.After(old.Expiry) {
+		t.Log("test failure: rotation did not renew expiry")
+		t.Fail()
+	}
+	if sec.ValidateToken(rotated.Secret, permissions, "") != nil {
+		t.Log("test failure: new secret invalid")
+		t.Fail()
+	}
+	if sec.ValidateToken(old.Secret, permissions, "") != nil {
+		t.Log("test failure: old secret invalid during grace period")
+		t.Fail()
+	}
+
+	_, err = sec.RotateToken(old.Id, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.ValidateToken(rotated.Secret, permissions, "") == nil {
+		t.Log("test failure: secret still valid after rotation without grace")
+		t.Fail()
+	}
+	if _, err = sec.RotateToken("missing", time.Hour, 0); err == nil {
+		t.Log("test failure: rotated missing token")
+		t.Fail()
+	}
+
+	sec.Tokens = append(sec.Tokens, Token{Id: "expired", Expiry: time.Now().Add(-time.Minute)})
+	if _, err = sec.RotateToken("expired", time.Hour, 24); err == nil || err.Code != errors.CODE_TOKEN_EXPIRED {
+		t.Logf("test failure: expected expired token error, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestSweepTokens(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions := PermissionFlags{ChecklistRead:true}
+	expiring, err := sec.AddToken(permissions, 1, "expiring", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lasting, err := sec.AddToken(permissions, 48, "lasting", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = sec.RotateToken(lasting.Id, time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = sec.IssueResetToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, changed := sec.SweepTokens(time.Now())
+	if len(removed) != 0 || changed {
+		t.Logf("test failure: swept unexpired tokens: %v", removed)
+		t.Fail()
+	}
+	removed, changed = sec.SweepTokens(time.Now().Add(2 * time.Hour))
+	if len(removed) != 1 || removed[0] != expiring.Id || ! changed {
+		t.Logf("swept tokens wrong: expected [%s], got %v", expiring.Id, removed)
+		t.Fail()
+	}
+	if len(sec.Tokens) != 1 || sec.Tokens[0].PreviousHash != "" {
+		t.Logf("test failure: expected one token without previous secret, got %+v", sec.Tokens)
+		t.Fail()
+	}
+	if sec.PasswordReset != nil {
+		t.Log("test failure: expired reset token not swept")
+		t.Fail()
+	}
+}
+
+func TestResetToken(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sec.UseResetToken("") == nil {
+		t.Log("test failure: used reset token before one was issued")
+		t.Fail()
+	}
+
+	first, _, err := sec.IssueResetToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, _, err := sec.IssueResetToken(time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.PasswordReset.Hash == second[ID_BITS/4:] {
+		t.Log("test failure: reset token secret stored unhashed")
+		t.Fail()
+	}
+	if sec.UseResetToken(first) == nil {
+		t.Log("test failure: used replaced reset token")
+		t.Fail()
+	}
+	if err := sec.UseResetToken(second); err != nil {
+		t.Logf("error using reset token: %s", err.Error())
+		t.Fail()
+	}
+	if sec.UseResetToken(second) == nil {
+		t.Log("test failure: used reset token twice")
+		t.Fail()
+	}
+
+	expired, _, err := sec.IssueResetToken(-time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sec.UseResetToken(expired)
+	if err == nil || err.Code != errors.CODE_RESET_TOKEN_EXPIRED {
+		t.Logf("test failure: expected expired reset token error, got %v", err)
+		t.Fail()
+	}
+}
+
+func TestHashTokenSecrets(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	permissions := PermissionFlags{ChecklistRead:true}
+	sec.Tokens = append(sec.Tokens, Token{
+		Id: "0123456789abcdef",
+		Secret: "fedcba9876543210",
+		Permissions: permissions,
+		Expiry: time.Now().Add(time.Hour),
+	})
+
+	if sec.ValidateToken("fedcba9876543210", permissions, "") == nil {
+		t.Log("test failure, ValidateToken: expected error before hashing, got nil")
+		t.Fail()
+	}
+	if ! sec.HashTokenSecrets() {
+		t.Log("test failure, HashTokenSecrets: expected changed, got unchanged")
+		t.Fail()
+	}
+	if sec.Tokens[0].Secret != "" {
+		t.Log("test failure, HashTokenSecrets: plaintext secret kept")
+		t.Fail()
+	}
+	if sec.ValidateToken("fedcba9876543210", permissions, "") != nil {
+		t.Log("test failure, ValidateToken: expected nil for legacy secret, got error")
+		t.Fail()
+	}
+	if sec.ValidateToken("0123456789abcdeffedcba9876543210", permissions, "") != nil {
+		t.Log("test failure, ValidateToken: expected nil for id and secret, got error")
+		t.Fail()
+	}
+	if sec.HashTokenSecrets() {
+		t.Log("test failure, HashTokenSecrets: expected unchanged, got changed")
+		t.Fail()
+	}
+}
+
+func TestTokenScope(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	invoke := PermissionFlags{ChecklistInvoke:true, GeneralRead:true}
+	token, err := sec.AddToken(invoke, 24, "button", []string{"morning", "evening-*"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if sec.ValidateToken(token.Secret, invoke, "morning") != nil {
+		t.Log("test failure, ValidateToken \"morning\": expected nil, got error")
+		t.Fail()
+	}
+	if sec.ValidateToken(token.Secret, invoke, "evening-weekday") != nil {
+		t.Log("test failure, ValidateToken \"evening-weekday\": expected nil, got error")
+		t.Fail()
+	}
+	if sec.ValidateToken(token.Secret, invoke, "night") == nil {
+		t.Log("test failure, ValidateToken \"night\": expected error, got nil")
+		t.Fail()
+	}
+	if sec.ValidateToken(token.Secret, invoke, "") == nil {
+		t.Log("test failure, ValidateToken all checklists: expected error, got nil")
+		t.Fail()
+	}
+	if sec.ValidateToken(token.Secret, PermissionFlags{GeneralRead:true}, "") != nil {
+		t.Log("test failure, ValidateToken general: expected nil, got error")
+		t.Fail()
+	}
+
+	_, err = sec.AddToken(invoke, 24, "bad", []string{"[morning"})
+	if err == nil {
+		t.Log("test failure, AddToken with bad pattern: expected error, got nil")
+		t.Fail()
+	}
+}
+
+func TestTokenCovers(t *testing.T) {
+	write := PermissionFlags{GeneralWrite:true}
+	both := PermissionFlags{ChecklistRead:true, GeneralWrite:true}
+	cases := []struct{
+		token Token
+		other Token
+		covers bool
+	}{
+		{Token{Permissions: both}, Token{Permissions: write, Checklists: []string{"morning"}}, true},
+		{Token{Permissions: write, Checklists: []string{"morning"}}, Token{Permissions: both}, false},
+		{Token{Permissions: write, Checklists: []string{"morning"}}, Token{Permissions: write}, false},
+		{Token{Permissions: write, Checklists: []string{"evening-*"}},
+			Token{Permissions: write, Checklists: []string{"evening-*", "evening-late"}}, true},
+		{Token{Permissions: write, Checklists: []string{"evening-*"}},
+			Token{Permissions: write, Checklists: []string{"evening*"}}, false},
+		{Token{Permissions: write, Checklists: []string{"morning"}},
+			Token{Permissions: write, Checklists: []string{"morning", "night"}}, false},
+	}
+	for i, c := range cases {
+		if covers := c.token.Covers(c.other); covers != c.covers {
+			t.Logf("test failure, case %d: expected %v, got %v", i, c.covers, covers)
+			t.Fail()
+		}
+	}
+}
+
+func TestScopes(t *testing.T) {
+	permissions, err := ParseScopes("general:read  checklist:invoke checklist:read")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := PermissionFlags{ChecklistRead: true, ChecklistInvoke: true, GeneralRead: true}
+	if permissions != expected {
+		t.Logf("permissions wrong: expected %+v, got %+v", expected, permissions)
+		t.Fail()
+	}
+	if scope := permissions.Scope(); scope != "checklist:invoke checklist:read general:read" {
+		t.Logf("scope wrong: got \"%s\"", scope)
+		t.Fail()
+	}
+
+	for _, scope := range []string{"", "checklist:read admin"} {
+		_, err = ParseScopes(scope)
+		if err == nil || err.Code != errors.CODE_INVALID_SCOPE {
+			t.Logf("test failure: expected invalid scope error for \"%s\", got %v", scope, err)
+			t.Fail()
+		}
+	}
+}
+
+func TestOAuthCode(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions := PermissionFlags{ChecklistRead: true}
+	verifier := "a-verifier-of-at-least-forty-three-characters-long"
+	challenge := PKCEChallenge(verifier)
+	uri := "https://example.com/callback"
+
+	issue := func() string {
+		code, err := sec.IssueOAuthCode("client", uri, challenge, permissions, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	code := issue()
+	used, err := sec.UseOAuthCode(code, "client", uri, verifier)
+	if err != nil {
+		t.Fatal(err.Prepend("error using code: "))
+	}
+	if used.Permissions != permissions {
+		t.Logf("permissions wrong: expected %+v, got %+v", permissions, used.Permissions)
+		t.Fail()
+	}
+	if _, err = sec.UseOAuthCode(code, "client", uri, verifier); err == nil {
+		t.Log("test failure: code used twice")
+		t.Fail()
+	}
+
+	wrong := []struct{
+		name string
+		clientId string
+		uri string
+		verifier string
+	}{
+		{"client", "other", uri, verifier},
+		{"redirect uri", "client", "https://example.com/other", verifier},
+		{"verifier", "client", uri, "wrong-verifier"},
+	}
+	for _, w := range wrong {
+		code = issue()
+		_, err = sec.UseOAuthCode(code, w.clientId, w.uri, w.verifier)
+		if err == nil || err.Code != errors.CODE_INVALID_GRANT {
+			t.Logf("test failure: expected invalid grant with wrong %s, got %v", w.name, err)
+			t.Fail()
+		}
+		if _, err = sec.UseOAuthCode(code, "client", uri, verifier); err == nil {
+			t.Logf("test failure: code usable after use with wrong %s", w.name)
+			t.Fail()
+		}
+	}
+
+	expired, err := sec.IssueOAuthCode("client", uri, challenge, permissions, -time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sec.UseOAuthCode(expired, "client", uri, verifier); err == nil {
+		t.Log("test failure: expired code used")
+		t.Fail()
+	}
+}
+
+func TestRefreshToken(t *testing.T) {
+	sec, err := New("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	permissions := PermissionFlags{GeneralRead: true}
+	access, err := sec.AddClientToken("client", permissions, 1, "OAuth client test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sec.Tokens[0].ClientId != "client" {
+		t.Logf("test failure: stored token has client id \"%s\"", sec.Tokens[0].ClientId)
+		t.Fail()
+	}
+
+	refresh, err := sec.IssueRefreshToken("client", permissions, access.Id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = sec.UseRefreshToken(refresh, "other"); err == nil {
+		t.Log("test failure: refresh token used by other client")
+		t.Fail()
+	}
+	if _, err = sec.UseRefreshToken(refresh, "client"); err == nil {
+		t.Log("test failure: refresh token usable after use by other client")
+		t.Fail()
+	}
+
+	refresh, err = sec.IssueRefreshToken("client", permissions, access.Id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	used, err := sec.UseRefreshToken(refresh, "client")
+	if err != nil {
+		t.Fatal(err.Prepend("error using refresh token: "))
+	}
+	if used.AccessTokenId != access.Id || used.Permissions != permissions {
+		t.Logf("refresh token wrong: got %+v", used)
+		t.Fail()
+	}
+	if _, err = sec.UseRefreshToken(refresh, "client"); err == nil {
+		t.Log("test failure: refresh token used twice")
+		t.Fail()
+	}
+
+	_, err = sec.IssueRefreshToken("client", permissions, access.Id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec.RevokeTokens("")
+	if len(sec.RefreshTokens) != 0 {
+		t.Logf("test failure: refresh tokens kept after revoking their access tokens: %+v", sec.RefreshTokens)
+		t.Fail()
+	}
+
+	// a refresh token whose access token has expired and been swept is
+	// revoked with the rest
+	expired, err := sec.AddClientToken("client", permissions, 1, "OAuth client test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec.Tokens[0].Expiry = time.Now().Add(-time.Minute)
+	refresh, err = sec.IssueRefreshToken("client", permissions, expired.Id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec.SweepTokens(time.Now())
+	sec.RevokeTokens("")
+	if _, err = sec.UseRefreshToken(refresh, "client"); err == nil {
+		t.Log("test failure: refresh token of swept access token usable after revocation")
+		t.Fail()
+	}
+
+	// as is one whose access token is gone for any other reason, but not
+	// that of the token kept
+	kept, err := sec.AddClientToken("client", permissions, 1, "OAuth client test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keptRefresh, err := sec.IssueRefreshToken("client", permissions, kept.Id, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	refresh, err = sec.IssueRefreshToken("client", permissions, "gone", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sec.RevokeTokens(kept.Id)
+	if _, err = sec.UseRefreshToken(refresh, "client"); err == nil {
+		t.Log("test failure: refresh token of missing access token usable after revocation")
+		t.Fail()
+	}
+	if _, err = sec.UseRefreshToken(keptRefresh, "client"); err != nil {
+		t.Logf("error using refresh token of kept token: %s", err.Error())
+		t.Fail()
+	}
+}
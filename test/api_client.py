@@ -12,16 +12,22 @@ class Client:
         with open(secret_file, "r") as f:
             self.node_secret = f.read().strip()
 
+    def token_headers(self):
+        return {"Authorization": "Bearer " + self.token}
+
+    def node_headers(self):
+        return {"X-Preflight-Node-Secret": self.node_secret}
+
     def add_user(self, email, password):
-        url = self.target + "/users?nodeSecret=" + self.node_secret
+        url = self.target + "/users"
         body = {"email": email, "password": password}
-        response = requests.post(url, json.dumps(body), verify=self.verify)
+        response = requests.post(url, json.dumps(body), headers=self.node_headers(), verify=self.verify)
         response.raise_for_status()
         return response.content
 
     def delete_user(self, userId):
-        url = self.target + "/users/%s?nodeSecret=%s" % (userId, self.node_secret)
-        response = requests.delete(url, verify=self.verify)
+        url = self.target + "/users/%s" % userId
+        response = requests.delete(url, headers=self.node_headers(), verify=self.verify)
         response.raise_for_status()
 
     def authorize(self, email, password, permissions):
@@ -31,78 +37,107 @@ class Client:
         self.token = token["secret"]
         return self.token
 
-    def change_password(self, newPassword):
-        url = self.target + "/password?token=" + self.token
-        response = requests.post(url, newPassword, verify=self.verify)
+    def change_password(self, newPassword, revokeOtherTokens=False):
+        url = self.target + "/password"
+        body = {"currentPassword": self.password,
+                "newPassword": newPassword,
+                "revokeOtherTokens": revokeOtherTokens}
+        response = requests.post(url, json.dumps(body), headers=self.token_headers(), verify=self.verify)
+        response.raise_for_status()
+        self.password = newPassword
+
+    def issue_password_reset(self, userId):
+        url = self.target + "/users/%s/passwordReset" % userId
+        response = requests.post(url, "", headers=self.node_headers(), verify=self.verify)
+        response.raise_for_status()
+        return response.json()
+
+    def reset_password(self, email, resetToken, newPassword):
+        url = self.target + "/password/reset"
+        body = {"email": email, "resetToken": resetToken, "newPassword": newPassword}
+        response = requests.post(url, json.dumps(body), verify=self.verify)
         response.raise_for_status()
 
     def invoke_checklist(self, name):
-        url = "%s/checklists/%s/invoke?token=%s" % (self.target, name, self.token)
-        response = requests.post(url, "", verify=self.verify)
+        url = "%s/checklists/%s/invoke" % (self.target, name)
+        response = requests.post(url, "", headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
 
     def add_checklist(self, name, checklist):
-        url = self.target + "/checklists?token=" + self.token
+        url = self.target + "/checklists"
         req = {"name": name,
                 "checklist": checklist}
-        response = requests.post(url, json.dumps(req), verify=self.verify)
+        response = requests.post(url, json.dumps(req), headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
         return response.headers["Location"]
 
     def update_checklist(self, name, checklist):
-        url = "%s/checklists/%s?token=%s" % (self.target, name, self.token)
-        response = requests.put(url, json.dumps(checklist), verify=self.verify)
+        url = "%s/checklists/%s" % (self.target, name)
+        response = requests.put(url, json.dumps(checklist), headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
 
     def delete_checklist(self, name):
-        url = "%s/checklists/%s?token=%s" % (self.target, name, self.token)
-        response = requests.delete(url, verify=self.verify)
+        url = "%s/checklists/%s" % (self.target, name)
+        response = requests.delete(url, headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
 
     def get_checklists(self):
-        url = self.target + "/checklists?token=" + self.token
-        response = requests.get(url, verify=self.verify)
+        url = self.target + "/checklists"
+        response = requests.get(url, headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
         return response.json()
 
     def get_checklist(self, name):
-        url = "%s/checklists/%s?token=%s" % (self.target, name, self.token)
-        response = requests.get(url, verify=self.verify)
+        url = "%s/checklists/%s" % (self.target, name)
+        response = requests.get(url, headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
         return response.json()
 
     def update_global_setting(self, name, value):
-        url = "%s/settings/%s?token=%s" % (self.target, name, self.token)
-        response = requests.put(url, str(value), verify=self.verify)
+        url = "%s/settings/%s" % (self.target, name)
+        response = requests.put(url, str(value), headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
 
     def get_global_settings(self):
-        url = self.target + "/settings?token=" + self.token
-        response = requests.get(url, verify=self.verify)
+        url = self.target + "/settings"
+        response = requests.get(url, headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
         return response.json()
 
     def force_update(self):
-        url = self.target + "/force-update?token=" + self.token
-        response = requests.post(url, "", verify=self.verify)
+        url = self.target + "/force-update"
+        response = requests.post(url, "", headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
 
     def get_tokens(self):
-        url = self.target + "/tokens?token=" + self.token
-        response = requests.get(url, verify=self.verify)
+        url = self.target + "/tokens"
+        response = requests.get(url, headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
         return response.json()
 
-    def add_token(self, permissions):
+    def add_token(self, permissions, checklists=None):
         req = {"permissions": permissions,
                 "expiryHours": 24,
                 "description": "api test client"}
+        if checklists is not None:
+            req["checklists"] = checklists
         url = self.target + "/tokens"
         response = requests.post(url, json.dumps(req), auth=(self.email, self.password), verify=self.verify)
         response.raise_for_status()
         return response.json()
 
     def delete_token(self, token_id):
-        url = self.target + "/tokens/%s?token=%s" % (token_id, self.token)
-        response = requests.delete(url, verify=self.verify)
+        url = self.target + "/tokens/%s" % token_id
+        response = requests.delete(url, headers=self.token_headers(), verify=self.verify)
         response.raise_for_status()
+
+    def get_audit_log(self, limit=None, before=None):
+        params = {}
+        if limit is not None:
+            params["limit"] = limit
+        if before is not None:
+            params["before"] = before
+        url = self.target + "/audit"
+        response = requests.get(url, params=params, headers=self.token_headers(), verify=self.verify)
+        response.raise_for_status()
+        return response.json()